@@ -1,73 +1,220 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
 
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/lometsj/code_server/pkg/types"
 	"github.com/lometsj/code_server/static_binary/linux"
 )
 
-type SymbolInfo struct {
-	Name    string `json:"name"`
-	Kind    string `json:"kind"`
-	Line    int    `json:"line"`
-	End     int    `json:"end"`
-	Content string `json:"content"`
-	File    string `json:"file"`
-	Typeref string `json:"typeref,omitempty"`
+// callerEntry 去重后的一个调用者及其包含的引用
+type callerEntry struct {
+	// content 调用者代码，分页后只读取返回的调用者，未读取时为空
+	content string
+	refs    []types.RefMatch
+	// codeRange 调用者代码的完整范围
+	codeRange types.CodeRange
+}
+
+// callerEmitter 流式输出调用者的回调，index为调用者在去重后列表中的下标；
+// refsOnly为true时entry只包含第index个调用者中新找到的引用。返回错误时停止查找
+type callerEmitter func(index int, entry callerEntry, refsOnly bool) error
+
+type CodeAnalyzer struct {
+	// name 代码仓库名称，用于在结果中标明来源
+	name    string
+	codeDir string
+	// tagsDir 存放tags、GTAGS等索引文件的目录，默认为codeDir/.tsj
+	tagsDir string
+	dataDir string
+	// binaryDir 外部工具所在目录，为空时从PATH查找
+	binaryDir string
+	// ownsBinaryDir binaryDir是提取内置二进制文件时创建的临时目录，Close时删除
+	ownsBinaryDir bool
+	refCache      *refCache
+	// symbolCache 按文件缓存ctags解析结果
+	symbolCache *symbolCache
+	// gtagsLabel、gtagsConf 重建索引和查询引用时传给gtags/global的GTAGSLABEL和GTAGSCONF
+	gtagsLabel string
+	gtagsConf  string
+	// indexMu 重建索引时持有写锁，查询时持有读锁
+	indexMu sync.RWMutex
+	// tagsCheck 缓存tags文件格式的检查结果，tags文件变化后重新检查
+	tagsCheck tagsFormatCheck
 }
 
-type SymbolResponse struct {
-	Status  string       `json:"status"`
-	ResList []SymbolInfo `json:"res_list,omitempty"`
-	Error   string       `json:"error,omitempty"`
+// analyzerBinaries CodeAnalyzer调用的外部工具
+var analyzerBinaries = []string{"ctags", "readtags", "global", "gtags"}
+
+// analyzerOptions NewCodeAnalyzer的可选配置
+type analyzerOptions struct {
+	binaryDir      string
+	systemBinaries bool
 }
 
-type RefResponse struct {
-	Callers []string `json:"callers"`
-	Error   string   `json:"error,omitempty"`
+// AnalyzerOption 修改NewCodeAnalyzer的默认行为
+type AnalyzerOption func(*analyzerOptions)
+
+// WithBinaryDir 使用dir中已有的ctags、readtags、global、gtags，不再提取内置二进制文件
+func WithBinaryDir(dir string) AnalyzerOption {
+	return func(o *analyzerOptions) {
+		o.binaryDir = dir
+	}
 }
 
-type CodeAnalyzer struct {
-	codeDir   string
-	dataDir   string
-	binaryDir string
+// WithSystemBinaries 从PATH中查找ctags、readtags、global、gtags，不再提取内置二进制文件
+func WithSystemBinaries() AnalyzerOption {
+	return func(o *analyzerOptions) {
+		o.systemBinaries = true
+	}
 }
 
-func NewCodeAnalyzer(codeDir, dataDir string) *CodeAnalyzer {
+func NewCodeAnalyzer(codeDir, dataDir string, opts ...AnalyzerOption) *CodeAnalyzer {
 	codeDirAbs, _ := filepath.Abs(codeDir)
 	println(codeDirAbs)
 	dataDirAbs, _ := filepath.Abs(dataDir)
 
-	// 创建临时目录存放二进制文件
-	tempDir, err := os.MkdirTemp("", "code-server-binaries-")
-	if err != nil {
-		log.Fatalf("Failed to create temp directory: %v", err)
+	var options analyzerOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	ca := &CodeAnalyzer{
+		name:    filepath.Base(codeDirAbs),
+		codeDir: codeDirAbs,
+		tagsDir: filepath.Join(codeDirAbs, ".tsj"),
+		dataDir: dataDirAbs,
 	}
 
-	// 提取二进制文件
-	binaries := []string{"ctags", "readtags", "global", "gtags"}
-	for _, binary := range binaries {
-		err := extractBinary(binary, tempDir)
+	switch {
+	case options.binaryDir != "":
+		binaryDir, err := filepath.Abs(options.binaryDir)
+		if err != nil {
+			log.Fatalf("Failed to resolve binary directory %s: %v", options.binaryDir, err)
+		}
+		for _, binary := range analyzerBinaries {
+			if _, err := os.Stat(filepath.Join(binaryDir, binary)); err != nil {
+				log.Fatalf("Binary %s not found in %s: %v", binary, binaryDir, err)
+			}
+		}
+		ca.binaryDir = binaryDir
+	case options.systemBinaries:
+		// binaryDir为空时getBinaryPath返回工具名，由exec按PATH查找
+		for _, binary := range analyzerBinaries {
+			if _, err := exec.LookPath(binary); err != nil {
+				log.Fatalf("Binary %s not found in PATH: %v", binary, err)
+			}
+		}
+	default:
+		// 创建临时目录存放二进制文件
+		tempDir, err := os.MkdirTemp("", "code-server-binaries-")
 		if err != nil {
-			log.Fatalf("Failed to extract %s: %v", binary, err)
+			log.Fatalf("Failed to create temp directory: %v", err)
+		}
+
+		// 提取二进制文件
+		for _, binary := range analyzerBinaries {
+			err := extractBinary(binary, tempDir)
+			if err != nil {
+				log.Fatalf("Failed to extract %s: %v", binary, err)
+			}
 		}
+		ca.binaryDir = tempDir
+		ca.ownsBinaryDir = true
+	}
+
+	return ca
+}
+
+// Close 删除提取内置二进制文件时创建的临时目录，注入的目录不会被删除
+func (ca *CodeAnalyzer) Close() error {
+	if !ca.ownsBinaryDir || ca.binaryDir == "" {
+		return nil
+	}
+	return os.RemoveAll(ca.binaryDir)
+}
+
+// NewRepoAnalyzer 为额外的代码仓库创建分析器，与ca共用二进制文件和配置，缓存相互独立
+func (ca *CodeAnalyzer) NewRepoAnalyzer(name, codeDir, tagsDir string) (*CodeAnalyzer, error) {
+	codeDirAbs, err := filepath.Abs(codeDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve code dir %s: %v", codeDir, err)
+	}
+	if tagsDir == "" {
+		tagsDir = filepath.Join(codeDirAbs, ".tsj")
+	}
+	tagsDirAbs, err := filepath.Abs(tagsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve tags dir %s: %v", tagsDir, err)
+	}
+	if name == "" {
+		name = filepath.Base(codeDirAbs)
 	}
 
 	return &CodeAnalyzer{
-		codeDir:   codeDirAbs,
-		dataDir:   dataDirAbs,
-		binaryDir: tempDir,
+		name:        name,
+		codeDir:     codeDirAbs,
+		tagsDir:     tagsDirAbs,
+		dataDir:     ca.dataDir,
+		binaryDir:   ca.binaryDir,
+		refCache:    ca.refCache.clone(),
+		symbolCache: ca.symbolCache.clone(),
+		gtagsLabel:  ca.gtagsLabel,
+		gtagsConf:   ca.gtagsConf,
+	}, nil
+}
+
+// parseRepoSpec 解析--extra-repo参数，格式为[name=]codeDir[,tagsDir]
+func parseRepoSpec(spec string) (string, string, string) {
+	var name string
+	if i := strings.Index(spec, "="); i >= 0 {
+		name, spec = spec[:i], spec[i+1:]
 	}
+	codeDir, tagsDir, _ := strings.Cut(spec, ",")
+	return name, codeDir, tagsDir
+}
+
+// repoFlags 可重复指定的--extra-repo参数
+type repoFlags []string
+
+func (f *repoFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *repoFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
 
 func extractBinary(name, destDir string) error {
@@ -87,9 +234,47 @@ func extractBinary(name, destDir string) error {
 }
 
 func (ca *CodeAnalyzer) getBinaryPath(name string) string {
+	if ca.binaryDir == "" {
+		return name
+	}
 	return filepath.Join(ca.binaryDir, name)
 }
 
+// maxStderrLen 错误信息中保留的子进程stderr最大长度
+const maxStderrLen = 1024
+
+// toolError 将子进程错误与其stderr输出组合成可读的错误
+func toolError(tool string, err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		stderr := strings.TrimSpace(string(exitErr.Stderr))
+		if len(stderr) > maxStderrLen {
+			stderr = stderr[:maxStderrLen] + "...(truncated)"
+		}
+		if stderr != "" {
+			return fmt.Errorf("%s command failed: %v: %s", tool, err, stderr)
+		}
+	}
+	return fmt.Errorf("%s command failed: %v", tool, err)
+}
+
+// maxSnippetLines 单个符号或调用者返回的最大代码行数，超出部分截断，0表示不限制
+var maxSnippetLines = 300
+
+// snippetTruncated line到end的代码是否会被截断
+func snippetTruncated(line, end int) bool {
+	return maxSnippetLines > 0 && end-line+1 > maxSnippetLines
+}
+
+// joinSnippet 拼接代码行，超过maxSnippetLines时只保留前面部分并标明截断的行数
+func joinSnippet(lines []string) string {
+	if maxSnippetLines <= 0 || len(lines) <= maxSnippetLines {
+		return strings.Join(lines, "\n")
+	}
+	omitted := len(lines) - maxSnippetLines
+	return strings.Join(lines[:maxSnippetLines], "\n") + fmt.Sprintf("\n... [truncated %d lines]", omitted)
+}
+
 func (ca *CodeAnalyzer) getCodeContent(file string, line, end int) (string, error) {
 	filePath := filepath.Join(ca.codeDir, file)
 	content, err := os.ReadFile(filePath)
@@ -102,340 +287,2905 @@ func (ca *CodeAnalyzer) getCodeContent(file string, line, end int) (string, erro
 		return "", fmt.Errorf("invalid line range %d-%d for file %s", line, end, file)
 	}
 
-	return strings.Join(lines[line-1:end], "\n"), nil
+	return joinSnippet(lines[line-1 : end]), nil
 }
 
-func (ca *CodeAnalyzer) getRefCalleeContent(filePath string, lineNum int) (string, error) {
-	cmd := exec.Command(ca.getBinaryPath("ctags"), "--fields=+ne-P", "--output-format=json", "-o", "-", filePath)
-	cmd.Dir = ca.codeDir
-	output, err := cmd.Output()
-	println(string(output))
-	if err != nil {
-		return "", fmt.Errorf("ctags command failed: %v", err)
-	}
-
-	syms := strings.Split(strings.TrimSpace(string(output)), "\n")
-	for _, sym := range syms {
-		if sym == "" {
-			continue
-		}
-
-		var symDict map[string]interface{}
-		if err := json.Unmarshal([]byte(sym), &symDict); err != nil {
-			continue
-		}
-
-		if kind, ok := symDict["kind"].(string); !ok || kind != "function" {
-			continue
-		}
-
-		//检查是否有line和end
-		if _, ok := symDict["line"]; !ok {
-			continue
-		}
-		if _, ok := symDict["end"]; !ok {
-			continue
-		}
-		//解析line和end为数字
-		symLine := int(symDict["line"].(float64))
+// symbolRealignWindow 索引行号过期时，在原行号上下搜索符号的行数范围
+const symbolRealignWindow = 20
 
-		symEnd := int(symDict["end"].(float64))
+// patternMatcher 将ctags的pattern（/^定义所在行$/）还原为匹配该行的函数。pattern过长被ctags截断时没有$，
+// 此时按前缀匹配；不是搜索模式（如行号）时返回nil
+func patternMatcher(pattern string) func(string) bool {
+	body, ok := strings.CutPrefix(pattern, "/^")
+	if !ok {
+		return nil
+	}
+	body, ok = strings.CutSuffix(body, "/")
+	if !ok {
+		return nil
+	}
+	body, exact := strings.CutSuffix(body, "$")
 
-		if lineNum > symLine && symEnd > lineNum {
-			return ca.getCodeContent(filePath, symLine, symEnd)
+	// pattern中的/和\分别转义为\/和\\
+	var text strings.Builder
+	for i := 0; i < len(body); i++ {
+		if body[i] == '\\' && i+1 < len(body) {
+			i++
 		}
+		text.WriteByte(body[i])
 	}
-
-	//如果没有找到，返回这个文件:行号前50行代码
-	if lineNum < 50 {
-		return ca.getCodeContent(filePath, 1, lineNum)
+	definition := text.String()
+	if definition == "" {
+		return nil
 	}
-	return ca.getCodeContent(filePath, lineNum-50, lineNum)
+	if exact {
+		return func(line string) bool { return line == definition }
+	}
+	return func(line string) bool { return strings.HasPrefix(line, definition) }
 }
 
-func (ca *CodeAnalyzer) GetSymbolInfo(symbol string) SymbolResponse {
-	response := SymbolResponse{Status: "failed"}
+// findLineShift 在索引行号附近查找与ctags pattern一致的定义行，返回实际位置相对索引行号的偏移量。
+// 只匹配定义所在的整行，不会对齐到定义上方对该符号的调用或注释
+func findLineShift(lines []string, pattern string, line int) (int, bool) {
+	if line < 1 || line > len(lines) {
+		return 0, false
+	}
+	match := patternMatcher(pattern)
+	if match == nil {
+		return 0, false
+	}
 
-	// 处理符号名称
-	if strings.HasPrefix(symbol, "struct") {
-		parts := strings.Fields(symbol)
-		if len(parts) > 1 {
-			symbol = parts[1]
-		}
+	if match(lines[line-1]) {
+		return 0, true
 	}
-	if strings.Contains(symbol, "->") {
-		parts := strings.Fields(symbol)
-		if len(parts) > 1 {
-			symbol = parts[1]
+
+	// 优先向下查找，在符号上方插入代码是最常见的情况
+	for delta := 1; delta <= symbolRealignWindow; delta++ {
+		if down := line + delta; down <= len(lines) && match(lines[down-1]) {
+			return delta, true
+		}
+		if up := line - delta; up >= 1 && match(lines[up-1]) {
+			return -delta, true
 		}
 	}
+	return 0, false
+}
 
-	// 使用readtags查找符号
-	cmd := exec.Command(ca.getBinaryPath("readtags"), "-t", ".tsj/tags", symbol)
-	cmd.Dir = ca.codeDir
-	output, err := cmd.Output()
+// getSymbolContent 获取符号代码内容，索引行号与文件内容不一致时尽量按定义行的pattern重新对齐
+func (ca *CodeAnalyzer) getSymbolContent(file, pattern string, line, end int) (string, int, error) {
+	filePath := filepath.Join(ca.codeDir, file)
+	content, err := os.ReadFile(filePath)
 	if err != nil {
-		response.Error = fmt.Sprintf("readtags command failed: %v", err)
-		return response
+		return "", 0, fmt.Errorf("failed to read file %s: %v", filePath, err)
 	}
 
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	if len(lines) == 0 || lines[0] == "" {
-		response.Error = "symbol not found"
-		return response
+	lines := strings.Split(string(content), "\n")
+	shift, ok := findLineShift(lines, pattern, line)
+	if ok && shift != 0 && line+shift >= 1 && end+shift <= len(lines) {
+		line += shift
+		end += shift
+	} else {
+		shift = 0
 	}
-	// println(len(lines))
-	println(string(output))
 
-	var resList []SymbolInfo
-	for _, line := range lines {
-		println("line start")
-		parts := strings.Fields(line)
-		if len(parts) < 2 {
-			println(line + "parse failed")
-			continue
-		}
+	if line < 1 || line > len(lines) || end < line || end > len(lines) {
+		return "", 0, fmt.Errorf("invalid line range %d-%d for file %s", line, end, file)
+	}
 
-		file := parts[1]
-		println(parts[0])
-		println(parts[1])
-		println(parts[2])
+	return joinSnippet(lines[line-1 : end]), shift, nil
+}
 
-		// 使用ctags获取详细信息
-		ctagsCmd := exec.Command(ca.getBinaryPath("ctags"), "--fields=+ne-P", "--output-format=json", "-o", "-", file)
-		println(ctagsCmd.String())
-		ctagsCmd.Dir = ca.codeDir
-		ctagsOutput, err := ctagsCmd.Output()
-		println(string(ctagsOutput))
-		if err != nil {
-			continue
-		}
+// Symbol ctags JSON输出中的一个符号
+type Symbol struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Pattern string `json:"pattern"`
+	Kind    string `json:"kind"`
+	Line    int    `json:"line"`
+	// End 声明、typedef等符号没有结束行，此时为nil
+	End       *int   `json:"end"`
+	Typeref   string `json:"typeref"`
+	Scope     string `json:"scope"`
+	ScopeKind string `json:"scopeKind"`
+}
 
-		syms := strings.Split(strings.TrimSpace(string(ctagsOutput)), "\n")
-		tmpSymToFind := symbol
-		i := 0
-		loopCount := 0
-		maxLoops := len(syms) * 2
+// fileSymbols 单个文件的ctags解析结果
+type fileSymbols struct {
+	file    string
+	modTime time.Time
+	size    int64
+	syms    []Symbol
+	// funcs 有结束行的function符号，按起始行排序，用于二分查找调用点所在函数
+	funcs []Symbol
+	// maxEnd maxEnd[i]为funcs[0..i]中最大的结束行，向前查找时据此提前结束
+	maxEnd []int
+}
 
-		for i < len(syms) && loopCount < maxLoops {
-			loopCount++
+func newFileSymbols(file string, info os.FileInfo, syms []Symbol) *fileSymbols {
+	fs := &fileSymbols{file: file, modTime: info.ModTime(), size: info.Size(), syms: syms}
+	for _, sym := range syms {
+		if sym.Kind == "function" && sym.Line > 0 && sym.End != nil {
+			fs.funcs = append(fs.funcs, sym)
+		}
+	}
+	sort.SliceStable(fs.funcs, func(i, j int) bool {
+		return fs.funcs[i].Line < fs.funcs[j].Line
+	})
+	fs.maxEnd = make([]int, len(fs.funcs))
+	for i, sym := range fs.funcs {
+		fs.maxEnd[i] = *sym.End
+		if i > 0 && fs.maxEnd[i-1] > fs.maxEnd[i] {
+			fs.maxEnd[i] = fs.maxEnd[i-1]
+		}
+	}
+	return fs
+}
 
-			var symDict map[string]interface{}
-			if err := json.Unmarshal([]byte(syms[i]), &symDict); err != nil {
-				i++
-				continue
-			}
+// enclosingFunction 查找包含lineNum的最内层函数。先二分查找起始行不大于lineNum的范围，
+// 再向前检查，之前的函数都在lineNum之前结束时停止，不嵌套的函数只需检查前一个
+func (fs *fileSymbols) enclosingFunction(lineNum int) *Symbol {
+	// 第一个起始行大于lineNum的位置，之前的函数才可能包含该行
+	i := sort.Search(len(fs.funcs), func(i int) bool {
+		return fs.funcs[i].Line > lineNum
+	})
+
+	var best *Symbol
+	for i--; i >= 0 && fs.maxEnd[i] >= lineNum; i-- {
+		sym := &fs.funcs[i]
+		if *sym.End >= lineNum && betterEnclosing(sym, best) {
+			best = sym
+		}
+	}
+	return best
+}
 
-			if symDict["name"] != tmpSymToFind {
-				i++
-				continue
-			}
+// symbolCache 按文件缓存ctags解析结果的LRU缓存，文件修改时间或大小变化后重新解析
+type symbolCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
 
-			// 处理typeref情况
-			if _, hasEnd := symDict["end"]; !hasEnd {
-				if typeref, hasTyperef := symDict["typeref"].(string); hasTyperef {
-					parts := strings.Split(typeref, ":")
-					if len(parts) > 1 {
-						tmpSymToFind = parts[1]
-						i = 0
-						continue
-					}
-				}
-			}
+func newSymbolCache(capacity int) *symbolCache {
+	return &symbolCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
 
-			// 获取代码内容
-			content, err := ca.getCodeContent(file, int(symDict["line"].(float64)), int(symDict["end"].(float64)))
-			if err != nil {
-				i++
-				continue
-			}
+// clone 返回容量相同的空缓存，未启用缓存时返回nil
+func (c *symbolCache) clone() *symbolCache {
+	if c == nil {
+		return nil
+	}
+	return newSymbolCache(c.capacity)
+}
 
-			symInfo := SymbolInfo{
-				Name:    symDict["name"].(string),
-				Kind:    symDict["kind"].(string),
-				Line:    int(symDict["line"].(float64)),
-				End:     int(symDict["end"].(float64)),
-				Content: content,
-				File:    file,
-			}
+func (c *symbolCache) get(file string, info os.FileInfo) (*fileSymbols, bool) {
+	if c == nil || c.capacity <= 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-			if typeref, ok := symDict["typeref"].(string); ok {
-				symInfo.Typeref = typeref
-			}
+	elem, ok := c.items[file]
+	if !ok {
+		return nil, false
+	}
+	fs := elem.Value.(*fileSymbols)
+	if !fs.modTime.Equal(info.ModTime()) || fs.size != info.Size() {
+		c.ll.Remove(elem)
+		delete(c.items, file)
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return fs, true
+}
 
-			resList = append(resList, symInfo)
-			break
-		}
+func (c *symbolCache) put(fs *fileSymbols) {
+	if c == nil || c.capacity <= 0 {
+		return
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	response.Status = "success"
-	response.ResList = resList
-	return response
+	if elem, ok := c.items[fs.file]; ok {
+		elem.Value = fs
+		c.ll.MoveToFront(elem)
+		return
+	}
+	c.items[fs.file] = c.ll.PushFront(fs)
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*fileSymbols).file)
+	}
 }
 
-func (ca *CodeAnalyzer) FindAllRefs(symbol string) RefResponse {
-	response := RefResponse{}
+// loadFileSymbols 返回文件的ctags解析结果，文件未修改时使用缓存
+func (ca *CodeAnalyzer) loadFileSymbols(ctx context.Context, file string) (*fileSymbols, error) {
+	key := filepath.Clean(file)
+	info, err := os.Stat(filepath.Join(ca.codeDir, key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file %s: %v", file, err)
+	}
+	if fs, ok := ca.symbolCache.get(key, info); ok {
+		return fs, nil
+	}
 
-	cmd := exec.Command(ca.getBinaryPath("global"), "-xsr", symbol)
+	// pattern用于索引行号过期时重新对齐定义行
+	cmd := exec.CommandContext(ctx, ca.getBinaryPath("ctags"), "--fields=+neP", "--output-format=json", "-o", "-", file)
 	cmd.Dir = ca.codeDir
-	//GTAGSROOT要为绝对路径
-	cmd.Env = append(os.Environ(), "GTAGSROOT="+ca.codeDir)
-	cmd.Env = append(cmd.Env, "GTAGSDBPATH="+ca.codeDir+"/.tsj")
 	output, err := cmd.Output()
-	println(string(output))
+	logf(ctx, "ctags %s:\n%s", file, output)
 	if err != nil {
-		response.Error = fmt.Sprintf("global command failed: %v", err)
-		return response
+		return nil, toolError("ctags", err)
 	}
 
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	if len(lines) == 0 || lines[0] == "" {
-		println("lines is empty")
-		return response
+	syms, err := parseCtagsOutput(ctx, file, output)
+	if err != nil {
+		return nil, err
 	}
+	fs := newFileSymbols(key, info, syms)
+	ca.symbolCache.put(fs)
+	return fs, nil
+}
 
-	var callersContent []string
-	seen := make(map[string]bool)
+// parseFileSymbols 返回单个文件解析后的符号列表，调用方不能修改返回的切片
+func (ca *CodeAnalyzer) parseFileSymbols(ctx context.Context, file string) ([]Symbol, error) {
+	fs, err := ca.loadFileSymbols(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	return fs.syms, nil
+}
 
-	for _, line := range lines {
-		println(line)
-		if strings.TrimSpace(line) == "" {
+// errNoCtagsOutput ctags正常退出但没有输出任何tag
+var errNoCtagsOutput = errors.New("ctags produced no tags")
+
+// parseCtagsOutput 解析ctags按行输出的JSON。空行、伪标签（_type为ptag）和不是JSON的行直接跳过，
+// 是JSON对象但解析失败的行记录日志；没有解析出任何tag时返回错误，而不是当作文件中没有符号
+func parseCtagsOutput(ctx context.Context, file string, output []byte) ([]Symbol, error) {
+	var syms []Symbol
+	malformed := 0
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		// 部分选项组合下ctags会输出注释等非JSON行
+		if !strings.HasPrefix(line, "{") {
 			continue
 		}
 
-		parts := strings.Fields(line)
-		if len(parts) < 4 {
+		var entry struct {
+			Type string `json:"_type"`
+			Symbol
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			malformed++
+			logf(ctx, "ctags %s: failed to parse output line %q: %v", file, line, err)
+			continue
+		}
+		if entry.Type != "" && entry.Type != "tag" {
 			continue
 		}
+		syms = append(syms, entry.Symbol)
+	}
 
-		// 移除未使用的变量
-		// callee := parts[0]
-		filePath := parts[2]
-		lineNumStr := parts[1]
-		// callLine := parts[3]
+	if len(syms) == 0 {
+		if malformed > 0 {
+			return nil, fmt.Errorf("failed to parse ctags output for %s: %d malformed line(s)", file, malformed)
+		}
+		return nil, fmt.Errorf("%w for %s", errNoCtagsOutput, file)
+	}
+	return syms, nil
+}
 
-		lineNum, err := strconv.Atoi(lineNumStr)
-		if err != nil {
+// findEnclosingSymbol 返回范围[line, end]包含lineNum的最内层符号，kind非空时只匹配该类型
+func findEnclosingSymbol(syms []Symbol, lineNum int, kind string) *Symbol {
+	var best *Symbol
+	for i := range syms {
+		sym := &syms[i]
+		if kind != "" && sym.Kind != kind {
 			continue
 		}
-		println("获取文件 " + filePath + " 行号 " + lineNumStr)
-		callerContent, err := ca.getRefCalleeContent(filePath, lineNum)
-		if err != nil {
+
+		//没有end的符号无法判断范围
+		if sym.Line <= 0 || sym.End == nil {
 			continue
 		}
 
-		if callerContent != "" && !seen[callerContent] {
-			callersContent = append(callersContent, callerContent)
-			seen[callerContent] = true
+		if lineNum >= sym.Line && lineNum <= *sym.End && betterEnclosing(sym, best) {
+			best = sym
 		}
 	}
-
-	response.Callers = callersContent
-	return response
+	return best
 }
 
-type Server struct {
-	analyzer *CodeAnalyzer
+// betterEnclosing 判断候选范围是否优于当前选择：范围更小的优先，大小相同时起始行更靠后的优先
+func betterEnclosing(candidate, current *Symbol) bool {
+	if current == nil {
+		return true
+	}
+	candidateSize := *candidate.End - candidate.Line
+	currentSize := *current.End - current.Line
+	if candidateSize != currentSize {
+		return candidateSize < currentSize
+	}
+	return candidate.Line > current.Line
 }
 
-func (s *Server) getSymbolHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// refCallerRange 获取引用所在函数的完整范围，不在任何函数中时为引用及其前50行
+func (ca *CodeAnalyzer) refCallerRange(ctx context.Context, filePath string, lineNum int) (types.CodeRange, error) {
+	fs, err := ca.loadFileSymbols(ctx, filePath)
+	if err != nil {
+		return types.CodeRange{}, err
 	}
 
-	var req struct {
-		Symbol string `json:"symbol"`
+	codeRange := types.CodeRange{File: filePath, Line: lineNum - 50, End: lineNum}
+	if sym := fs.enclosingFunction(lineNum); sym != nil {
+		codeRange.Line, codeRange.End = sym.Line, *sym.End
+	} else if lineNum < 50 {
+		//如果没有找到，返回这个文件:行号前50行代码
+		codeRange.Line = 1
 	}
+	codeRange.Truncated = snippetTruncated(codeRange.Line, codeRange.End)
+	return codeRange, nil
+}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+// loadCallerContent 读取调用者的代码，已读取过时直接返回。错误信息包含调用者中第一个引用的位置
+func (ca *CodeAnalyzer) loadCallerContent(caller callerEntry) (callerEntry, error) {
+	if caller.content != "" {
+		return caller, nil
 	}
-
-	response := s.analyzer.GetSymbolInfo(req.Symbol)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	ref := caller.refs[0]
+	content, err := ca.getCodeContent(caller.codeRange.File, caller.codeRange.Line, caller.codeRange.End)
+	if err != nil {
+		return caller, fmt.Errorf("%s:%d: %v", ref.File, ref.Line, err)
+	}
+	if content == "" {
+		return caller, fmt.Errorf("%s:%d: empty caller content", ref.File, ref.Line)
+	}
+	caller.content = content
+	return caller, nil
 }
 
-func (s *Server) findRefsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// gtagsLabels global支持的GTAGSLABEL
+var gtagsLabels = []string{"default", "native", "ctags", "new-ctags", "pygments", "user"}
+
+// validateGtagsLabel 校验GTAGSLABEL是global支持的标签；指定了gtags.conf时还要求标签在配置文件中有定义
+func validateGtagsLabel(label, conf string) error {
+	if label == "" {
+		return nil
+	}
+	if !containsString(gtagsLabels, label) {
+		return fmt.Errorf("unsupported gtags label %q, expected one of %s", label, strings.Join(gtagsLabels, ", "))
+	}
+	if conf == "" {
+		return nil
 	}
 
-	var req struct {
-		Symbol string `json:"symbol"`
+	data, err := os.ReadFile(conf)
+	if err != nil {
+		return fmt.Errorf("failed to read gtags conf %s: %v", conf, err)
+	}
+	// gtags.conf中标签定义的格式为"label:..."或"label|alias:..."
+	pattern := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(label) + `[:|]`)
+	if !pattern.Match(data) {
+		return fmt.Errorf("gtags label %q is not defined in %s", label, conf)
 	}
+	return nil
+}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+// gtagsEnv 返回运行gtags/global所需的环境变量
+func (ca *CodeAnalyzer) gtagsEnv() []string {
+	//GTAGSROOT要为绝对路径
+	env := append(os.Environ(), "GTAGSROOT="+ca.codeDir)
+	env = append(env, "GTAGSDBPATH="+ca.tagsDir)
+	if ca.gtagsLabel != "" {
+		env = append(env, "GTAGSLABEL="+ca.gtagsLabel)
 	}
+	if ca.gtagsConf != "" {
+		env = append(env, "GTAGSCONF="+ca.gtagsConf)
+	}
+	return env
+}
 
-	response := s.analyzer.FindAllRefs(req.Symbol)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+// resolveCodePath 校验客户端传入的文件路径位于代码目录内，返回相对代码目录的路径
+func (ca *CodeAnalyzer) resolveCodePath(file string) (string, error) {
+	absPath := file
+	if !filepath.IsAbs(absPath) {
+		absPath = filepath.Join(ca.codeDir, file)
+	}
+	rel, err := filepath.Rel(ca.codeDir, filepath.Clean(absPath))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file %s is outside the code directory", file)
+	}
+	return rel, nil
 }
 
-func main() {
-	// 解析命令行参数
-	codeDir := flag.String("code-dir", ".", "代码目录路径")
-	listenAddr := flag.String("listen", "0.0.0.0:0", "监听地址和端口 (格式: host:port)")
+// codeFileExists 判断相对代码目录的路径是否为存在的普通文件
+func (ca *CodeAnalyzer) codeFileExists(file string) bool {
+	info, err := os.Stat(filepath.Join(ca.codeDir, file))
+	return err == nil && info.Mode().IsRegular()
+}
 
-	flag.Parse()
+// GetSymbolAt 查找文件中包含指定行的符号定义
+func (ca *CodeAnalyzer) GetSymbolAt(ctx context.Context, file string, lineNum int) types.SymbolResponse {
+	response := types.SymbolResponse{Status: "failed"}
 
-	// 检查.tsj目录是否存在，目录下是否有tags GPATH GTAGS GRTAGS文件
-	if _, err := os.Stat(".tsj"); os.IsNotExist(err) {
-		log.Fatalf(".tsj目录不存在，请先运行gtags生成tags文件")
-	}
-	if _, err := os.Stat(".tsj/tags"); os.IsNotExist(err) {
-		log.Fatalf(".tsj/tags文件不存在，请先运行ctags生成tags文件")
-	}
-	if _, err := os.Stat(".tsj/GPATH"); os.IsNotExist(err) {
-		log.Fatalf(".tsj/GPATH文件不存在，请先运行gtags生成tags文件")
+	ca.indexMu.RLock()
+	defer ca.indexMu.RUnlock()
+
+	relPath, err := ca.resolveCodePath(file)
+	if err != nil {
+		response.Error = err.Error()
+		return response
 	}
-	if _, err := os.Stat(".tsj/GTAGS"); os.IsNotExist(err) {
-		log.Fatalf(".tsj/GTAGS文件不存在，请先运行gtags生成tags文件")
+
+	syms, err := ca.parseFileSymbols(ctx, relPath)
+	if err != nil {
+		response.Error = err.Error()
+		return response
 	}
-	if _, err := os.Stat(".tsj/GRTAGS"); os.IsNotExist(err) {
-		log.Fatalf(".tsj/GRTAGS文件不存在，请先运行gtags生成tags文件")
+
+	sym := findEnclosingSymbol(syms, lineNum, "")
+	if sym == nil {
+		response.Error = errSymbolNotFound
+		return response
 	}
 
-	// 如果端口为0，让系统自动分配端口
-	if strings.HasSuffix(*listenAddr, ":0") {
-		listener, err := net.Listen("tcp", *listenAddr)
-		if err != nil {
-			log.Fatalf("Failed to listen: %v", err)
-		}
-		*listenAddr = listener.Addr().String()
-		listener.Close()
+	content, err := ca.getCodeContent(relPath, sym.Line, *sym.End)
+	if err != nil {
+		response.Error = err.Error()
+		return response
 	}
 
-	// 创建代码分析器
-	analyzer := NewCodeAnalyzer(*codeDir, "")
+	symInfo := types.SymbolInfo{
+		Name:    sym.Name,
+		Kind:    sym.Kind,
+		Line:    sym.Line,
+		End:     *sym.End,
+		Content: content,
+		File:    relPath,
+		Typeref: sym.Typeref,
+		Repo:    ca.name,
+		// 截断时Line和End仍为完整范围，客户端可据此读取全文
+		Truncated: snippetTruncated(sym.Line, *sym.End),
+	}
 
-	// 程序退出时清理临时目录
-	defer func() {
-		if analyzer.binaryDir != "" {
-			os.RemoveAll(analyzer.binaryDir)
-		}
-	}()
+	response.Status = "success"
+	response.ResList = []types.SymbolInfo{symInfo}
+	return response
+}
 
-	// 创建HTTP服务器
-	server := &Server{analyzer: analyzer}
+// errSymbolNotFound 符号不存在时的错误信息
+const errSymbolNotFound = "symbol not found"
 
-	// 设置路由
-	http.HandleFunc("/api/get_symbol", server.getSymbolHandler)
-	http.HandleFunc("/api/find_refs", server.findRefsHandler)
+// errInvalidSymbol 客户端传入的符号名称不合法
+var errInvalidSymbol = errors.New("invalid symbol")
 
-	log.Printf("Starting server on %s", *listenAddr)
-	log.Printf("Code directory: %s", *codeDir)
-	log.Printf("API endpoints:")
+// normalizeSymbol 规范化客户端传入的符号名称：去除首尾空白，拒绝空值和控制字符
+func normalizeSymbol(symbol string) (string, error) {
+	symbol = strings.TrimSpace(symbol)
+	if symbol == "" {
+		return "", fmt.Errorf("%w: symbol is empty", errInvalidSymbol)
+	}
+	for _, r := range symbol {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("%w: symbol contains control characters", errInvalidSymbol)
+		}
+	}
+	return symbol, nil
+}
+
+// SymbolQuery get_symbol查询参数
+type SymbolQuery struct {
+	Symbol string `json:"symbol"`
+	// File 可选，只在该文件（相对代码目录）中查找符号，用于区分同名的static符号
+	File string `json:"file,omitempty"`
+	// Repo 可选，只在该代码仓库中查找；为空时查找全部仓库，指定File时为主仓库
+	Repo string `json:"repo,omitempty"`
+	// Content 可选，为false时只返回符号的位置等元数据，不读取文件内容
+	Content *bool `json:"content,omitempty"`
+	// Fields 可选，res_list中每个符号只返回这些字段（见types.SymbolInfoFields），为空时返回全部字段
+	Fields []string `json:"fields,omitempty"`
+}
+
+// withContent 查询结果是否需要包含代码内容，默认包含；选择了字段但不含content时同样不读取文件
+func (q SymbolQuery) withContent() bool {
+	if len(q.Fields) > 0 && !containsString(q.Fields, "content") {
+		return false
+	}
+	return q.Content == nil || *q.Content
+}
+
+// validateFields 检查fields中的字段都是SymbolInfo的JSON字段
+func validateFields(fields []string) error {
+	for _, field := range fields {
+		if !containsString(types.SymbolInfoFields, field) {
+			return fmt.Errorf("unknown field %q, expected one of %s", field, strings.Join(types.SymbolInfoFields, ", "))
+		}
+	}
+	return nil
+}
+
+// symbolKeywords 符号表达式中需要去掉的类型关键字，其后的标识符为类型名
+var symbolKeywords = map[string]bool{"struct": true, "union": true, "enum": true}
+
+// symbolExpr 从C表达式中解析出的符号
+type symbolExpr struct {
+	// chain 成员访问链上依次的标识符，如a->b.c为[a b c]，最后一个是要查找的符号
+	chain []string
+	// member 表达式以成员访问（.或->）结尾
+	member bool
+}
+
+// name 要查找的符号名称
+func (e symbolExpr) name() string {
+	return e.chain[len(e.chain)-1]
+}
+
+// isIdentByte 标识符中的字符，包含C++限定名中的:和析构函数的~，非ASCII字节按标识符处理
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c == ':' || c == '~' || c >= 0x80 ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// parseSymbolExpr 解析客户端传入的符号表达式，支持a->b->c、s.field、(*p).x、a[i].b、obj->f()、struct foo *p等形式：
+// 忽略指针、取地址、下标和调用参数，以成员访问结尾时返回最后一条访问链，
+// 否则有struct/union/enum关键字时返回其后的类型名，再否则返回最后一个标识符
+func parseSymbolExpr(expr string) symbolExpr {
+	var chains []symbolExpr
+	var typeName string
+	// skip 每层括号是否跳过其中的内容（下标和函数调用参数），skipping为需要跳过的层数
+	var skip []bool
+	skipping := 0
+	// access 上一个记号是.或->；callable 上一个记号是标识符或右括号，其后的(为函数调用
+	access, callable, keyword := false, false, false
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case isIdentByte(c):
+			j := i + 1
+			for j < len(expr) && isIdentByte(expr[j]) {
+				j++
+			}
+			word := expr[i:j]
+			i = j
+			if skipping > 0 {
+				continue
+			}
+			switch {
+			case symbolKeywords[word]:
+				keyword = true
+			case keyword:
+				typeName = word
+				keyword = false
+			case access && len(chains) > 0:
+				last := &chains[len(chains)-1]
+				last.chain = append(last.chain, word)
+				last.member = true
+			default:
+				chains = append(chains, symbolExpr{chain: []string{word}, member: access})
+			}
+			access, callable = false, true
+		case c == '-' && i+1 < len(expr) && expr[i+1] == '>', c == '.':
+			if c == '-' {
+				i++
+			}
+			i++
+			if skipping == 0 {
+				access = true
+			}
+			callable = false
+		case c == '(' || c == '[':
+			skipped := c == '[' || callable
+			skip = append(skip, skipped)
+			if skipped {
+				skipping++
+			}
+			i++
+			access, callable = false, false
+		case c == ')' || c == ']':
+			if n := len(skip); n > 0 {
+				if skip[n-1] {
+					skipping--
+				}
+				skip = skip[:n-1]
+			}
+			i++
+			access, callable = false, true
+		default:
+			// 空白不影响前后记号的关系，其他符号（*、&、逗号等）分隔表达式
+			if c != ' ' && c != '\t' {
+				access, callable = false, false
+			}
+			i++
+		}
+	}
+
+	if n := len(chains); n > 0 && (chains[n-1].member || typeName == "") {
+		return chains[n-1]
+	}
+	if typeName != "" {
+		return symbolExpr{chain: []string{typeName}}
+	}
+	// 没有解析出标识符时保持原样，由后续查找报告符号不存在
+	return symbolExpr{chain: []string{strings.TrimSpace(expr)}}
+}
+
+func (ca *CodeAnalyzer) GetSymbolInfo(ctx context.Context, query SymbolQuery) types.SymbolResponse {
+	response := types.SymbolResponse{Status: "failed"}
+
+	ca.indexMu.RLock()
+	defer ca.indexMu.RUnlock()
+
+	// 从成员访问等表达式中取出要查找的标识符
+	expr := parseSymbolExpr(query.Symbol)
+	symbol := expr.name()
+
+	// X->field先解析X的类型，返回该结构体中field成员的定义；无法解析时按普通符号查找
+	if expr.member && len(expr.chain) > 1 {
+		symInfo, err := ca.resolveMember(ctx, expr.chain, query.File, query.withContent())
+		if err != nil {
+			logf(ctx, "resolve member %s: %v", strings.Join(expr.chain, "."), err)
+		} else {
+			response.Status = "success"
+			response.ResList = []types.SymbolInfo{*symInfo}
+			return response
+		}
+	}
+
+	files, err := ca.lookupTagFiles(ctx, symbol)
+	if err != nil {
+		// readtags无法打开tags文件时，优先给出格式不兼容的具体原因
+		if formatErr := ca.tagsFormatError(); formatErr != nil {
+			err = fmt.Errorf("%v (%v)", formatErr, err)
+		}
+		response.Error = err.Error()
+		return response
+	}
+	if len(files) == 0 {
+		// readtags什么都没找到时，区分tags文件格式不兼容与符号确实不存在
+		if err := ca.tagsFormatError(); err != nil {
+			logf(ctx, "%v", err)
+			response.Error = err.Error()
+			return response
+		}
+	}
+	if query.File != "" {
+		files = filterFiles(files, query.File)
+	}
+	if len(files) == 0 {
+		response.Error = errSymbolNotFound
+		return response
+	}
+
+	var resList []types.SymbolInfo
+	var resolveErr error
+	for _, file := range files {
+		symInfo, err := ca.resolveSymbol(ctx, file, symbol, query.withContent())
+		if err != nil {
+			logf(ctx, "%v", err)
+			if resolveErr == nil {
+				resolveErr = err
+			}
+			continue
+		}
+		if symInfo != nil {
+			resList = append(resList, *symInfo)
+		}
+	}
+	// 所有文件都解析失败（例如ctags没有输出）时返回错误，而不是空的成功结果
+	if len(resList) == 0 && resolveErr != nil {
+		response.Error = resolveErr.Error()
+		return response
+	}
+
+	response.Status = "success"
+	response.ResList = resList
+	return response
+}
+
+// supportedTagFormats 内置readtags能读取的tags文件格式（!_TAG_FILE_FORMAT）
+var supportedTagFormats = map[string]bool{"1": true, "2": true}
+
+// tagsHeaderLines 检查tags文件格式时最多读取的行数，伪标签都在文件开头
+const tagsHeaderLines = 64
+
+// tagsFormatCheck 按tags文件的修改时间和大小缓存格式检查结果
+type tagsFormatCheck struct {
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	err     error
+}
+
+// checkTagsFormat 检查tags文件是否能被内置readtags正确读取，返回说明不兼容原因的错误
+func checkTagsFormat(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open tags file %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var format, sorted, program string
+	var sawTag bool
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for i := 0; i < tagsHeaderLines && scanner.Scan(); i++ {
+		line := scanner.Text()
+		if i == 0 && strings.HasPrefix(line, "\x0c") {
+			return fmt.Errorf("tags file %s is in etags (Emacs TAGS) format, regenerate it with: ctags -L filelist -o %s", path, path)
+		}
+		if !strings.HasPrefix(line, "!_TAG_") {
+			if line != "" {
+				sawTag = true
+				break
+			}
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "!_TAG_FILE_FORMAT":
+			format = fields[1]
+		case "!_TAG_FILE_SORTED":
+			sorted = fields[1]
+		case "!_TAG_PROGRAM_NAME":
+			program = fields[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read tags file %s: %v", path, err)
+	}
+
+	switch {
+	case format == "" && !sawTag:
+		return fmt.Errorf("tags file %s is empty or has no tags, regenerate it with: ctags -L filelist -o %s", path, path)
+	case format == "":
+		// 没有格式头时readtags按已排序的文件二分查找，未排序或格式不同时查不到任何符号
+		return fmt.Errorf("tags file %s has no !_TAG_FILE_FORMAT header and may not be readable by the embedded readtags, regenerate it with the embedded ctags", path)
+	case !supportedTagFormats[format]:
+		return fmt.Errorf("tags file %s uses format %s (generated by %s), which the embedded readtags does not support", path, format, programName(program))
+	case sorted != "" && sorted != "0" && sorted != "1" && sorted != "2":
+		return fmt.Errorf("tags file %s has unknown sort order %s (generated by %s)", path, sorted, programName(program))
+	}
+	return nil
+}
+
+// programName 返回tags文件中记录的生成程序名称，缺失时返回unknown
+func programName(program string) string {
+	if program == "" {
+		return "unknown ctags"
+	}
+	return program
+}
+
+// tagsFormatError 返回当前tags文件的格式问题，格式兼容时返回nil；tags文件未变化时复用上次的结果
+func (ca *CodeAnalyzer) tagsFormatError() error {
+	path := filepath.Join(ca.tagsDir, "tags")
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat tags file %s: %v", path, err)
+	}
+
+	ca.tagsCheck.mu.Lock()
+	defer ca.tagsCheck.mu.Unlock()
+	if ca.tagsCheck.modTime.Equal(info.ModTime()) && ca.tagsCheck.size == info.Size() {
+		return ca.tagsCheck.err
+	}
+	ca.tagsCheck.err = checkTagsFormat(path)
+	ca.tagsCheck.modTime = info.ModTime()
+	ca.tagsCheck.size = info.Size()
+	return ca.tagsCheck.err
+}
+
+// lookupTagFiles 使用readtags查找定义了符号的文件列表（去重，保持tags中的顺序）
+func (ca *CodeAnalyzer) lookupTagFiles(ctx context.Context, symbol string) ([]string, error) {
+	// "-"之后的参数即使以-开头也按符号名处理
+	cmd := exec.CommandContext(ctx, ca.getBinaryPath("readtags"), "-t", filepath.Join(ca.tagsDir, "tags"), "-", symbol)
+	cmd.Dir = ca.codeDir
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, toolError("readtags", err)
+	}
+	logf(ctx, "readtags %s:\n%s", symbol, output)
+
+	var files []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		// tags文件每行格式为 name<TAB>file<TAB>pattern
+		parts := strings.Split(line, "\t")
+		if len(parts) < 2 {
+			if line != "" {
+				logf(ctx, "%s parse failed", line)
+			}
+			continue
+		}
+		if file := parts[1]; !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// RawTagEntry readtags输出的一行，按tags文件格式拆分但不做任何后续处理
+type RawTagEntry struct {
+	Repo    string `json:"repo"`
+	Raw     string `json:"raw"`
+	Name    string `json:"name"`
+	File    string `json:"file"`
+	Pattern string `json:"pattern"`
+	// Fields 扩展字段，如kind、typeref、scope；没有键名的字段按tags格式视为kind
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// RawTags 使用readtags -e查找符号，返回原始的tags行及拆分后的字段，用于排查get_symbol的解析结果
+func (ca *CodeAnalyzer) RawTags(ctx context.Context, symbol string) ([]RawTagEntry, error) {
+	ca.indexMu.RLock()
+	defer ca.indexMu.RUnlock()
+
+	cmd := exec.CommandContext(ctx, ca.getBinaryPath("readtags"), "-e", "-t", filepath.Join(ca.tagsDir, "tags"), "-", symbol)
+	cmd.Dir = ca.codeDir
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, toolError("readtags", err)
+	}
+
+	entries := []RawTagEntry{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line == "" {
+			continue
+		}
+		entries = append(entries, parseRawTagLine(ca.name, line))
+	}
+	return entries, nil
+}
+
+// parseRawTagLine 拆分tags文件的一行：name<TAB>file<TAB>pattern;"<TAB>扩展字段...
+func parseRawTagLine(repo, line string) RawTagEntry {
+	entry := RawTagEntry{Repo: repo, Raw: line}
+	parts := strings.Split(line, "\t")
+	entry.Name = parts[0]
+	if len(parts) > 1 {
+		entry.File = parts[1]
+	}
+	if len(parts) > 2 {
+		entry.Pattern = strings.TrimSuffix(parts[2], `;"`)
+	}
+	for _, field := range parts[min(len(parts), 3):] {
+		if field == "" {
+			continue
+		}
+		if entry.Fields == nil {
+			entry.Fields = make(map[string]string)
+		}
+		key, value, ok := strings.Cut(field, ":")
+		if !ok {
+			key, value = "kind", field
+		}
+		entry.Fields[key] = value
+	}
+	return entry
+}
+
+// filterFiles 返回与目标文件路径相同的文件，比较前统一清理路径（如"./a.c"与"a.c"）
+func filterFiles(files []string, target string) []string {
+	target = filepath.Clean(target)
+	var matched []string
+	for _, file := range files {
+		if filepath.Clean(file) == target {
+			matched = append(matched, file)
+		}
+	}
+	return matched
+}
+
+// maxTyperefHops typeref链的最大跳数，防止递归typedef导致死循环
+const maxTyperefHops = 8
+
+// parseTyperef 解析ctags的typeref字段，例如"struct:foo *"解析为("struct", "foo")
+func parseTyperef(typeref string) (string, string) {
+	parts := strings.SplitN(typeref, ":", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], strings.TrimSpace(strings.TrimRight(parts[1], " *&"))
+}
+
+// findSymbolByName 按名称（及类型）查找符号，优先返回有结束行的定义；typename表示不限类型
+func findSymbolByName(syms []Symbol, name, kind string) *Symbol {
+	var fallback *Symbol
+	for i := range syms {
+		sym := &syms[i]
+		if sym.Name != name || (kind != "" && kind != "typename" && sym.Kind != kind) {
+			continue
+		}
+		if sym.End != nil {
+			return sym
+		}
+		if fallback == nil {
+			fallback = sym
+		}
+	}
+	return fallback
+}
+
+// findTyperefTarget 查找typeref指向的符号，先在当前文件中查找，再通过tags查找其他文件
+func (ca *CodeAnalyzer) findTyperefTarget(ctx context.Context, file string, syms []Symbol, current *Symbol, name, kind string) (*Symbol, string, []Symbol) {
+	if target := findSymbolByName(syms, name, kind); target != nil && target != current {
+		return target, file, syms
+	}
+
+	files, err := ca.lookupTagFiles(ctx, name)
+	if err != nil {
+		return nil, "", nil
+	}
+	for _, otherFile := range files {
+		if otherFile == file {
+			continue
+		}
+		otherSyms, err := ca.parseFileSymbols(ctx, otherFile)
+		if err != nil {
+			continue
+		}
+		if target := findSymbolByName(otherSyms, name, kind); target != nil {
+			return target, otherFile, otherSyms
+		}
+	}
+	return nil, "", nil
+}
+
+// resolveSymbol 在文件中查找符号定义，沿typeref链解析到具体的类型定义；
+// withContent为false时不读取文件，只返回索引中的位置
+func (ca *CodeAnalyzer) resolveSymbol(ctx context.Context, file, symbol string, withContent bool) (*types.SymbolInfo, error) {
+	syms, err := ca.parseFileSymbols(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+
+	sym := findSymbolByName(syms, symbol, "")
+	if sym == nil {
+		return nil, nil
+	}
+
+	// 没有结束行的符号（typedef等）沿typeref逐跳解析，记录经过的每个符号
+	var resolvedFrom []string
+	visited := make(map[string]bool)
+	for sym.End == nil && sym.Typeref != "" {
+		if len(resolvedFrom) >= maxTyperefHops {
+			logf(ctx, "typeref chain of %s exceeds %d hops, stop at %s", symbol, maxTyperefHops, sym.Name)
+			break
+		}
+		kind, name := parseTyperef(sym.Typeref)
+		if name == "" || visited[kind+":"+name] {
+			break
+		}
+		visited[kind+":"+name] = true
+
+		target, targetFile, targetSyms := ca.findTyperefTarget(ctx, file, syms, sym, name, kind)
+		if target == nil {
+			break
+		}
+		resolvedFrom = append(resolvedFrom, sym.Name)
+		sym, file, syms = target, targetFile, targetSyms
+	}
+
+	// 声明等没有结束行的符号跳过；typedef到基础类型时返回typedef所在行
+	end := sym.Line
+	if sym.End != nil {
+		end = *sym.End
+	} else if len(resolvedFrom) == 0 && sym.Kind != "typedef" {
+		return nil, nil
+	}
+
+	if !withContent {
+		return &types.SymbolInfo{
+			Name:         sym.Name,
+			Kind:         sym.Kind,
+			Line:         sym.Line,
+			End:          end,
+			File:         file,
+			Typeref:      sym.Typeref,
+			Repo:         ca.name,
+			ResolvedFrom: resolvedFrom,
+		}, nil
+	}
+
+	// 获取代码内容
+	content, shift, err := ca.getSymbolContent(file, sym.Pattern, sym.Line, end)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.SymbolInfo{
+		Name:         sym.Name,
+		Kind:         sym.Kind,
+		Line:         sym.Line + shift,
+		End:          end + shift,
+		Content:      content,
+		File:         file,
+		Typeref:      sym.Typeref,
+		Repo:         ca.name,
+		LineShift:    shift,
+		ResolvedFrom: resolvedFrom,
+		Truncated:    snippetTruncated(sym.Line, end),
+	}, nil
+}
+
+// typeSymbol 在某个文件中找到的类型或变量定义
+type typeSymbol struct {
+	sym  *Symbol
+	file string
+	syms []Symbol
+}
+
+// variableKinds 可以作为成员访问起点的符号类型
+var variableKinds = map[string]bool{"variable": true, "externvar": true, "local": true, "parameter": true, "member": true}
+
+// parseLocalSymbols 解析文件中包括局部变量和函数参数在内的符号，不使用缓存
+func (ca *CodeAnalyzer) parseLocalSymbols(ctx context.Context, file string) ([]Symbol, error) {
+	cmd := exec.CommandContext(ctx, ca.getBinaryPath("ctags"), "--fields=+ne-P", "--kinds-C=+lz", "--output-format=json", "-o", "-", file)
+	cmd.Dir = ca.codeDir
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, toolError("ctags", err)
+	}
+	return parseCtagsOutput(ctx, file, output)
+}
+
+// findVariable 查找成员访问起点的变量定义：指定了文件时先查找其中的局部变量和参数，再通过tags查找全局变量
+func (ca *CodeAnalyzer) findVariable(ctx context.Context, name, file string) (*typeSymbol, error) {
+	match := func(syms []Symbol) *Symbol {
+		for i := range syms {
+			if syms[i].Name == name && syms[i].Typeref != "" && variableKinds[syms[i].Kind] {
+				return &syms[i]
+			}
+		}
+		return nil
+	}
+
+	if file != "" {
+		locals, err := ca.parseLocalSymbols(ctx, file)
+		if err != nil {
+			return nil, err
+		}
+		if sym := match(locals); sym != nil {
+			syms, err := ca.parseFileSymbols(ctx, file)
+			if err != nil {
+				return nil, err
+			}
+			return &typeSymbol{sym: sym, file: file, syms: syms}, nil
+		}
+	}
+
+	files, err := ca.lookupTagFiles(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, tagFile := range files {
+		syms, err := ca.parseFileSymbols(ctx, tagFile)
+		if err != nil {
+			continue
+		}
+		if sym := match(syms); sym != nil {
+			return &typeSymbol{sym: sym, file: tagFile, syms: syms}, nil
+		}
+	}
+	return nil, fmt.Errorf("variable %s not found", name)
+}
+
+// resolveStructType 沿typeref（经过typedef）解析到结构体或联合体的定义
+func (ca *CodeAnalyzer) resolveStructType(ctx context.Context, from *typeSymbol) (*typeSymbol, error) {
+	current := from
+	for hop := 0; hop < maxTyperefHops; hop++ {
+		kind, name := parseTyperef(current.sym.Typeref)
+		// 去掉const等修饰符，只保留类型名
+		if fields := strings.Fields(name); len(fields) > 0 {
+			name = fields[len(fields)-1]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("%s has no usable typeref", current.sym.Name)
+		}
+
+		switch kind {
+		case "struct", "union":
+			target, targetFile, targetSyms := ca.findTyperefTarget(ctx, current.file, current.syms, current.sym, name, kind)
+			if target == nil {
+				return nil, fmt.Errorf("%s %s not found", kind, name)
+			}
+			return &typeSymbol{sym: target, file: targetFile, syms: targetSyms}, nil
+		case "typename":
+			target, targetFile, targetSyms := ca.findTyperefTarget(ctx, current.file, current.syms, current.sym, name, "typedef")
+			if target == nil {
+				return nil, fmt.Errorf("type %s of %s is not a struct", name, current.sym.Name)
+			}
+			current = &typeSymbol{sym: target, file: targetFile, syms: targetSyms}
+		default:
+			return nil, fmt.Errorf("unsupported typeref %q of %s", current.sym.Typeref, current.sym.Name)
+		}
+	}
+	return nil, fmt.Errorf("typeref chain of %s exceeds %d hops", from.sym.Name, maxTyperefHops)
+}
+
+// findMember 在结构体定义所在文件中查找成员
+func findMember(owner *typeSymbol, member string) *Symbol {
+	for i := range owner.syms {
+		sym := &owner.syms[i]
+		if sym.Name != member || sym.Kind != "member" {
+			continue
+		}
+		// 嵌套结构体的scope带有外层名称，如outer::inner
+		if sym.Scope == owner.sym.Name || strings.HasSuffix(sym.Scope, "::"+owner.sym.Name) || strings.HasSuffix(sym.Scope, "."+owner.sym.Name) {
+			return sym
+		}
+	}
+	return nil
+}
+
+// resolveMember 解析成员访问链chain（如obj->a.b为[obj a b]）：依次解析每一级的结构体类型，返回最后一个成员的定义
+func (ca *CodeAnalyzer) resolveMember(ctx context.Context, chain []string, file string, withContent bool) (*types.SymbolInfo, error) {
+	current, err := ca.findVariable(ctx, chain[0], file)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, member := range chain[1:] {
+		owner, err := ca.resolveStructType(ctx, current)
+		if err != nil {
+			return nil, err
+		}
+		sym := findMember(owner, member)
+		if sym == nil {
+			return nil, fmt.Errorf("%s %s has no member %s", owner.sym.Kind, owner.sym.Name, member)
+		}
+		current = &typeSymbol{sym: sym, file: owner.file, syms: owner.syms}
+	}
+
+	sym := current.sym
+	end := sym.Line
+	if sym.End != nil {
+		end = *sym.End
+	}
+	symInfo := &types.SymbolInfo{
+		Name:         sym.Name,
+		Kind:         sym.Kind,
+		Line:         sym.Line,
+		End:          end,
+		File:         current.file,
+		Typeref:      sym.Typeref,
+		Repo:         ca.name,
+		ResolvedFrom: chain[:len(chain)-1],
+	}
+	if !withContent {
+		return symInfo, nil
+	}
+
+	content, shift, err := ca.getSymbolContent(current.file, sym.Pattern, sym.Line, end)
+	if err != nil {
+		return nil, err
+	}
+	symInfo.Content = content
+	symInfo.Line += shift
+	symInfo.End += shift
+	symInfo.LineShift = shift
+	symInfo.Truncated = snippetTruncated(sym.Line, end)
+	return symInfo, nil
+}
+
+// RefQuery find_refs查询参数
+type RefQuery struct {
+	Symbol string `json:"symbol"`
+	// Offset和Limit用于对去重后的调用者列表分页，Limit为0时返回全部
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+	// Mode 引用查找模式，见refModeFlags，为空时使用symbol_refs
+	Mode string `json:"mode,omitempty"`
+	// Repo 可选，只在该代码仓库中查找，为空时查找全部仓库
+	Repo string `json:"repo,omitempty"`
+	// NoCache 跳过引用缓存，由URL参数nocache=true设置
+	NoCache bool `json:"-"`
+}
+
+// defaultRefMode find_refs未指定mode时的默认模式
+const defaultRefMode = "symbol_refs"
+
+// refModeFlags find_refs的mode到global参数的映射：
+//   - symbol_refs: -xsr，引用及其他符号（含宏中的使用），默认行为
+//   - refs: -xr，只查找真正的引用
+//   - symbols: -xs，只查找没有定义的其他符号
+//   - defs: -xd，查找定义
+var refModeFlags = map[string]string{
+	"symbol_refs": "-xsr",
+	"refs":        "-xr",
+	"symbols":     "-xs",
+	"defs":        "-xd",
+}
+
+// refCacheEntry 引用缓存条目
+type refCacheEntry struct {
+	symbol  string
+	callers []callerEntry
+}
+
+// refCache 按符号缓存去重后的调用者列表的LRU缓存，标签数据库更新后整体失效
+type refCache struct {
+	mu         sync.Mutex
+	capacity   int
+	ll         *list.List
+	items      map[string]*list.Element
+	generation time.Time
+}
+
+func newRefCache(capacity int) *refCache {
+	return &refCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// clone 返回容量相同的空缓存，未启用缓存时返回nil
+func (c *refCache) clone() *refCache {
+	if c == nil {
+		return nil
+	}
+	return newRefCache(c.capacity)
+}
+
+// checkGeneration 标签数据库版本变化时清空缓存，调用方需持有锁
+func (c *refCache) checkGeneration(generation time.Time) {
+	if !generation.Equal(c.generation) {
+		c.ll.Init()
+		c.items = make(map[string]*list.Element)
+		c.generation = generation
+	}
+}
+
+func (c *refCache) get(symbol string, generation time.Time) ([]callerEntry, bool) {
+	if c == nil || c.capacity <= 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checkGeneration(generation)
+	elem, ok := c.items[symbol]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*refCacheEntry).callers, true
+}
+
+func (c *refCache) put(symbol string, generation time.Time, callers []callerEntry) {
+	if c == nil || c.capacity <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checkGeneration(generation)
+	if elem, ok := c.items[symbol]; ok {
+		elem.Value.(*refCacheEntry).callers = callers
+		c.ll.MoveToFront(elem)
+		return
+	}
+	c.items[symbol] = c.ll.PushFront(&refCacheEntry{symbol: symbol, callers: callers})
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*refCacheEntry).symbol)
+	}
+}
+
+// tagsGeneration 以GTAGS文件的修改时间作为标签数据库的版本
+func (ca *CodeAnalyzer) tagsGeneration() time.Time {
+	info, err := os.Stat(filepath.Join(ca.tagsDir, "GTAGS"))
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (ca *CodeAnalyzer) FindAllRefs(ctx context.Context, query RefQuery) types.RefResponse {
+	response := types.RefResponse{}
+
+	callers, warnings, err := ca.findCallers(ctx, query, nil)
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+
+	var page []callerEntry
+	for _, caller := range paginate(callers, query.Offset, query.Limit) {
+		caller, err := ca.loadCallerContent(caller)
+		if err != nil {
+			warnings = append(warnings, err.Error())
+			continue
+		}
+		page = append(page, caller)
+	}
+	setCallers(&response, page, len(callers))
+	response.Warnings = warnings
+	return response
+}
+
+// setCallers 用已分页并读取了代码的调用者填充响应，total为分页前的调用者总数
+func setCallers(response *types.RefResponse, page []callerEntry, total int) {
+	response.Total = total
+	response.Callers = make([]string, 0, len(page))
+	response.CallerRefs = make([][]types.RefMatch, 0, len(page))
+	response.CallerRanges = make([]types.CodeRange, 0, len(page))
+	for _, caller := range page {
+		response.Callers = append(response.Callers, caller.content)
+		response.CallerRefs = append(response.CallerRefs, caller.refs)
+		response.CallerRanges = append(response.CallerRanges, caller.codeRange)
+	}
+}
+
+// findCallers 查找符号的全部调用者（未分页），优先使用缓存，同时返回无法定位调用者而跳过的引用。
+// emit为nil时不读取调用者代码，由调用方在分页后读取；emit不为nil时每个调用者的引用收集完后
+// 立即连同代码交给emit，缓存命中时依次交出缓存的调用者，返回的列表只包含交出的调用者
+func (ca *CodeAnalyzer) findCallers(ctx context.Context, query RefQuery, emit callerEmitter) ([]callerEntry, []string, error) {
+	ca.indexMu.RLock()
+	defer ca.indexMu.RUnlock()
+
+	mode := query.Mode
+	if mode == "" {
+		mode = defaultRefMode
+	}
+	globalFlags, ok := refModeFlags[mode]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown find_refs mode: %s", mode)
+	}
+
+	// 不同模式的结果不同，缓存键包含模式
+	cacheKey := mode + ":" + query.Symbol
+	generation := ca.tagsGeneration()
+	if !query.NoCache {
+		if callers, ok := ca.refCache.get(cacheKey, generation); ok {
+			logf(ctx, "find_refs cache hit: %s (%s)", query.Symbol, mode)
+			if emit == nil {
+				return callers, nil, nil
+			}
+			var emitted []callerEntry
+			var warnings refWarnings
+			for _, caller := range callers {
+				caller, err := ca.loadCallerContent(caller)
+				if err != nil {
+					warnings.add(err.Error())
+					continue
+				}
+				if err := emit(len(emitted), caller, false); err != nil {
+					return nil, nil, err
+				}
+				emitted = append(emitted, caller)
+			}
+			return emitted, warnings.list(), nil
+		}
+	}
+
+	callers, warnings, err := ca.resolveCallers(ctx, query.Symbol, globalFlags, emit)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 部分引用失败可能是暂时的（如文件正在写入），不缓存不完整的结果
+	if len(warnings) == 0 {
+		ca.refCache.put(cacheKey, generation, callers)
+	}
+	return callers, warnings, nil
+}
+
+// resolveCallers 使用global按指定参数查找符号的全部引用，按所在函数的范围合并为调用者，
+// 返回调用者及其包含的引用，以及无法定位调用者而跳过的引用。emit为nil时只确定调用者的范围，不读取代码；
+// emit不为nil时读取每个新调用者的代码，出现新的调用者就把之前的调用者交给emit（引用按位置排序，同一调用者的引用相邻）
+func (ca *CodeAnalyzer) resolveCallers(ctx context.Context, symbol, globalFlags string, emit callerEmitter) ([]callerEntry, []string, error) {
+	// -e 保证以-开头的符号不会被当作选项
+	cmd := exec.CommandContext(ctx, ca.getBinaryPath("global"), globalFlags, "-e", symbol)
+	cmd.Dir = ca.codeDir
+	cmd.Env = ca.gtagsEnv()
+	output, err := cmd.Output()
+	logf(ctx, "global %s %s:\n%s", globalFlags, symbol, output)
+	if err != nil {
+		return nil, nil, toolError("global", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) == 0 || lines[0] == "" {
+		logf(ctx, "global returned no references for %s", symbol)
+		return nil, nil, nil
+	}
+
+	var refs []types.RefMatch
+	for _, line := range lines {
+		if ref, ok := parseGlobalLine(line, ca.codeFileExists); ok {
+			ref.Repo = ca.name
+			refs = append(refs, ref)
+		}
+	}
+
+	// 按文件和行号排序，保证去重和分页结果稳定
+	sort.SliceStable(refs, func(i, j int) bool {
+		if refs[i].File != refs[j].File {
+			return refs[i].File < refs[j].File
+		}
+		return refs[i].Line < refs[j].Line
+	})
+	refs = slices.Compact(refs)
+
+	var callers []callerEntry
+	var warnings refWarnings
+	// index 调用者范围到其在callers中的下标，读取代码失败而跳过的调用者为-1
+	index := make(map[types.CodeRange]int)
+	// emitted 已交给emit的调用者数量
+	emitted := 0
+	flush := func() error {
+		for ; emit != nil && emitted < len(callers); emitted++ {
+			if err := emit(emitted, callers[emitted], false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, ref := range refs {
+		logf(ctx, "获取文件 %s 行号 %d", ref.File, ref.Line)
+		codeRange, err := ca.refCallerRange(ctx, ref.File, ref.Line)
+		if err != nil {
+			warnings.add(fmt.Sprintf("%s:%d: %v", ref.File, ref.Line, err))
+			continue
+		}
+
+		// 同一调用者中的多处引用合并到一个条目
+		if i, ok := index[codeRange]; ok {
+			if i < 0 {
+				continue
+			}
+			callers[i].refs = append(callers[i].refs, ref)
+			// 内容相同但不相邻的调用者已经输出，单独补充引用
+			if emit != nil && i < emitted {
+				if err := emit(i, callerEntry{refs: []types.RefMatch{ref}}, true); err != nil {
+					return nil, nil, err
+				}
+			}
+			continue
+		}
+		caller := callerEntry{refs: []types.RefMatch{ref}, codeRange: codeRange}
+		if emit != nil {
+			if caller, err = ca.loadCallerContent(caller); err != nil {
+				warnings.add(err.Error())
+				index[codeRange] = -1
+				continue
+			}
+		}
+		if err := flush(); err != nil {
+			return nil, nil, err
+		}
+		index[codeRange] = len(callers)
+		callers = append(callers, caller)
+	}
+
+	if err := flush(); err != nil {
+		return nil, nil, err
+	}
+	return callers, warnings.list(), nil
+}
+
+// maxRefWarnings 单次find_refs最多返回的警告数，超出部分只计数
+const maxRefWarnings = 50
+
+// refWarnings 收集find_refs中跳过的引用，同一文件的大量失败不会撑大响应
+type refWarnings struct {
+	items   []string
+	omitted int
+}
+
+func (w *refWarnings) add(warning string) {
+	if len(w.items) >= maxRefWarnings {
+		w.omitted++
+		return
+	}
+	w.items = append(w.items, warning)
+}
+
+// list 返回收集到的警告，有省略时在末尾附加省略的数量
+func (w *refWarnings) list() []string {
+	if w.omitted > 0 {
+		return append(w.items, fmt.Sprintf("... and %d more skipped references", w.omitted))
+	}
+	return w.items
+}
+
+// parseGlobalLine 解析global -x的一行输出：tag 行号 文件 源代码行。
+// 文件路径可能包含空白，fileExists不为nil时逐个合并后续字段，直到得到存在的文件
+func parseGlobalLine(line string, fileExists func(string) bool) (types.RefMatch, bool) {
+	parts := strings.Fields(line)
+	if len(parts) < 3 {
+		return types.RefMatch{}, false
+	}
+
+	lineNum, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return types.RefMatch{}, false
+	}
+
+	file, n := parts[2], 3
+	if fileExists != nil && !fileExists(file) {
+		rest := skipFields(line, 2)
+		for i := 3; i < len(parts); i++ {
+			// 从原始文本中截取，保留路径中原有的空白
+			end := strings.Index(rest, parts[i])
+			if end < 0 {
+				break
+			}
+			candidate := rest[:end+len(parts[i])]
+			rest = rest[end+len(parts[i]):]
+			if fileExists(candidate) {
+				file, n = candidate, i+1
+				break
+			}
+		}
+	}
+
+	return types.RefMatch{
+		Tag:    parts[0],
+		File:   file,
+		Line:   lineNum,
+		Source: skipFields(line, n),
+	}, true
+}
+
+// skipFields 跳过前n个空白分隔的字段，返回剩余的原始文本（保留其中的空白）
+func skipFields(line string, n int) string {
+	rest := line
+	for i := 0; i < n; i++ {
+		rest = strings.TrimLeft(rest, " \t")
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			return ""
+		}
+		rest = rest[end:]
+	}
+	return strings.TrimLeft(rest, " \t")
+}
+
+// paginate 返回列表中[offset, offset+limit)的部分，limit为0表示不限制
+func paginate[T any](items []T, offset, limit int) []T {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(items) {
+		return []T{}
+	}
+	end := len(items)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return items[offset:end]
+}
+
+// sourceLanguages 文件扩展名到ctags语言名的映射，用于重建索引时检测代码目录包含的语言
+var sourceLanguages = map[string]string{
+	".c":    "C",
+	".cc":   "C++",
+	".cpp":  "C++",
+	".cxx":  "C++",
+	".c++":  "C++",
+	".hh":   "C++",
+	".hpp":  "C++",
+	".hxx":  "C++",
+	".go":   "Go",
+	".java": "Java",
+	".py":   "Python",
+	".rs":   "Rust",
+	".js":   "JavaScript",
+	".ts":   "TypeScript",
+}
+
+// ReindexResponse 重建索引的结果
+type ReindexResponse struct {
+	Status string `json:"status"`
+	// Languages 检测到并传给ctags --languages的语言
+	Languages []string `json:"languages"`
+	Files     int      `json:"files"`
+	// Mode gtags索引的更新方式：incremental（gtags -i，即global -u）或full
+	Mode string `json:"mode,omitempty"`
+	// Updated gtags重新解析或删除了标签的文件数，全量重建时等于Files
+	Updated int    `json:"updated"`
+	Error   string `json:"error,omitempty"`
+}
+
+// 重建gtags索引的方式
+const (
+	ReindexIncremental = "incremental"
+	ReindexFull        = "full"
+)
+
+// gtagsProgressPattern 匹配gtags -v输出中处理单个文件的行，如" [1/2] extracting tags of a.c"，全量重建时为" [1] extracting tags of a.c"
+var gtagsProgressPattern = regexp.MustCompile(`^\s*\[\d+(?:/\d+)?\] (?:extracting|deleting) tags of (.+)$`)
+
+// countGtagsUpdates 统计gtags -v输出中重新解析或删除了标签的文件数
+func countGtagsUpdates(output []byte) int {
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(output), "\n") {
+		if m := gtagsProgressPattern.FindStringSubmatch(strings.TrimRight(line, "\r")); m != nil {
+			seen[m[1]] = true
+		}
+	}
+	return len(seen)
+}
+
+// collectSourceFiles 遍历代码目录，返回可索引的源文件（"./"开头的相对路径）及检测到的语言
+func (ca *CodeAnalyzer) collectSourceFiles() ([]string, []string, error) {
+	var files []string
+	langSet := make(map[string]bool)
+	hasHeader := false
+
+	err := filepath.WalkDir(ca.codeDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// 跳过.git、.tsj等隐藏目录
+		if d.IsDir() {
+			if path != ca.codeDir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext == ".h" {
+			hasHeader = true
+		} else if lang, ok := sourceLanguages[ext]; ok {
+			langSet[lang] = true
+		} else {
+			return nil
+		}
+
+		rel, err := filepath.Rel(ca.codeDir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, "./"+filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to walk code directory: %v", err)
+	}
+
+	// .h在ctags中默认按C++解析，没有C++源文件时按C解析
+	if hasHeader && !langSet["C++"] && !langSet["C"] {
+		langSet["C++"] = true
+	}
+
+	var languages []string
+	for lang := range langSet {
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+	return files, languages, nil
+}
+
+// Reindex 重新生成文件列表，并按检测到的语言重建tagsDir下的ctags和gtags索引。
+// 已有GTAGS且full为false时增量更新gtags索引，只重新解析有变化的文件
+func (ca *CodeAnalyzer) Reindex(ctx context.Context, full bool) ReindexResponse {
+	response := ReindexResponse{Status: "failed"}
+
+	ca.indexMu.Lock()
+	defer ca.indexMu.Unlock()
+
+	files, languages, err := ca.collectSourceFiles()
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+	response.Languages = languages
+	response.Files = len(files)
+	if len(files) == 0 {
+		response.Error = "no source files found"
+		return response
+	}
+
+	if err := os.MkdirAll(ca.tagsDir, 0755); err != nil {
+		response.Error = fmt.Sprintf("failed to create %s: %v", ca.tagsDir, err)
+		return response
+	}
+	fileList := filepath.Join(ca.tagsDir, "filelist")
+	if err := os.WriteFile(fileList, []byte(strings.Join(files, "\n")+"\n"), 0644); err != nil {
+		response.Error = fmt.Sprintf("failed to write file list: %v", err)
+		return response
+	}
+
+	ctagsArgs := []string{"--languages=" + strings.Join(languages, ",")}
+	if !containsString(languages, "C++") && containsString(languages, "C") {
+		ctagsArgs = append(ctagsArgs, "--map-C=+.h")
+	}
+	ctagsArgs = append(ctagsArgs, "-L", fileList, "-o", filepath.Join(ca.tagsDir, "tags"))
+	cmd := exec.CommandContext(ctx, ca.getBinaryPath("ctags"), ctagsArgs...)
+	cmd.Dir = ca.codeDir
+	if _, err := cmd.Output(); err != nil {
+		response.Error = toolError("ctags", err).Error()
+		return response
+	}
+
+	// gtags -i与global -u相同，但可以继续使用生成的文件列表
+	response.Mode = ReindexFull
+	gtagsArgs := []string{"-v", "-f", fileList}
+	if _, err := os.Stat(filepath.Join(ca.tagsDir, "GTAGS")); err == nil && !full {
+		response.Mode = ReindexIncremental
+		gtagsArgs = append([]string{"-i"}, gtagsArgs...)
+	}
+	gtagsArgs = append(gtagsArgs, ca.tagsDir)
+	cmd = exec.CommandContext(ctx, ca.getBinaryPath("gtags"), gtagsArgs...)
+	cmd.Dir = ca.codeDir
+	cmd.Env = ca.gtagsEnv()
+	// -v的进度输出在stderr中
+	var progress bytes.Buffer
+	cmd.Stderr = &progress
+	if err := cmd.Run(); err != nil {
+		stderr := strings.TrimSpace(progress.String())
+		if len(stderr) > maxStderrLen {
+			stderr = stderr[len(stderr)-maxStderrLen:]
+		}
+		response.Error = fmt.Sprintf("gtags command failed: %v: %s", err, stderr)
+		return response
+	}
+	response.Updated = countGtagsUpdates(progress.Bytes())
+
+	logf(ctx, "reindexed %s (%s): %d files, %d updated, languages: %s", ca.name, response.Mode, len(files), response.Updated, strings.Join(languages, ","))
+	response.Status = "success"
+	return response
+}
+
+// watchDelay 源文件变化后等待多久再重建索引，期间的其他变化合并为一次重建
+var watchDelay = 2 * time.Second
+
+// isSourceFile 判断文件是否会被collectSourceFiles收录
+func isSourceFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	_, ok := sourceLanguages[ext]
+	return ok || ext == ".h"
+}
+
+// skipWatchDir 判断目录是否不需要监听：与collectSourceFiles一样跳过隐藏目录（包括.tsj），以及索引目录本身
+func (ca *CodeAnalyzer) skipWatchDir(path string) bool {
+	if path == ca.tagsDir {
+		return true
+	}
+	return path != ca.codeDir && strings.HasPrefix(filepath.Base(path), ".")
+}
+
+// addWatchDirs 监听root及其下所有需要监听的子目录，fsnotify不会递归监听
+func (ca *CodeAnalyzer) addWatchDirs(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if ca.skipWatchDir(path) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// watch 监听代码目录中源文件的变化，合并一段时间内的变化后增量重建索引。
+// 重建与手动reindex一样持有indexMu写锁，不会与查询同时进行
+func (ca *CodeAnalyzer) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := ca.addWatchDirs(watcher, ca.codeDir); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch %s: %v", ca.codeDir, err)
+	}
+
+	reindex := func() {
+		response := ca.Reindex(context.Background(), false)
+		if response.Error != "" {
+			log.Printf("Auto reindex %s failed: %s", ca.name, response.Error)
+			return
+		}
+		log.Printf("Auto reindexed %s (%s): %d files, %d updated", ca.name, response.Mode, response.Files, response.Updated)
+	}
+
+	go func() {
+		defer watcher.Close()
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				path := filepath.Clean(event.Name)
+				if path == ca.tagsDir || strings.HasPrefix(path, ca.tagsDir+string(filepath.Separator)) {
+					continue
+				}
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				if info, err := os.Stat(path); err == nil && info.IsDir() {
+					// 新建的目录需要单独加入监听，其中已有的源文件同样需要重建索引
+					if !event.Has(fsnotify.Create) || ca.skipWatchDir(path) {
+						continue
+					}
+					if err := ca.addWatchDirs(watcher, path); err != nil {
+						log.Printf("Failed to watch %s: %v", path, err)
+					}
+				} else if !isSourceFile(path) && !(event.Has(fsnotify.Remove|fsnotify.Rename) && filepath.Ext(path) == "") {
+					// 删除或移走的没有扩展名的路径可能是目录，其中的源文件需要从索引中去掉
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(watchDelay, reindex)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Code watcher error for %s: %v", ca.name, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// containsString 判断字符串切片中是否包含指定值
+func containsString(items []string, target string) bool {
+	for _, item := range items {
+		if item == target {
+			return true
+		}
+	}
+	return false
+}
+
+// requestIDHeader 请求追踪ID的HTTP头，客户端未提供时由服务端生成
+const requestIDHeader = "X-Request-ID"
+
+// taskIDHeader task_executor发起请求时附带的任务ID
+const taskIDHeader = "X-Task-ID"
+
+// requestIDKey、taskIDKey 请求追踪ID和任务ID在context中的键
+type requestIDKey struct{}
+type taskIDKey struct{}
+
+// requestIDFromContext 返回context中的请求追踪ID
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// taskIDFromContext 返回context中的任务ID
+func taskIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(taskIDKey{}).(string)
+	return id
+}
+
+// logf 输出带请求追踪ID和任务ID前缀的日志
+func logf(ctx context.Context, format string, args ...interface{}) {
+	var tags []string
+	if id := requestIDFromContext(ctx); id != "" {
+		tags = append(tags, "req="+id)
+	}
+	if id := taskIDFromContext(ctx); id != "" {
+		tags = append(tags, "task="+id)
+	}
+	if len(tags) > 0 {
+		format = "[" + strings.Join(tags, " ") + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// validTraceID 客户端传入的追踪ID不能为空、过长或包含控制字符
+func validTraceID(id string) bool {
+	return id != "" && len(id) <= maxRequestIDLen && strings.IndexFunc(id, unicode.IsControl) < 0
+}
+
+// newRequestID 生成随机的请求追踪ID
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// maxRequestIDLen 接受的客户端请求追踪ID最大长度
+const maxRequestIDLen = 128
+
+// withRequestID 为请求分配追踪ID：沿用合法的X-Request-ID或生成新的，写入响应头和context，并记录请求耗时；
+// 请求带有X-Task-ID时一并记录到日志中
+func withRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSpace(r.Header.Get(requestIDHeader))
+		if !validTraceID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		if taskID := strings.TrimSpace(r.Header.Get(taskIDHeader)); validTraceID(taskID) {
+			ctx = context.WithValue(ctx, taskIDKey{}, taskID)
+		}
+		start := time.Now()
+		logf(ctx, "%s %s", r.Method, r.URL.Path)
+		next(w, r.WithContext(ctx))
+		logf(ctx, "%s %s done in %v", r.Method, r.URL.Path, time.Since(start))
+	}
+}
+
+// gzipResponseWriter 将响应体写入gzip压缩流，第一次写入时才设置Content-Encoding并创建压缩流
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.gz == nil {
+		if w.Header().Get("Content-Encoding") == "" {
+			w.WriteHeader(http.StatusOK)
+		}
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	return w.gz.Write(p)
+}
+
+// Flush 将已压缩的数据连同底层连接一起刷出，用于流式响应
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close 结束压缩流，写出gzip尾部
+func (w *gzipResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+// acceptsGzip 请求的Accept-Encoding是否包含gzip（q=0表示拒绝）
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+	}
+	return false
+}
+
+// withGzip 请求带有Accept-Encoding: gzip时压缩响应，find_refs等大响应经远程链路传输时可明显减少流量
+func withGzip(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		next(gw, r)
+	}
+}
+
+type Server struct {
+	// analyzer 主代码仓库
+	analyzer *CodeAnalyzer
+	// repos 全部代码仓库，主仓库在前
+	repos []*CodeAnalyzer
+	// version 启动时收集的构建信息和内置工具版本
+	version VersionResponse
+}
+
+// analyzerFor 按名称选择代码仓库，名称为空时返回主仓库
+func (s *Server) analyzerFor(name string) (*CodeAnalyzer, error) {
+	if name == "" {
+		return s.analyzer, nil
+	}
+	for _, repo := range s.repos {
+		if repo.name == name {
+			return repo, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown repo: %s", name)
+}
+
+// queryRepos 返回查询涉及的代码仓库：指定名称时只有该仓库，否则为全部仓库
+func (s *Server) queryRepos(name string) ([]*CodeAnalyzer, error) {
+	if name == "" {
+		return s.repos, nil
+	}
+	repo, err := s.analyzerFor(name)
+	if err != nil {
+		return nil, err
+	}
+	return []*CodeAnalyzer{repo}, nil
+}
+
+// getSymbolInfo 在各代码仓库中查找符号并合并结果，任一仓库找到即成功
+func (s *Server) getSymbolInfo(ctx context.Context, repos []*CodeAnalyzer, query SymbolQuery) types.SymbolResponse {
+	merged := types.SymbolResponse{Status: "failed"}
+	var errs []string
+	for _, repo := range repos {
+		response := repo.GetSymbolInfo(ctx, query)
+		switch {
+		case response.Status == "success":
+			merged.Status = "success"
+			merged.ResList = append(merged.ResList, response.ResList...)
+		case response.Error != errSymbolNotFound:
+			errs = append(errs, repo.name+": "+response.Error)
+		}
+	}
+
+	if merged.Status == "success" {
+		for _, err := range errs {
+			logf(ctx, "get_symbol %s: %s", query.Symbol, err)
+		}
+		return merged
+	}
+	if len(errs) == 0 {
+		merged.Error = errSymbolNotFound
+	} else {
+		merged.Error = strings.Join(errs, "; ")
+	}
+	return merged
+}
+
+// findAllRefs 在各代码仓库中查找引用，合并后统一分页
+func (s *Server) findAllRefs(ctx context.Context, repos []*CodeAnalyzer, query RefQuery) types.RefResponse {
+	response := types.RefResponse{}
+	var all []callerEntry
+	// owners owners[i]为all[i]所在的仓库，分页后从该仓库读取调用者代码
+	var owners []*CodeAnalyzer
+	var errs, warnings []string
+	for _, repo := range repos {
+		callers, repoWarnings, err := repo.findCallers(ctx, query, nil)
+		if err != nil {
+			errs = append(errs, repo.name+": "+err.Error())
+			continue
+		}
+		all = append(all, callers...)
+		for range callers {
+			owners = append(owners, repo)
+		}
+		warnings = append(warnings, prefixWarnings(repo, repos, repoWarnings)...)
+	}
+
+	// 全部仓库都失败时返回错误，部分失败作为警告和其他仓库的结果一起返回
+	if len(errs) == len(repos) {
+		response.Error = strings.Join(errs, "; ")
+		return response
+	}
+	for _, err := range errs {
+		logf(ctx, "find_refs %s: %s", query.Symbol, err)
+	}
+
+	// 只读取当前页调用者的代码，总数仍按分页前的全部调用者计算
+	pageOwners := paginate(owners, query.Offset, query.Limit)
+	var page []callerEntry
+	for i, caller := range paginate(all, query.Offset, query.Limit) {
+		caller, err := pageOwners[i].loadCallerContent(caller)
+		if err != nil {
+			warnings = append(warnings, prefixWarnings(pageOwners[i], repos, []string{err.Error()})...)
+			continue
+		}
+		page = append(page, caller)
+	}
+	setCallers(&response, page, len(all))
+	response.Warnings = append(errs, warnings...)
+	return response
+}
+
+// prefixWarnings 查询多个仓库时在警告前加上仓库名
+func prefixWarnings(repo *CodeAnalyzer, repos []*CodeAnalyzer, warnings []string) []string {
+	if len(repos) == 1 {
+		return warnings
+	}
+	prefixed := make([]string, len(warnings))
+	for i, warning := range warnings {
+		prefixed[i] = repo.name + ": " + warning
+	}
+	return prefixed
+}
+
+// streamRefs 以换行分隔的JSON（NDJSON）流式输出各代码仓库中的调用者，每个调用者的引用收集完就写出并flush，
+// 最后一行为RefStreamEnd。输出任何调用者之前全部仓库都失败时返回422和普通的错误响应
+func (s *Server) streamRefs(w http.ResponseWriter, r *http.Request, repos []*CodeAnalyzer, query RefQuery) {
+	ctx := r.Context()
+	controller := http.NewResponseController(w)
+	encoder := json.NewEncoder(w)
+	started := false
+
+	// offset 之前仓库的调用者数量，调用者下标在全部仓库中连续编号
+	offset := 0
+	emit := func(index int, entry callerEntry, refsOnly bool) error {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		line := types.RefStreamCaller{Index: offset + index, Refs: entry.refs}
+		if !refsOnly {
+			codeRange := entry.codeRange
+			line.Caller = entry.content
+			line.Range = &codeRange
+		}
+		if err := encoder.Encode(line); err != nil {
+			return err
+		}
+		controller.Flush()
+		return nil
+	}
+
+	var errs, warnings []string
+	for _, repo := range repos {
+		callers, repoWarnings, err := repo.findCallers(ctx, query, emit)
+		if err != nil {
+			errs = append(errs, repo.name+": "+err.Error())
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		offset += len(callers)
+		warnings = append(warnings, prefixWarnings(repo, repos, repoWarnings)...)
+	}
+	for _, err := range errs {
+		logf(ctx, "find_refs %s: %s", query.Symbol, err)
+	}
+
+	end := types.RefStreamEnd{Done: true, Total: offset}
+	if len(errs) == len(repos) || ctx.Err() != nil {
+		end.Error = strings.Join(errs, "; ")
+	} else {
+		end.Warnings = append(errs, warnings...)
+	}
+	if !started {
+		if end.Error != "" {
+			writeJSON(w, http.StatusUnprocessableEntity, types.RefResponse{Error: end.Error})
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	encoder.Encode(end)
+}
+
+// routes 返回注册了全部API的handler，与监听方式无关，也可直接交给httptest.NewServer
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/get_symbol", withRequestID(withGzip(s.getSymbolHandler)))
+	mux.HandleFunc("/api/find_refs", withRequestID(withGzip(s.findRefsHandler)))
+	mux.HandleFunc("/api/get_symbol_at", withRequestID(withGzip(s.getSymbolAtHandler)))
+	mux.HandleFunc("/api/reindex", withRequestID(withGzip(s.reindexHandler)))
+	mux.HandleFunc("/api/symbols_batch", withRequestID(withGzip(s.symbolsBatchHandler)))
+	mux.HandleFunc("/api/find_refs_batch", withRequestID(withGzip(s.findRefsBatchHandler)))
+	mux.HandleFunc("/api/raw_tags", withRequestID(withGzip(s.rawTagsHandler)))
+	mux.HandleFunc("/api/version", withRequestID(withGzip(s.versionHandler)))
+	return mux
+}
+
+// writeJSON 以指定状态码输出JSON响应
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) getSymbolHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req SymbolQuery
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	symbol, err := normalizeSymbol(req.Symbol)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, types.SymbolResponse{Status: "failed", Error: err.Error()})
+		return
+	}
+	req.Symbol = symbol
+	if err := validateFields(req.Fields); err != nil {
+		writeJSON(w, http.StatusBadRequest, types.SymbolResponse{Status: "failed", Error: err.Error()})
+		return
+	}
+
+	repos, err := s.queryRepos(req.Repo)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, types.SymbolResponse{Status: "failed", Error: err.Error()})
+		return
+	}
+
+	// 文件路径只对单个仓库有意义
+	if req.File != "" {
+		repo, _ := s.analyzerFor(req.Repo)
+		relPath, err := repo.resolveCodePath(req.File)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, types.SymbolResponse{Status: "failed", Error: err.Error()})
+			return
+		}
+		req.File = relPath
+		repos = []*CodeAnalyzer{repo}
+	}
+
+	response := s.getSymbolInfo(r.Context(), repos, req)
+	for i := range response.ResList {
+		response.ResList[i] = response.ResList[i].SelectFields(req.Fields)
+	}
+	writeJSON(w, symbolStatusCode(response), response)
+}
+
+// RawTagsRequest raw_tags请求参数
+type RawTagsRequest struct {
+	Symbol string `json:"symbol"`
+	// Repo 可选，只在该代码仓库中查找
+	Repo string `json:"repo,omitempty"`
+}
+
+// RawTagsResponse raw_tags响应，没有匹配时Entries为空列表
+type RawTagsResponse struct {
+	Status  string        `json:"status"`
+	Entries []RawTagEntry `json:"entries"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// rawTagsHandler 返回readtags对符号的原始输出，不经过get_symbol的ctags解析和定义选择
+func (s *Server) rawTagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RawTagsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	symbol, err := normalizeSymbol(req.Symbol)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, RawTagsResponse{Status: "failed", Error: err.Error()})
+		return
+	}
+
+	repos, err := s.queryRepos(req.Repo)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, RawTagsResponse{Status: "failed", Error: err.Error()})
+		return
+	}
+
+	response := RawTagsResponse{Status: "success", Entries: []RawTagEntry{}}
+	var errs []string
+	for _, repo := range repos {
+		entries, err := repo.RawTags(r.Context(), symbol)
+		if err != nil {
+			errs = append(errs, repo.name+": "+err.Error())
+			continue
+		}
+		response.Entries = append(response.Entries, entries...)
+	}
+	if len(errs) > 0 {
+		response.Error = strings.Join(errs, "; ")
+		if len(errs) == len(repos) {
+			response.Status = "failed"
+			writeJSON(w, http.StatusUnprocessableEntity, response)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// symbolStatusCode 根据符号查询结果选择HTTP状态码：未找到返回404，命令执行失败返回422
+func symbolStatusCode(response types.SymbolResponse) int {
+	switch {
+	case response.Error == errSymbolNotFound:
+		return http.StatusNotFound
+	case response.Status == "failed" || response.Error != "":
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusOK
+	}
+}
+
+// maxBatchSymbols 单次symbols_batch、find_refs_batch请求允许的最大符号数
+const maxBatchSymbols = 256
+
+// batchWorkers symbols_batch、find_refs_batch并发解析符号的最大协程数
+var batchWorkers = runtime.NumCPU()
+
+// SymbolsBatchRequest symbols_batch请求参数
+type SymbolsBatchRequest struct {
+	Symbols []string `json:"symbols"`
+	// Repo 可选，只在该代码仓库中查找
+	Repo string `json:"repo,omitempty"`
+}
+
+// FindRefsBatchRequest find_refs_batch请求参数，Mode和Repo对全部符号生效
+type FindRefsBatchRequest struct {
+	Symbols []string `json:"symbols"`
+	Mode    string   `json:"mode,omitempty"`
+	Repo    string   `json:"repo,omitempty"`
+}
+
+// FindRefsBatchResponse find_refs_batch响应，Results以请求中的符号名为键
+type FindRefsBatchResponse struct {
+	Results map[string]types.RefResponse `json:"results"`
+	Error   string                       `json:"error,omitempty"`
+}
+
+// findRefsBatchHandler 并发查找多个符号的引用，每个符号的结果与单独调用find_refs相同
+func (s *Server) findRefsBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req FindRefsBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Symbols) == 0 || len(req.Symbols) > maxBatchSymbols {
+		writeJSON(w, http.StatusBadRequest, FindRefsBatchResponse{Error: fmt.Sprintf("symbols must contain 1 to %d entries", maxBatchSymbols)})
+		return
+	}
+	if _, ok := refModeFlags[req.Mode]; req.Mode != "" && !ok {
+		writeJSON(w, http.StatusBadRequest, FindRefsBatchResponse{Error: fmt.Sprintf("unknown find_refs mode: %s", req.Mode)})
+		return
+	}
+
+	repos, err := s.queryRepos(req.Repo)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, FindRefsBatchResponse{Error: err.Error()})
+		return
+	}
+
+	response := FindRefsBatchResponse{Results: make(map[string]types.RefResponse, len(req.Symbols))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchWorkers)
+
+	for _, raw := range req.Symbols {
+		mu.Lock()
+		_, duplicate := response.Results[raw]
+		if !duplicate {
+			// 先占位，重复的符号只查找一次
+			response.Results[raw] = types.RefResponse{}
+		}
+		mu.Unlock()
+		if duplicate {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(raw string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var result types.RefResponse
+			if symbol, err := normalizeSymbol(raw); err != nil {
+				result = types.RefResponse{Error: err.Error()}
+			} else {
+				result = s.findAllRefs(r.Context(), repos, RefQuery{Symbol: symbol, Mode: req.Mode})
+			}
+
+			mu.Lock()
+			response.Results[raw] = result
+			mu.Unlock()
+		}(raw)
+	}
+	wg.Wait()
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// SymbolsBatchResponse symbols_batch响应，Results以请求中的符号名为键
+type SymbolsBatchResponse struct {
+	Results map[string]types.SymbolResponse `json:"results"`
+	Error   string                          `json:"error,omitempty"`
+}
+
+func (s *Server) symbolsBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req SymbolsBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Symbols) == 0 || len(req.Symbols) > maxBatchSymbols {
+		writeJSON(w, http.StatusBadRequest, SymbolsBatchResponse{Error: fmt.Sprintf("symbols must contain 1 to %d entries", maxBatchSymbols)})
+		return
+	}
+
+	repos, err := s.queryRepos(req.Repo)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, SymbolsBatchResponse{Error: err.Error()})
+		return
+	}
+
+	response := SymbolsBatchResponse{Results: make(map[string]types.SymbolResponse, len(req.Symbols))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchWorkers)
+
+	for _, raw := range req.Symbols {
+		mu.Lock()
+		_, duplicate := response.Results[raw]
+		if !duplicate {
+			// 先占位，重复的符号只解析一次
+			response.Results[raw] = types.SymbolResponse{}
+		}
+		mu.Unlock()
+		if duplicate {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(raw string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var result types.SymbolResponse
+			if symbol, err := normalizeSymbol(raw); err != nil {
+				result = types.SymbolResponse{Status: "failed", Error: err.Error()}
+			} else {
+				result = s.getSymbolInfo(r.Context(), repos, SymbolQuery{Symbol: symbol})
+			}
+
+			mu.Lock()
+			response.Results[raw] = result
+			mu.Unlock()
+		}(raw)
+	}
+	wg.Wait()
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) getSymbolAtHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		File string `json:"file"`
+		Line int    `json:"line"`
+		// Repo 文件所在的代码仓库，为空时为主仓库
+		Repo string `json:"repo,omitempty"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(req.File) == "" || req.Line < 1 {
+		writeJSON(w, http.StatusBadRequest, types.SymbolResponse{Status: "failed", Error: "file and a positive line are required"})
+		return
+	}
+
+	repo, err := s.analyzerFor(req.Repo)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, types.SymbolResponse{Status: "failed", Error: err.Error()})
+		return
+	}
+	if _, err := repo.resolveCodePath(req.File); err != nil {
+		writeJSON(w, http.StatusBadRequest, types.SymbolResponse{Status: "failed", Error: err.Error()})
+		return
+	}
+
+	response := repo.GetSymbolAt(r.Context(), req.File, req.Line)
+	writeJSON(w, symbolStatusCode(response), response)
+}
+
+func (s *Server) findRefsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RefQuery
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	symbol, err := normalizeSymbol(req.Symbol)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, types.RefResponse{Error: err.Error()})
+		return
+	}
+	req.NoCache = r.URL.Query().Get("nocache") == "true"
+	if req.Offset < 0 || req.Limit < 0 {
+		writeJSON(w, http.StatusBadRequest, types.RefResponse{Error: "offset and limit must not be negative"})
+		return
+	}
+	if _, ok := refModeFlags[req.Mode]; req.Mode != "" && !ok {
+		writeJSON(w, http.StatusBadRequest, types.RefResponse{Error: fmt.Sprintf("unknown find_refs mode: %s", req.Mode)})
+		return
+	}
+	req.Symbol = symbol
+
+	repos, err := s.queryRepos(req.Repo)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, types.RefResponse{Error: err.Error()})
+		return
+	}
+
+	// stream=true时逐个输出调用者，不支持分页
+	if r.URL.Query().Get("stream") == "true" {
+		if req.Offset != 0 || req.Limit != 0 {
+			writeJSON(w, http.StatusBadRequest, types.RefResponse{Error: "offset and limit are not supported with stream=true"})
+			return
+		}
+		s.streamRefs(w, r, repos, req)
+		return
+	}
+
+	response := s.findAllRefs(r.Context(), repos, req)
+	status := http.StatusOK
+	if response.Error != "" {
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, status, response)
+}
+
+func (s *Server) reindexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	repo, err := s.analyzerFor(r.URL.Query().Get("repo"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ReindexResponse{Status: "failed", Error: err.Error()})
+		return
+	}
+
+	// full=true时忽略已有的GTAGS，全量重建
+	response := repo.Reindex(r.Context(), r.URL.Query().Get("full") == "true")
+	status := http.StatusOK
+	if response.Error != "" {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, response)
+}
+
+// version 构建时通过-ldflags "-X main.version=..."注入的版本号
+var version = "dev"
+
+// VersionResponse /api/version的响应：服务自身的构建信息和内置工具的版本
+type VersionResponse struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	// Revision、BuildTime、Modified 来自构建时记录的VCS信息
+	Revision  string `json:"revision,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	// Tools 内置ctags、global的版本（--version输出的第一行）
+	Tools map[string]string `json:"tools"`
+}
+
+// versionString 返回--version输出的版本信息
+func versionString() string {
+	info := buildVersion()
+	text := fmt.Sprintf("code_server %s %s", info.Version, info.GoVersion)
+	if info.Revision != "" {
+		text += " revision " + info.Revision
+		if info.Modified {
+			text += "-dirty"
+		}
+	}
+	return text
+}
+
+// versionTools 启动时查询版本的内置工具
+var versionTools = []string{"ctags", "global"}
+
+// buildVersion 收集服务自身的构建信息
+func buildVersion() VersionResponse {
+	info := VersionResponse{Version: version, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Revision = setting.Value
+			case "vcs.time":
+				info.BuildTime = setting.Value
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+// toolVersions 运行内置工具的--version，返回每个工具输出的第一行
+func (ca *CodeAnalyzer) toolVersions() map[string]string {
+	versions := make(map[string]string)
+	for _, tool := range versionTools {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		output, err := exec.CommandContext(ctx, ca.getBinaryPath(tool), "--version").Output()
+		cancel()
+		if err != nil {
+			versions[tool] = "unknown: " + toolError(tool, err).Error()
+			continue
+		}
+		firstLine, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+		versions[tool] = strings.TrimSpace(firstLine)
+	}
+	return versions
+}
+
+func (s *Server) versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.version)
+}
+
+// validateCodeDir 检查代码目录存在、是目录且可读，返回其绝对路径
+func validateCodeDir(codeDir string) (string, error) {
+	codeDirAbs, err := filepath.Abs(codeDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve code dir %s: %v", codeDir, err)
+	}
+	info, err := os.Stat(codeDirAbs)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("code dir %s does not exist", codeDirAbs)
+		}
+		return "", fmt.Errorf("failed to stat code dir %s: %v", codeDirAbs, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("code dir %s is not a directory", codeDirAbs)
+	}
+	dir, err := os.Open(codeDirAbs)
+	if err != nil {
+		return "", fmt.Errorf("code dir %s is not readable: %v", codeDirAbs, err)
+	}
+	defer dir.Close()
+	if _, err := dir.Readdirnames(1); err != nil && err != io.EOF {
+		return "", fmt.Errorf("code dir %s is not readable: %v", codeDirAbs, err)
+	}
+	return codeDirAbs, nil
+}
+
+// indexFiles 启动时必须存在的索引文件及缺失时的提示
+var indexFiles = []struct {
+	name string
+	hint string
+}{
+	{"tags", "请先运行ctags生成tags文件"},
+	{"GPATH", "请先运行gtags生成tags文件"},
+	{"GTAGS", "请先运行gtags生成tags文件"},
+	{"GRTAGS", "请先运行gtags生成tags文件"},
+}
+
+// checkIndexFiles 检查tagsDir（绝对路径）及其下的tags GPATH GTAGS GRTAGS文件是否存在
+func checkIndexFiles(tagsDir string) error {
+	if _, err := os.Stat(tagsDir); os.IsNotExist(err) {
+		return fmt.Errorf("%s目录不存在，请先运行gtags生成tags文件", tagsDir)
+	}
+	for _, file := range indexFiles {
+		path := filepath.Join(tagsDir, file.name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return fmt.Errorf("%s文件不存在，%s", path, file.hint)
+		}
+	}
+	return nil
+}
+
+// unixListenPrefix --listen使用Unix domain socket时的地址前缀，如unix:/run/code_server.sock
+const unixListenPrefix = "unix:"
+
+// listenUnix 在path上监听Unix domain socket，先清理上次异常退出残留的socket文件
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s already exists and is not a socket", path)
+		}
+		// 还能连上说明有其他进程在使用该socket，不能删除
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+func main() {
+	// 解析命令行参数
+	codeDir := flag.String("code-dir", ".", "代码目录路径")
+	listenAddr := flag.String("listen", "0.0.0.0:0", "监听地址和端口 (格式: host:port，或unix:/path/to.sock监听Unix domain socket)")
+	refsCacheSize := flag.Int("refs-cache-size", 256, "find_refs结果缓存的最大符号数，0表示不缓存")
+	symbolCacheSize := flag.Int("symbol-cache-size", 1024, "按文件缓存ctags解析结果的最大文件数，0表示不缓存")
+	gtagsLabel := flag.String("gtags-label", "", "重建索引和查询引用时使用的GTAGSLABEL ("+strings.Join(gtagsLabels, "|")+")")
+	gtagsConf := flag.String("gtags-conf", "", "gtags.conf路径（GTAGSCONF），使用非默认GTAGSLABEL时需要")
+	flag.IntVar(&maxSnippetLines, "max-snippet-lines", 300, "单个符号或调用者返回的最大代码行数，超出部分截断，0表示不限制")
+	flag.IntVar(&batchWorkers, "batch-workers", runtime.NumCPU(), "symbols_batch、find_refs_batch并发解析符号的最大协程数")
+	var extraRepos repoFlags
+	flag.Var(&extraRepos, "extra-repo", "额外的代码仓库，格式为[name=]codeDir[,tagsDir]，可重复指定")
+	useSystemBinaries := flag.Bool("use-system-binaries", false, "从PATH查找ctags、readtags、global、gtags，不提取内置二进制文件")
+	binaryDir := flag.String("binary-dir", "", "使用该目录中的ctags、readtags、global、gtags，优先于--use-system-binaries")
+	watch := flag.Bool("watch", false, "监听代码目录，源文件变化后自动增量重建索引")
+	flag.DurationVar(&watchDelay, "watch-delay", watchDelay, "--watch时源文件变化后等待多久再重建索引，期间的变化合并为一次")
+	showVersion := flag.Bool("version", false, "输出版本信息后退出")
+
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	if batchWorkers < 1 {
+		batchWorkers = 1
+	}
+
+	if err := validateGtagsLabel(*gtagsLabel, *gtagsConf); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *gtagsLabel != "" && *gtagsLabel != "default" && *gtagsConf == "" {
+		log.Printf("警告: 未指定--gtags-conf，内置gtags没有配置文件，GTAGSLABEL=%s可能不会生效", *gtagsLabel)
+	}
+
+	// 检查代码目录，避免--code-dir写错时只在每个请求中报读文件错误
+	codeDirAbs, err := validateCodeDir(*codeDir)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// 所有启动检查都基于代码目录的绝对路径，与查询实际使用的目录一致，不依赖当前工作目录
+	if err := checkIndexFiles(filepath.Join(codeDirAbs, ".tsj")); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// 先完成监听再直接在该listener上服务，端口为0时由系统分配的端口不会在重新监听前被其他进程占用
+	// unix:前缀表示监听Unix domain socket
+	var listener net.Listener
+	if socketPath, ok := strings.CutPrefix(*listenAddr, unixListenPrefix); ok {
+		if socketPath == "" {
+			log.Fatalf("Failed to listen: empty unix socket path")
+		}
+		listener, err = listenUnix(socketPath)
+	} else {
+		listener, err = net.Listen("tcp", *listenAddr)
+	}
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+
+	// 创建代码分析器
+	var analyzerOpts []AnalyzerOption
+	switch {
+	case *binaryDir != "":
+		analyzerOpts = append(analyzerOpts, WithBinaryDir(*binaryDir))
+	case *useSystemBinaries:
+		analyzerOpts = append(analyzerOpts, WithSystemBinaries())
+	}
+	analyzer := NewCodeAnalyzer(codeDirAbs, "", analyzerOpts...)
+	analyzer.refCache = newRefCache(*refsCacheSize)
+	analyzer.symbolCache = newSymbolCache(*symbolCacheSize)
+	analyzer.gtagsLabel = *gtagsLabel
+	if *gtagsConf != "" {
+		analyzer.gtagsConf, _ = filepath.Abs(*gtagsConf)
+	}
+
+	// 程序退出时清理临时目录
+	defer analyzer.Close()
+
+	// 创建HTTP服务器
+	server := &Server{analyzer: analyzer, repos: []*CodeAnalyzer{analyzer}}
+	server.version = buildVersion()
+	server.version.Tools = analyzer.toolVersions()
+	for _, spec := range extraRepos {
+		name, repoDir, tagsDir := parseRepoSpec(spec)
+		if _, err := validateCodeDir(repoDir); err != nil {
+			log.Fatalf("extra repo %s: %v", spec, err)
+		}
+		repo, err := analyzer.NewRepoAnalyzer(name, repoDir, tagsDir)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if _, err := server.analyzerFor(repo.name); err == nil {
+			log.Fatalf("duplicate repo name: %s", repo.name)
+		}
+		if _, err := os.Stat(filepath.Join(repo.tagsDir, "tags")); err != nil {
+			log.Fatalf("repo %s: %s/tags不存在，请先生成tags文件", repo.name, repo.tagsDir)
+		}
+		server.repos = append(server.repos, repo)
+		log.Printf("Extra repo %s: %s (tags: %s)", repo.name, repo.codeDir, repo.tagsDir)
+	}
+
+	if *watch {
+		for _, repo := range server.repos {
+			if err := repo.watch(); err != nil {
+				log.Fatalf("Failed to start watcher for %s: %v", repo.name, err)
+			}
+			log.Printf("Watching %s for changes (delay %s)", repo.codeDir, watchDelay)
+		}
+	}
+
+	// tags文件格式不兼容时readtags查不到任何符号，启动时提前提示
+	for _, repo := range server.repos {
+		if err := repo.tagsFormatError(); err != nil {
+			log.Printf("警告: %s: %v", repo.name, err)
+		}
+	}
+
+	// 打印实际绑定的地址，端口为0时即系统分配的端口
+	boundAddr := listener.Addr().String()
+	if listener.Addr().Network() == "unix" {
+		boundAddr = unixListenPrefix + boundAddr
+	}
+	log.Printf("Starting server on %s", boundAddr)
+	log.Printf("Code directory: %s", *codeDir)
+	log.Printf("API endpoints:")
 	log.Printf("  POST /api/get_symbol - 获取符号信息")
 	log.Printf("  POST /api/find_refs - 获取符号引用")
-
-	if err := http.ListenAndServe(*listenAddr, nil); err != nil {
+	log.Printf("  POST /api/get_symbol_at - 获取文件指定行所在的符号")
+	log.Printf("  POST /api/reindex - 检测代码语言并重建索引（已有GTAGS时增量更新，?full=true全量重建）")
+	log.Printf("  POST /api/symbols_batch - 批量获取符号信息")
+	log.Printf("  POST /api/find_refs_batch - 批量获取符号引用")
+	log.Printf("  POST /api/raw_tags - 获取readtags对符号的原始输出")
+	log.Printf("  GET  /api/version - 服务构建信息和内置工具版本")
+
+	// 收到退出信号时关闭监听，正常返回以清理临时目录，net.UnixListener关闭时会删除socket文件
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		listener.Close()
+	}()
+	if err := http.Serve(listener, server.routes()); err != nil && !errors.Is(err, net.ErrClosed) {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
@@ -0,0 +1,1013 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lometsj/code_server/pkg/types"
+)
+
+// fixtureDir 带有预先生成的.tsj索引的测试代码目录
+const fixtureDir = "../../test_c_file"
+
+// testBinaryDir 提取内置的ctags、readtags、global、gtags，无法提取或在当前平台无法运行时跳过测试
+func testBinaryDir(t testing.TB) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, binary := range analyzerBinaries {
+		if err := extractBinary(binary, dir); err != nil {
+			t.Skipf("analyzer binaries unavailable: %v", err)
+		}
+	}
+	for _, tool := range versionTools {
+		if err := exec.Command(filepath.Join(dir, tool), "--version").Run(); err != nil {
+			t.Skipf("%s cannot run: %v", tool, err)
+		}
+	}
+	return dir
+}
+
+// copyFixture 将测试代码目录复制到临时目录，测试可以修改文件或重建索引而不影响仓库中的fixture
+func copyFixture(t testing.TB) string {
+	t.Helper()
+	dst := t.TempDir()
+	err := filepath.WalkDir(fixtureDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(fixtureDir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0644)
+	})
+	if err != nil {
+		t.Fatalf("copy fixture: %v", err)
+	}
+	return dst
+}
+
+// newTestAnalyzer 在fixture副本上创建使用内置工具的CodeAnalyzer
+func newTestAnalyzer(t testing.TB) *CodeAnalyzer {
+	t.Helper()
+	ca := NewCodeAnalyzer(copyFixture(t), "", WithBinaryDir(testBinaryDir(t)))
+	ca.refCache = newRefCache(16)
+	ca.symbolCache = newSymbolCache(16)
+	return ca
+}
+
+// newSourceAnalyzer 在临时目录中写入给定的源文件并建立索引，返回使用内置工具的CodeAnalyzer
+func newSourceAnalyzer(t testing.TB, files map[string]string) *CodeAnalyzer {
+	t.Helper()
+	binaryDir := testBinaryDir(t)
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ca := NewCodeAnalyzer(dir, "", WithBinaryDir(binaryDir))
+	ca.refCache = newRefCache(16)
+	ca.symbolCache = newSymbolCache(16)
+	if response := ca.Reindex(context.Background(), true); response.Status != "success" {
+		t.Fatalf("reindex: %+v", response)
+	}
+	return ca
+}
+
+// newTestServer 启动服务全部API的httptest.Server
+func newTestServer(t *testing.T) (*httptest.Server, *CodeAnalyzer) {
+	t.Helper()
+	ca := newTestAnalyzer(t)
+	s := &Server{analyzer: ca, repos: []*CodeAnalyzer{ca}}
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+	return ts, ca
+}
+
+// postJSON 发送POST请求，返回状态码和响应体
+func postJSON(t *testing.T, url, body string) (int, []byte) {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	return resp.StatusCode, data
+}
+
+func decodeJSON(t *testing.T, data []byte, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("decode %s: %v", data, err)
+	}
+}
+
+func TestGetSymbolFound(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	status, body := postJSON(t, ts.URL+"/api/get_symbol", `{"symbol":"print_log"}`)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body %s", status, body)
+	}
+	var response types.SymbolResponse
+	decodeJSON(t, body, &response)
+	if response.Status != "success" || len(response.ResList) == 0 {
+		t.Fatalf("unexpected response: %s", body)
+	}
+	sym := response.ResList[0]
+	if sym.Name != "print_log" || sym.Kind != "function" {
+		t.Errorf("got %s %s, want function print_log", sym.Kind, sym.Name)
+	}
+	if !strings.Contains(sym.Content, "void print_log(const char *message)") {
+		t.Errorf("content does not contain the definition:\n%s", sym.Content)
+	}
+	if sym.Line <= 0 || sym.End < sym.Line {
+		t.Errorf("invalid range %d-%d", sym.Line, sym.End)
+	}
+}
+
+func TestGetSymbolNotFound(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	status, body := postJSON(t, ts.URL+"/api/get_symbol", `{"symbol":"no_such_symbol"}`)
+	if status != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404, body %s", status, body)
+	}
+	var response types.SymbolResponse
+	decodeJSON(t, body, &response)
+	if response.Status != "failed" || response.Error != errSymbolNotFound {
+		t.Errorf("unexpected response: %s", body)
+	}
+}
+
+func TestMalformedRequests(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"get_symbol truncated JSON", "/api/get_symbol", `{"symbol":`, http.StatusBadRequest},
+		{"get_symbol wrong type", "/api/get_symbol", `{"symbol":42}`, http.StatusBadRequest},
+		{"get_symbol empty symbol", "/api/get_symbol", `{"symbol":"  "}`, http.StatusBadRequest},
+		{"find_refs truncated JSON", "/api/find_refs", `{"symbol":`, http.StatusBadRequest},
+		{"find_refs negative limit", "/api/find_refs", `{"symbol":"print_log","limit":-1}`, http.StatusBadRequest},
+		{"find_refs unknown mode", "/api/find_refs", `{"symbol":"print_log","mode":"bogus"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := postJSON(t, ts.URL+tt.path, tt.body)
+			if status != tt.want {
+				t.Errorf("status = %d, want %d, body %s", status, tt.want, body)
+			}
+		})
+	}
+
+	resp, err := http.Get(ts.URL + "/api/get_symbol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET get_symbol status = %d, want 405", resp.StatusCode)
+	}
+}
+
+func TestFindRefs(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	status, body := postJSON(t, ts.URL+"/api/find_refs", `{"symbol":"print_log"}`)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body %s", status, body)
+	}
+	var response types.RefResponse
+	decodeJSON(t, body, &response)
+	if response.Total == 0 || len(response.Callers) != response.Total {
+		t.Fatalf("total = %d, callers = %d", response.Total, len(response.Callers))
+	}
+	if len(response.CallerRefs) != len(response.Callers) || len(response.CallerRanges) != len(response.Callers) {
+		t.Fatalf("caller_refs/caller_ranges do not match callers: %s", body)
+	}
+	found := false
+	for i, caller := range response.Callers {
+		if strings.Contains(caller, "void log_system_info()") {
+			found = true
+		}
+		for _, ref := range response.CallerRefs[i] {
+			if ref.Tag != "print_log" || ref.File == "" || ref.Line <= 0 {
+				t.Errorf("unexpected ref %+v", ref)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("log_system_info not among callers of print_log")
+	}
+
+	status, body = postJSON(t, ts.URL+"/api/find_refs", `{"symbol":"no_such_symbol"}`)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body %s", status, body)
+	}
+	response = types.RefResponse{}
+	decodeJSON(t, body, &response)
+	if response.Total != 0 || len(response.Callers) != 0 {
+		t.Errorf("expected no callers, got %s", body)
+	}
+}
+
+// findRefs 调用find_refs并解析响应
+func findRefs(t *testing.T, url, body string) types.RefResponse {
+	t.Helper()
+	status, data := postJSON(t, url+"/api/find_refs", body)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body %s", status, data)
+	}
+	var response types.RefResponse
+	decodeJSON(t, data, &response)
+	return response
+}
+
+func TestFindRefsPagination(t *testing.T) {
+	ts, ca := newTestServer(t)
+
+	full := findRefs(t, ts.URL, `{"symbol":"print_log"}`)
+	if full.Total < 3 {
+		t.Fatalf("need at least 3 callers of print_log, got %d", full.Total)
+	}
+
+	for _, tt := range []struct{ offset, limit int }{{0, 1}, {1, 2}, {full.Total - 1, 5}, {full.Total, 1}} {
+		page := findRefs(t, ts.URL, fmt.Sprintf(`{"symbol":"print_log","offset":%d,"limit":%d}`, tt.offset, tt.limit))
+		if page.Total != full.Total {
+			t.Errorf("offset %d limit %d: total = %d, want %d", tt.offset, tt.limit, page.Total, full.Total)
+		}
+		end := min(tt.offset+tt.limit, full.Total)
+		if !reflect.DeepEqual(page.Callers, full.Callers[tt.offset:end]) ||
+			!reflect.DeepEqual(page.CallerRanges, full.CallerRanges[tt.offset:end]) {
+			t.Errorf("offset %d limit %d: page does not match the full list", tt.offset, tt.limit)
+		}
+	}
+
+	// 不分页的查找只确定调用者范围，代码在分页后按需读取
+	callers, _, err := ca.findCallers(context.Background(), RefQuery{Symbol: "print_log", NoCache: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, caller := range callers {
+		if caller.content != "" {
+			t.Errorf("caller %+v read before pagination", caller.codeRange)
+		}
+	}
+
+	// 流式输出仍然包含每个调用者的代码，缓存中没有代码时同样读取
+	for _, nocache := range []string{"true", "false"} {
+		resp, err := http.Post(ts.URL+"/api/find_refs?stream=true&nocache="+nocache, "application/json", strings.NewReader(`{"symbol":"print_log"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != full.Total+1 {
+			t.Fatalf("nocache=%s: got %d lines, want %d callers and the end line", nocache, len(lines), full.Total)
+		}
+		for i, line := range lines[:full.Total] {
+			var caller types.RefStreamCaller
+			decodeJSON(t, []byte(line), &caller)
+			if caller.Index != i || caller.Caller != full.Callers[i] {
+				t.Errorf("nocache=%s: line %d = %s", nocache, i, line)
+			}
+		}
+	}
+}
+
+// syntheticFileSymbols 构造n个互不嵌套、每个10行的函数，每隔100个函数有一个包含后面5个函数的外层函数
+func syntheticFileSymbols(tb testing.TB, n int) *fileSymbols {
+	tb.Helper()
+	info, err := os.Stat(fixtureDir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	syms := make([]Symbol, 0, n+n/100)
+	for i := 0; i < n; i++ {
+		end := i*10 + 9
+		syms = append(syms, Symbol{Name: fmt.Sprintf("func_%d", i), Kind: "function", Line: i*10 + 1, End: &end})
+		if i%100 == 0 {
+			outerEnd := (i+5)*10 + 9
+			syms = append(syms, Symbol{Name: fmt.Sprintf("outer_%d", i), Kind: "function", Line: i*10 + 1, End: &outerEnd})
+		}
+	}
+	return newFileSymbols("big.c", info, syms)
+}
+
+func TestEnclosingFunctionMatchesLinearScan(t *testing.T) {
+	fs := syntheticFileSymbols(t, 1000)
+	for lineNum := 0; lineNum <= 10010; lineNum++ {
+		got := fs.enclosingFunction(lineNum)
+		want := findEnclosingSymbol(fs.syms, lineNum, "function")
+		switch {
+		case got == nil && want == nil:
+		case got == nil || want == nil || got.Name != want.Name:
+			t.Fatalf("line %d: enclosingFunction = %v, linear scan = %v", lineNum, got, want)
+		}
+	}
+}
+
+func BenchmarkEnclosingFunction(b *testing.B) {
+	fs := syntheticFileSymbols(b, 20000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fs.enclosingFunction(i*7919%200000 + 1)
+	}
+}
+
+func TestParseCtagsOutput(t *testing.T) {
+	const mainTag = `{"_type": "tag", "name": "main", "path": "test.c", "pattern": "/^int main() {$/", "line": 10, "kind": "function", "end": 20}`
+	const logTag = `{"_type": "tag", "name": "print_log", "path": "test.c", "pattern": "/^void print_log() {$/", "line": 30, "kind": "function", "end": 35}`
+	const ptag = `{"_type": "ptag", "name": "JSON_OUTPUT_VERSION", "path": "1.0", "pattern": "in development"}`
+	const malformed = `{"_type": "tag", "name": broken`
+
+	tests := []struct {
+		name      string
+		output    string
+		wantNames []string
+		wantErr   string
+		wantLog   bool
+	}{
+		{"trailing blank lines", mainTag + "\n" + logTag + "\n\n\n", []string{"main", "print_log"}, "", false},
+		{"pseudo tags and non-JSON lines skipped", "!_TAG_FILE_FORMAT\t2\n" + ptag + "\n# comment\n" + mainTag + "\n", []string{"main"}, "", false},
+		{"malformed object logged", malformed + "\n" + logTag + "\n", []string{"print_log"}, "", true},
+		{"only malformed objects", malformed + "\n", nil, "1 malformed line(s)", true},
+		{"only pseudo tags", ptag + "\n", nil, errNoCtagsOutput.Error(), false},
+		{"empty output", "", nil, errNoCtagsOutput.Error(), false},
+		{"whitespace only", "\n  \n", nil, errNoCtagsOutput.Error(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			syms, err := parseCtagsOutput(context.Background(), "test.c", []byte(tt.output))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want containing %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var names []string
+			for _, sym := range syms {
+				names = append(names, sym.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.wantNames, ",") {
+				t.Errorf("symbols = %v, want %v", names, tt.wantNames)
+			}
+			if logged := strings.Contains(logs.String(), "failed to parse output line"); logged != tt.wantLog {
+				t.Errorf("logged parse error = %v, want %v (log: %q)", logged, tt.wantLog, logs.String())
+			}
+		})
+	}
+
+	syms, err := parseCtagsOutput(context.Background(), "test.c", []byte(mainTag))
+	if err != nil || len(syms) != 1 {
+		t.Fatalf("parse main: %v", err)
+	}
+	if sym := syms[0]; sym.Kind != "function" || sym.Line != 10 || sym.End == nil || *sym.End != 20 {
+		t.Errorf("unexpected symbol %+v", sym)
+	}
+}
+
+func TestPatternMatcher(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		line    string
+		want    bool
+	}{
+		{"exact line", `/^void print_log(const char *message) {$/`, "void print_log(const char *message) {", true},
+		{"exact line needs whole line", `/^int main() {$/`, "int main() { return 0; }", false},
+		{"call site does not match", `/^void target(void) {$/`, "    target();", false},
+		{"escaped slash and backslash", `/^char *s = "a\/b\\\\c";$/`, `char *s = "a/b\\c";`, true},
+		{"truncated pattern matches prefix", `/^int g(char *first, /`, "int g(char *first, char *second) {", true},
+		{"line number excmd", "42", "42", false},
+		{"empty pattern", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match := patternMatcher(tt.pattern)
+			if got := match != nil && match(tt.line); got != tt.want {
+				t.Errorf("match(%q, %q) = %v, want %v", tt.pattern, tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+// staleSource 在target定义上方插入了两行，调用处离索引行号比定义更近
+const staleSource = `// header
+void helper(void);
+int x;
+void caller(void) { target(); }
+// inserted 1
+// inserted 2
+void target(void) {
+    return;
+}
+`
+
+func TestGetSymbolContentRealignsStaleTag(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "stale.c"), []byte(staleSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ca := &CodeAnalyzer{codeDir: dir}
+
+	// 索引中target位于插入前的5-7行
+	content, shift, err := ca.getSymbolContent("stale.c", `/^void target(void) {$/`, 5, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shift != 2 {
+		t.Errorf("shift = %d, want 2", shift)
+	}
+	if want := "void target(void) {\n    return;\n}"; content != want {
+		t.Errorf("content = %q, want %q", content, want)
+	}
+
+	// 没有pattern时不猜测位置，按索引行号返回
+	if _, shift, err := ca.getSymbolContent("stale.c", "", 5, 7); err != nil || shift != 0 {
+		t.Errorf("without pattern shift = %d, err = %v, want 0", shift, err)
+	}
+}
+
+func TestGetSymbolWithStaleIndex(t *testing.T) {
+	ca := newTestAnalyzer(t)
+	ctx := context.Background()
+	fs, err := ca.loadFileSymbols(ctx, "test.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 在文件开头插入一行后，保留插入前的解析结果，模拟索引落后于文件内容
+	path := filepath.Join(ca.codeDir, "test.c")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append([]byte("// inserted line\n"), data...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.symbolCache.put(newFileSymbols("test.c", info, fs.syms))
+
+	response := ca.GetSymbolInfo(ctx, SymbolQuery{Symbol: "print_log"})
+	if response.Status != "success" || len(response.ResList) != 1 {
+		t.Fatalf("unexpected response %+v", response)
+	}
+	sym := response.ResList[0]
+	if sym.LineShift != 1 {
+		t.Errorf("line_shift = %d, want 1", sym.LineShift)
+	}
+	if !strings.HasPrefix(sym.Content, "void print_log(const char *message) {") {
+		t.Errorf("content does not start at the definition:\n%s", sym.Content)
+	}
+}
+
+func TestToolErrorIncludesStderr(t *testing.T) {
+	_, err := exec.Command("sh", "-c", "echo 'global: GTAGS not found.' >&2; exit 3").Output()
+	got := toolError("global", err).Error()
+	if want := "global command failed: exit status 3: global: GTAGS not found."; got != want {
+		t.Errorf("toolError = %q, want %q", got, want)
+	}
+
+	_, err = exec.Command("sh", "-c", "exit 1").Output()
+	if got, want := toolError("ctags", err).Error(), "ctags command failed: exit status 1"; got != want {
+		t.Errorf("toolError without stderr = %q, want %q", got, want)
+	}
+
+	_, err = exec.Command("sh", "-c", fmt.Sprintf("head -c %d /dev/zero | tr '\\\\0' x >&2; exit 1", maxStderrLen*2)).Output()
+	if got := toolError("readtags", err).Error(); !strings.HasSuffix(got, "...(truncated)") || len(got) > maxStderrLen+100 {
+		t.Errorf("long stderr not truncated: %d bytes", len(got))
+	}
+
+	// 工具所在目录中的global出错时，find_refs的错误带有其stderr
+	dir := testBinaryDir(t)
+	script := "#!/bin/sh\necho 'global: GTAGS not found.' >&2\nexit 3\n"
+	if err := os.Remove(filepath.Join(dir, "global")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "global"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ca := NewCodeAnalyzer(copyFixture(t), "", WithBinaryDir(dir))
+	response := ca.FindAllRefs(context.Background(), RefQuery{Symbol: "print_log"})
+	if !strings.Contains(response.Error, "global: GTAGS not found.") {
+		t.Errorf("find_refs error = %q, want the global stderr", response.Error)
+	}
+}
+
+// declarations 包含没有结束行的typedef、结构体成员和普通函数的C代码
+const declarations = `typedef int myint;
+int proto(int x);
+struct point { int x; int y; };
+typedef struct point point_t;
+static int counter;
+int add(int a, int b) {
+    return a + b;
+}
+`
+
+func TestParseFileSymbols(t *testing.T) {
+	ca := newSourceAnalyzer(t, map[string]string{"decl.c": declarations})
+	ctx := context.Background()
+
+	syms, err := ca.parseFileSymbols(ctx, "decl.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]Symbol)
+	for _, sym := range syms {
+		if sym.Path != "decl.c" {
+			t.Errorf("symbol %s has path %q", sym.Name, sym.Path)
+		}
+		byName[sym.Name] = sym
+	}
+	add, ok := byName["add"]
+	if !ok {
+		t.Fatalf("add not found in %+v", syms)
+	}
+	if add.Kind != "function" || add.Line != 6 || add.End == nil || *add.End != 8 ||
+		add.Typeref != "typename:int" || add.Pattern != "/^int add(int a, int b) {$/" {
+		t.Errorf("unexpected add %+v", add)
+	}
+	if counter := byName["counter"]; counter.Kind != "variable" || counter.Line != 5 {
+		t.Errorf("unexpected counter %+v", counter)
+	}
+
+	// 文件未修改时直接使用缓存的解析结果
+	again, err := ca.parseFileSymbols(ctx, "decl.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) == 0 || &again[0] != &syms[0] {
+		t.Errorf("second parse did not use the cache")
+	}
+
+	if _, err := ca.parseFileSymbols(ctx, "missing.c"); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestSymbolOptionalEndAndScope(t *testing.T) {
+	ca := newSourceAnalyzer(t, map[string]string{"decl.c": declarations})
+	ctx := context.Background()
+	syms, err := ca.parseFileSymbols(ctx, "decl.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]Symbol)
+	for _, sym := range syms {
+		byName[sym.Name] = sym
+	}
+
+	// typedef没有结束行
+	for _, name := range []string{"myint", "point_t"} {
+		if sym := byName[name]; sym.Kind != "typedef" || sym.End != nil {
+			t.Errorf("%s = %+v, want a typedef without end", name, sym)
+		}
+	}
+	if typeref := byName["point_t"].Typeref; typeref != "struct:point" {
+		t.Errorf("point_t typeref = %q", typeref)
+	}
+	for _, name := range []string{"x", "y"} {
+		if sym := byName[name]; sym.Kind != "member" || sym.Scope != "point" || sym.ScopeKind != "struct" {
+			t.Errorf("%s = %+v, want a member of struct point", name, sym)
+		}
+	}
+
+	data, err := json.Marshal(byName["myint"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"end":null`) {
+		t.Errorf("marshal = %s, want end null", data)
+	}
+
+	// 没有结束行的符号不能作为包含某行的定义
+	if response := ca.GetSymbolAt(ctx, "decl.c", 1); response.Status != "failed" {
+		t.Errorf("get_symbol_at line 1 = %+v, want not found", response)
+	}
+	response := ca.GetSymbolAt(ctx, "decl.c", 7)
+	if response.Status != "success" || len(response.ResList) != 1 || response.ResList[0].Name != "add" {
+		t.Errorf("get_symbol_at line 7 = %+v, want add", response)
+	}
+}
+
+// typedefChain 经过多层typedef（跨文件）才到达结构体定义，以及互相引用的typedef
+var typedefChain = map[string]string{
+	"inner.c": `struct inner {
+    int value;
+};
+`,
+	"alias.c": `typedef struct inner inner_t;
+typedef inner_t handle_t;
+typedef handle_t *handle_ptr;
+typedef loop_b loop_a;
+typedef loop_a loop_b;
+`,
+}
+
+func TestGetSymbolResolvesTypedefChain(t *testing.T) {
+	ca := newSourceAnalyzer(t, typedefChain)
+	ctx := context.Background()
+
+	tests := []struct {
+		symbol       string
+		wantName     string
+		wantFile     string
+		resolvedFrom []string
+	}{
+		{"inner_t", "inner", "inner.c", []string{"inner_t"}},
+		{"handle_t", "inner", "inner.c", []string{"handle_t", "inner_t"}},
+		{"handle_ptr", "inner", "inner.c", []string{"handle_ptr", "handle_t", "inner_t"}},
+		// 循环的typedef在回到已经过的符号时停止，返回最后的typedef本身
+		{"loop_a", "loop_a", "alias.c", []string{"loop_a", "loop_b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.symbol, func(t *testing.T) {
+			response := ca.GetSymbolInfo(ctx, SymbolQuery{Symbol: tt.symbol})
+			if response.Status != "success" || len(response.ResList) != 1 {
+				t.Fatalf("unexpected response %+v", response)
+			}
+			sym := response.ResList[0]
+			if sym.Name != tt.wantName || filepath.Clean(sym.File) != tt.wantFile {
+				t.Errorf("resolved to %s in %s, want %s in %s", sym.Name, sym.File, tt.wantName, tt.wantFile)
+			}
+			if !reflect.DeepEqual(sym.ResolvedFrom, tt.resolvedFrom) {
+				t.Errorf("resolved_from = %v, want %v", sym.ResolvedFrom, tt.resolvedFrom)
+			}
+		})
+	}
+
+	if response := ca.GetSymbolInfo(ctx, SymbolQuery{Symbol: "inner"}); len(response.ResList) != 1 || len(response.ResList[0].ResolvedFrom) != 0 {
+		t.Errorf("direct lookup = %+v, want no resolved_from", response)
+	}
+}
+
+func TestNestedDefinitions(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join(fixtureDir, "nested.cpp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := newSourceAnalyzer(t, map[string]string{"nested.cpp": string(data)})
+	ctx := context.Background()
+
+	// 第9行同时位于outer和其中的Local::run中，应返回最内层的run
+	for _, tt := range []struct {
+		line      int
+		want      string
+		wantRange [2]int
+	}{
+		{5, "outer", [2]int{4, 13}},
+		{9, "run", [2]int{7, 10}},
+		{12, "outer", [2]int{4, 13}},
+		{16, "helper", [2]int{15, 18}},
+	} {
+		response := ca.GetSymbolAt(ctx, "nested.cpp", tt.line)
+		if response.Status != "success" || len(response.ResList) != 1 {
+			t.Errorf("line %d: unexpected response %+v", tt.line, response)
+			continue
+		}
+		sym := response.ResList[0]
+		if sym.Name != tt.want || [2]int{sym.Line, sym.End} != tt.wantRange {
+			t.Errorf("line %d: got %s %d-%d, want %s %d-%d", tt.line, sym.Name, sym.Line, sym.End, tt.want, tt.wantRange[0], tt.wantRange[1])
+		}
+	}
+
+	// 调用者同样取最内层的函数
+	response := ca.FindAllRefs(ctx, RefQuery{Symbol: "helper", Mode: "refs"})
+	found := false
+	for i, refs := range response.CallerRefs {
+		for _, ref := range refs {
+			if ref.Line != 9 {
+				continue
+			}
+			found = true
+			if r := response.CallerRanges[i]; r.Line != 7 || r.End != 10 {
+				t.Errorf("caller of line 9 = %+v, want run at 7-10", r)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("reference at line 9 not found: %+v", response)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, GZIP", true},
+		{"gzip;q=0.5, br", true},
+		{"gzip; q=0", false},
+		{"br, identity", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/get_symbol", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		if got := acceptsGzip(r); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestGzipResponse(t *testing.T) {
+	ts, _ := newTestServer(t)
+	body := `{"symbol":"print_log"}`
+
+	// 显式设置Accept-Encoding时Transport不会自动解压，可以检查原始响应
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/find_refs", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("status = %d, Content-Encoding = %q", resp.StatusCode, resp.Header.Get("Content-Encoding"))
+	}
+	if !strings.Contains(resp.Header.Get("Vary"), "Accept-Encoding") {
+		t.Errorf("Vary = %q", resp.Header.Get("Vary"))
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response types.RefResponse
+	decodeJSON(t, data, &response)
+	if response.Total == 0 {
+		t.Errorf("empty find_refs response: %s", data)
+	}
+
+	// 不接受gzip的客户端收到未压缩的响应
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err = client.Post(ts.URL+"/api/find_refs", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Content-Encoding = %q without Accept-Encoding", resp.Header.Get("Content-Encoding"))
+	}
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodeJSON(t, data, &types.RefResponse{})
+}
+
+func TestParseSymbolExpr(t *testing.T) {
+	tests := []struct {
+		expr   string
+		chain  []string
+		member bool
+	}{
+		{"print_log", []string{"print_log"}, false},
+		{"  print_log  ", []string{"print_log"}, false},
+		{"a->b->c", []string{"a", "b", "c"}, true},
+		{"s.field", []string{"s", "field"}, true},
+		{"(*p).x", []string{"p", "x"}, true},
+		{"a[i].b", []string{"a", "b"}, true},
+		{"a[i + j->k]->b", []string{"a", "b"}, true},
+		{"obj->f()", []string{"obj", "f"}, true},
+		{"get_ctx()->cfg.name", []string{"get_ctx", "cfg", "name"}, true},
+		{"&ctx->lock", []string{"ctx", "lock"}, true},
+		{"struct foo *p", []string{"foo"}, false},
+		{"struct foo", []string{"foo"}, false},
+		{"union u", []string{"u"}, false},
+		{"ns::Class::method", []string{"ns::Class::method"}, false},
+		{"Class::~Class", []string{"Class::~Class"}, false},
+		{"a, b", []string{"b"}, false},
+		{"*", []string{"*"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got := parseSymbolExpr(tt.expr)
+			if !reflect.DeepEqual(got.chain, tt.chain) || got.member != tt.member {
+				t.Errorf("parseSymbolExpr(%q) = %v (member %v), want %v (member %v)", tt.expr, got.chain, got.member, tt.chain, tt.member)
+			}
+			if got.name() != tt.chain[len(tt.chain)-1] {
+				t.Errorf("name() = %q", got.name())
+			}
+		})
+	}
+}
+
+// memberSource 两个结构体有同名成员name，经指针成员、typedef和局部变量访问
+var memberSource = map[string]string{
+	"server.h": `struct config {
+    char *name;
+    int port;
+};
+
+typedef struct config config_t;
+
+struct server {
+    const char *name;
+    config_t *cfg;
+    struct server *next;
+};
+`,
+	"server.c": `#include "server.h"
+
+struct server *g_server;
+
+int start(struct server *srv) {
+    config_t local;
+    local.port = srv->cfg->port;
+    return srv->next->cfg->port + local.port;
+}
+`,
+}
+
+func TestResolveMember(t *testing.T) {
+	ca := newSourceAnalyzer(t, memberSource)
+	ctx := context.Background()
+
+	tests := []struct {
+		query        SymbolQuery
+		wantLine     int
+		resolvedFrom []string
+	}{
+		{SymbolQuery{Symbol: "g_server->name"}, 9, []string{"g_server"}},
+		// 同名成员按所属结构体区分
+		{SymbolQuery{Symbol: "g_server->cfg->name"}, 2, []string{"g_server", "cfg"}},
+		{SymbolQuery{Symbol: "g_server->next->cfg->port"}, 3, []string{"g_server", "next", "cfg"}},
+		// 参数和局部变量需要指定文件
+		{SymbolQuery{Symbol: "srv->cfg", File: "server.c"}, 10, []string{"srv"}},
+		{SymbolQuery{Symbol: "local.port", File: "server.c"}, 3, []string{"local"}},
+		{SymbolQuery{Symbol: "(*g_server).next"}, 11, []string{"g_server"}},
+		// 找不到变量时退回按最后一个标识符查找
+		{SymbolQuery{Symbol: "nobody->port"}, 3, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query.Symbol, func(t *testing.T) {
+			response := ca.GetSymbolInfo(ctx, tt.query)
+			if response.Status != "success" || len(response.ResList) != 1 {
+				t.Fatalf("unexpected response %+v", response)
+			}
+			sym := response.ResList[0]
+			if sym.Kind != "member" || sym.Line != tt.wantLine || filepath.Clean(sym.File) != "server.h" {
+				t.Errorf("got %s %s at %s:%d, want member at server.h:%d", sym.Kind, sym.Name, sym.File, sym.Line, tt.wantLine)
+			}
+			if len(sym.ResolvedFrom) != len(tt.resolvedFrom) || (len(tt.resolvedFrom) > 0 && !reflect.DeepEqual(sym.ResolvedFrom, tt.resolvedFrom)) {
+				t.Errorf("resolved_from = %v, want %v", sym.ResolvedFrom, tt.resolvedFrom)
+			}
+		})
+	}
+
+	response := ca.GetSymbolInfo(ctx, SymbolQuery{Symbol: "g_server->name"})
+	if want := "    const char *name;"; len(response.ResList) != 1 || response.ResList[0].Content != want {
+		t.Errorf("content = %+v, want %q", response.ResList, want)
+	}
+	if response := ca.GetSymbolInfo(ctx, SymbolQuery{Symbol: "g_server->missing"}); response.Status != "failed" || response.Error != errSymbolNotFound {
+		t.Errorf("missing member = %+v, want not found", response)
+	}
+}
+
+func TestBinaryOptions(t *testing.T) {
+	binaryDir := testBinaryDir(t)
+	codeDir := copyFixture(t)
+	ctx := context.Background()
+
+	// 注入的目录转为绝对路径，Close时不删除
+	old, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Dir(binaryDir)); err != nil {
+		t.Fatal(err)
+	}
+	ca := NewCodeAnalyzer(codeDir, "", WithBinaryDir(filepath.Base(binaryDir)))
+	if err := os.Chdir(old); err != nil {
+		t.Fatal(err)
+	}
+	if ca.binaryDir != binaryDir {
+		t.Errorf("binaryDir = %s, want %s", ca.binaryDir, binaryDir)
+	}
+	if got, want := ca.getBinaryPath("global"), filepath.Join(binaryDir, "global"); got != want {
+		t.Errorf("getBinaryPath = %s, want %s", got, want)
+	}
+	if response := ca.GetSymbolInfo(ctx, SymbolQuery{Symbol: "print_log"}); response.Status != "success" {
+		t.Errorf("get_symbol with injected binaries = %+v", response)
+	}
+	if err := ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(binaryDir, "ctags")); err != nil {
+		t.Errorf("injected binary directory was removed: %v", err)
+	}
+
+	// 从PATH查找时直接使用工具名；ctags排序时还需要系统的sort
+	t.Setenv("PATH", binaryDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	ca = NewCodeAnalyzer(codeDir, "", WithSystemBinaries())
+	if ca.binaryDir != "" || ca.getBinaryPath("readtags") != "readtags" {
+		t.Errorf("binaryDir = %q, getBinaryPath = %q", ca.binaryDir, ca.getBinaryPath("readtags"))
+	}
+	if response := ca.GetSymbolInfo(ctx, SymbolQuery{Symbol: "print_log"}); response.Status != "success" {
+		t.Errorf("get_symbol with binaries from PATH = %+v", response)
+	}
+	if err := ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 默认提取内置二进制文件到临时目录，Close时删除
+	ca = NewCodeAnalyzer(codeDir, "")
+	extracted := ca.binaryDir
+	if extracted == "" || !ca.ownsBinaryDir {
+		t.Fatalf("binaryDir = %q, ownsBinaryDir = %v", extracted, ca.ownsBinaryDir)
+	}
+	if _, err := os.Stat(filepath.Join(extracted, "gtags")); err != nil {
+		t.Errorf("gtags not extracted: %v", err)
+	}
+	if err := ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(extracted); !os.IsNotExist(err) {
+		t.Errorf("extracted binary directory %s still exists", extracted)
+	}
+}
+
+func TestNewRepoAnalyzerCaches(t *testing.T) {
+	ctx := context.Background()
+
+	// 未启用缓存时额外仓库同样不缓存
+	ca := NewCodeAnalyzer(copyFixture(t), "", WithBinaryDir(testBinaryDir(t)))
+	repo, err := ca.NewRepoAnalyzer("extra", copyFixture(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.refCache != nil || repo.symbolCache != nil {
+		t.Errorf("caches enabled for repo without parent caches: %v %v", repo.refCache, repo.symbolCache)
+	}
+	if response := repo.GetSymbolInfo(ctx, SymbolQuery{Symbol: "print_log"}); response.Status != "success" {
+		t.Errorf("get_symbol without caches = %+v", response)
+	}
+
+	// 启用缓存时容量相同、内容相互独立
+	ca = newTestAnalyzer(t)
+	repo, err = ca.NewRepoAnalyzer("extra", copyFixture(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.refCache == nil || repo.refCache == ca.refCache || repo.refCache.capacity != ca.refCache.capacity {
+		t.Errorf("ref cache not cloned: %+v", repo.refCache)
+	}
+	if repo.symbolCache == nil || repo.symbolCache == ca.symbolCache || repo.symbolCache.capacity != ca.symbolCache.capacity {
+		t.Errorf("symbol cache not cloned: %+v", repo.symbolCache)
+	}
+}
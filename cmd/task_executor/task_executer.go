@@ -2,37 +2,378 @@ package main
 
 import (
 	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gorilla/websocket"
+	"github.com/lometsj/code_server/pkg/types"
 )
 
 type DataStore struct {
-	data     Config
+	data     types.Config
 	mu       sync.Mutex
 	filepath string
+	// lastContent 最近一次加载或写入的文件内容，用于忽略执行器自身写入触发的文件变更
+	lastContent []byte
 }
 
 var dataStore = &DataStore{}
 
 // TaskList 任务列表
-var TaskList = []Task{}
+var TaskList = []types.Task{}
 var taskListMutex sync.Mutex
 
-// TaskResult 任务结果
+// 任务状态
+const (
+	TaskStateQueued    = "queued"
+	TaskStateRunning   = "running"
+	TaskStateCompleted = "completed"
+	TaskStateFailed    = "failed"
+)
+
+// TaskStatus 同一ID下任务的状态统计（批量任务共用一个ID）
+type TaskStatus struct {
+	ID        string    `json:"id"`
+	State     string    `json:"state"`
+	Queued    int       `json:"queued"`
+	Running   int       `json:"running"`
+	Completed int       `json:"completed"`
+	Failed    int       `json:"failed"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// refreshState 根据各状态的任务数更新整体状态：有运行中的为running，其次queued，全部结束后有失败的为failed
+func (ts *TaskStatus) refreshState() {
+	switch {
+	case ts.Running > 0:
+		ts.State = TaskStateRunning
+	case ts.Queued > 0:
+		ts.State = TaskStateQueued
+	case ts.Failed > 0:
+		ts.State = TaskStateFailed
+	default:
+		ts.State = TaskStateCompleted
+	}
+	ts.UpdatedAt = time.Now()
+}
+
+// finished 该ID下的任务是否都已结束
+func (ts *TaskStatus) finished() bool {
+	return ts.Queued == 0 && ts.Running == 0
+}
+
+// maxRetainedTasks 内存中保留的已结束任务状态数量，超出后按LRU淘汰，结果文件不受影响
+var maxRetainedTasks = 10000
+
+// taskTracker 按任务ID记录任务状态，排队和运行中的任务不会被淘汰
+type taskTracker struct {
+	mu       sync.Mutex
+	statuses map[string]*TaskStatus
+	// finishedList 已结束任务的ID，最近访问的在前
+	finishedList *list.List
+	finishedElem map[string]*list.Element
+	// queuedTotal、runningTotal 所有ID下排队和运行中的任务总数
+	queuedTotal  int
+	runningTotal int
+}
+
+func newTaskTracker() *taskTracker {
+	return &taskTracker{
+		statuses:     make(map[string]*TaskStatus),
+		finishedList: list.New(),
+		finishedElem: make(map[string]*list.Element),
+	}
+}
+
+var tracker = newTaskTracker()
+
+// status 返回任务状态，不存在时创建，调用方需持有锁
+func (tt *taskTracker) status(id string) *TaskStatus {
+	ts, ok := tt.statuses[id]
+	if !ok {
+		ts = &TaskStatus{ID: id}
+		tt.statuses[id] = ts
+	}
+	return ts
+}
+
+// update 在锁内修改任务状态，并根据是否结束维护LRU列表
+func (tt *taskTracker) update(id string, fn func(ts *TaskStatus)) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	ts := tt.status(id)
+	fn(ts)
+	ts.refreshState()
+
+	if elem, ok := tt.finishedElem[id]; ok {
+		tt.finishedList.Remove(elem)
+		delete(tt.finishedElem, id)
+	}
+	if ts.finished() {
+		tt.finishedElem[id] = tt.finishedList.PushFront(id)
+		tt.evict()
+	}
+}
+
+// evict 淘汰最久未访问的已结束任务，调用方需持有锁
+func (tt *taskTracker) evict() {
+	for tt.finishedList.Len() > maxRetainedTasks {
+		oldest := tt.finishedList.Back()
+		id := oldest.Value.(string)
+		tt.finishedList.Remove(oldest)
+		delete(tt.finishedElem, id)
+		delete(tt.statuses, id)
+	}
+}
+
+// queued 记录一个任务进入队列
+func (tt *taskTracker) queued(id string) {
+	tt.update(id, func(ts *TaskStatus) {
+		ts.Queued++
+		tt.queuedTotal++
+	})
+}
+
+// started 记录一个任务开始执行
+func (tt *taskTracker) started(id string) {
+	tt.update(id, func(ts *TaskStatus) {
+		ts.Queued--
+		ts.Running++
+		tt.queuedTotal--
+		tt.runningTotal++
+	})
+}
+
+// done 记录一个任务执行结束
+func (tt *taskTracker) done(id string, err error) {
+	tt.update(id, func(ts *TaskStatus) {
+		ts.Running--
+		tt.runningTotal--
+		if err != nil {
+			ts.Failed++
+		} else {
+			ts.Completed++
+		}
+	})
+}
+
+// unqueued 撤销一次queued记录，用于任务未能放入队列的情况
+func (tt *taskTracker) unqueued(id string) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	ts, ok := tt.statuses[id]
+	if !ok {
+		return
+	}
+	ts.Queued--
+	tt.queuedTotal--
+	// 该ID没有其他任务时直接删除，不作为已结束任务保留
+	if ts.finished() && ts.Completed == 0 && ts.Failed == 0 {
+		delete(tt.statuses, id)
+		return
+	}
+	ts.refreshState()
+	if ts.finished() {
+		tt.finishedElem[id] = tt.finishedList.PushFront(id)
+		tt.evict()
+	}
+}
+
+// counts 返回排队和运行中的任务总数
+func (tt *taskTracker) counts() (int, int) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	return tt.queuedTotal, tt.runningTotal
+}
+
+// get 返回任务状态的副本，已结束的任务同时刷新其LRU位置
+func (tt *taskTracker) get(id string) (TaskStatus, bool) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	ts, ok := tt.statuses[id]
+	if !ok {
+		return TaskStatus{}, false
+	}
+	if elem, ok := tt.finishedElem[id]; ok {
+		tt.finishedList.MoveToFront(elem)
+	}
+	return *ts, true
+}
+
+// idempotencyTTL 任务结束后幂等key继续有效的时间
+var idempotencyTTL = time.Hour
+
+// idempotencyEntry 幂等key对应的任务，任务排队或执行中时不会过期
+type idempotencyEntry struct {
+	taskID  string
+	active  bool
+	expires time.Time
+}
+
+// idempotencyStore 记录幂等key到任务ID的映射
+type idempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+}
+
+var idempotency = &idempotencyStore{entries: make(map[string]*idempotencyEntry)}
+
+// claim 为key登记taskID。key已对应未过期的任务时返回该任务ID和false
+func (s *idempotencyStore) claim(key, taskID string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	// 最多每分钟清理一次过期的key
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, e := range s.entries {
+			if !e.active && now.After(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if e, ok := s.entries[key]; ok && (e.active || now.Before(e.expires)) {
+		return e.taskID, false
+	}
+	s.entries[key] = &idempotencyEntry{taskID: taskID, active: true}
+	return taskID, true
+}
+
+// release 任务未能入队或未执行时删除key，客户端可以重新提交
+func (s *idempotencyStore) release(key string) {
+	if key == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+// finish 任务结束后key从此时起再保留idempotencyTTL
+func (s *idempotencyStore) finish(key string) {
+	if key == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok {
+		e.active = false
+		e.expires = time.Now().Add(idempotencyTTL)
+	}
+}
+
+// 任务结果状态
+const (
+	ResultStatusCompleted = "completed"
+	ResultStatusTimedOut  = "timed_out"
+	// ResultStatusInterrupted 执行器关闭时任务被中断，结果中保留已有的对话
+	ResultStatusInterrupted = "interrupted"
+	// ResultStatusInconclusive 对话轮数耗尽模型仍未给出结论
+	ResultStatusInconclusive = "inconclusive"
+	// ResultStatusError 调用模型或code server等出错，任务没有完成
+	ResultStatusError = "error"
+)
+
+// resultSchemaVersion 结果记录的格式版本，字段含义或类型不兼容地变化时递增
+const resultSchemaVersion = 2
+
+// TaskResult 保存到结果文件中的一条任务结果
 type TaskResult struct {
-	ID        string                 `json:"id"`
-	Result    map[string]interface{} `json:"result"`
-	CreatedAt time.Time              `json:"created_at"`
+	// SchemaVersion 结果记录的格式版本，没有该字段的是旧格式记录
+	SchemaVersion int    `json:"schema_version"`
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	// Tag 模型最后给出的结论tag（tsj_have/tsj_nothave），对话轮数耗尽时为空
+	Tag            string `json:"tag,omitempty"`
+	HasProblemInfo bool   `json:"has_problem_info"`
+	// ProblemInfo 总是JSON对象，没有问题信息时为空对象
+	ProblemInfo map[string]interface{} `json:"problem_info"`
+	Response    interface{}            `json:"response,omitempty"`
+	Error       string                 `json:"error,omitempty"`
+	Labels      []string               `json:"labels,omitempty"`
+	LLMConfig   string                 `json:"llm_config"`
+	Model       string                 `json:"model"`
+	CodeServer  string                 `json:"code_server"`
+	WorkerID    int                    `json:"worker_id"`
+	SubmittedAt time.Time              `json:"submitted_at"`
+	StartedAt   time.Time              `json:"started_at"`
+	CompletedAt time.Time              `json:"completed_at"`
+	DurationMs  int64                  `json:"duration_ms"`
+	// ToolCacheHits 对话中重复的工具请求直接使用缓存结果的次数
+	ToolCacheHits int `json:"tool_cache_hits"`
+	// ProtocolRetries 模型回复不是合法JSON而要求重新回答的次数
+	ProtocolRetries int `json:"protocol_retries,omitempty"`
+	// Truncated 对话超过token上限，部分工具结果被截断后才发送给模型
+	Truncated         bool      `json:"truncated,omitempty"`
+	TruncatedMessages int       `json:"truncated_messages,omitempty"`
+	Conversation      []Message `json:"conversation,omitempty"`
+	// ConversationFile 对话单独保存时的文件路径（相对于结果目录）
+	ConversationFile string `json:"conversation_file,omitempty"`
+	// Input 任务的输入，用于重新执行任务，早期的记录没有该字段
+	Input *TaskInput `json:"input,omitempty"`
+	// FailedLLMConfigs 失败后改用fallback的LLM配置，按尝试顺序
+	FailedLLMConfigs []string `json:"failed_llm_configs,omitempty"`
+	// ModelsUsed 对话中各LLM配置和模型给出的回复数，按首次使用的顺序
+	ModelsUsed []ModelUsage `json:"models_used,omitempty"`
+}
+
+// TaskInput 随结果保存的任务输入
+type TaskInput struct {
+	SystemPrompt   string   `json:"system_prompt"`
+	UserPrompt     string   `json:"user_prompt"`
+	CodeServerName string   `json:"code_server_name"`
+	LLMConfigName  string   `json:"llm_config_name"`
+	Labels         []string `json:"labels,omitempty"`
+}
+
+// normalizeProblemInfo 将模型给出的problem_info统一为对象：字符串包装为{"message": ...}，
+// 数组、数字等其他值包装为{"value": ...}，没有时为空对象
+func normalizeProblemInfo(info interface{}) map[string]interface{} {
+	switch v := info.(type) {
+	case nil:
+		return map[string]interface{}{}
+	case map[string]interface{}:
+		if v == nil {
+			return map[string]interface{}{}
+		}
+		return v
+	case string:
+		return map[string]interface{}{"message": v}
+	default:
+		return map[string]interface{}{"value": v}
+	}
 }
 
 // 结果目录（相对于程序所在目录）
@@ -41,6 +382,35 @@ var resultDir = "results"
 // prompts目录（相对于程序所在目录）
 var promptDir = "prompts"
 
+// resultDirOverride、promptDirOverride 通过--results-dir/--prompts-dir或环境变量指定的目录（绝对路径），
+// 为空时使用程序所在目录下的默认目录
+var (
+	resultDirOverride string
+	promptDirOverride string
+)
+
+// setDataDir 解析命令行参数或环境变量指定的数据目录，优先级：命令行参数 > 环境变量。
+// 相对路径基于当前工作目录，目录已存在但不是目录时返回错误
+func setDataDir(target *string, flagValue, envName string) error {
+	dir := flagValue
+	if dir == "" {
+		dir = os.Getenv(envName)
+	}
+	if dir == "" {
+		return nil
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", dir, err)
+	}
+	if info, err := os.Stat(absDir); err == nil && !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", absDir)
+	}
+	*target = absDir
+	return nil
+}
+
 // 获取程序所在目录
 func getExecutableDir() string {
 	exePath, err := os.Executable()
@@ -52,56 +422,200 @@ func getExecutableDir() string {
 
 // 获取结果目录的完整路径
 func getResultDir() string {
+	if resultDirOverride != "" {
+		return resultDirOverride
+	}
 	return filepath.Join(getExecutableDir(), resultDir)
 }
 
 // 获取prompts目录的完整路径
 func getPromptDir() string {
+	if promptDirOverride != "" {
+		return promptDirOverride
+	}
 	return filepath.Join(getExecutableDir(), promptDir)
 }
 
-// getConfigHandler 获取当前配置的 HTTP 处理函数
-type CodeServer struct {
-	Name string `json:"name"`
-	URL  string `json:"url"`
+// llmConfigChain 返回name对应的LLM配置及其fallback链，调用方需持有配置数据的一致视图
+func llmConfigChain(c *types.Config, name string) ([]types.NamedLLMConfig, error) {
+	var chain []types.NamedLLMConfig
+	seen := make(map[string]bool)
+	for name != "" {
+		if seen[name] {
+			return nil, fmt.Errorf("fallback cycle at LLM config %q", name)
+		}
+		seen[name] = true
+
+		found := false
+		for _, config := range c.LLMConfigs {
+			if config.Name == name {
+				chain = append(chain, config)
+				name = config.Fallback
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("LLM config %q not found", name)
+		}
+	}
+	return chain, nil
+}
+
+// codeServerURL 在锁内查找code server的地址，没有该配置时返回空字符串
+func (ds *DataStore) codeServerURL(name string) string {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for _, cs := range ds.data.CodeServers {
+		if cs.Name == name {
+			return cs.URL
+		}
+	}
+	return ""
+}
+
+// llmConfigChain 在锁内复制name对应的LLM配置及其fallback链，之后重新加载配置不影响返回的副本
+func (ds *DataStore) llmConfigChain(name string) ([]types.NamedLLMConfig, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return llmConfigChain(&ds.data, name)
+}
+
+// llmLimiter 按LLM配置限流：令牌桶（容量为1，按固定间隔补充）限制请求速率，信号量限制并发数
+type llmLimiter struct {
+	config   types.RateLimit
+	interval time.Duration
+	sem      chan struct{}
+
+	mu sync.Mutex
+	// next 下一个令牌可用的时间
+	next time.Time
+}
+
+// newLLMLimiter 创建限流器，没有任何限制时返回nil
+func newLLMLimiter(config types.RateLimit) *llmLimiter {
+	if config.RequestsPerMinute <= 0 && config.MaxConcurrent <= 0 {
+		return nil
+	}
+	l := &llmLimiter{config: config}
+	if config.RequestsPerMinute > 0 {
+		l.interval = time.Minute / time.Duration(config.RequestsPerMinute)
+	}
+	if config.MaxConcurrent > 0 {
+		l.sem = make(chan struct{}, config.MaxConcurrent)
+	}
+	return l
+}
+
+// acquire 等待直到可以发出请求，返回请求结束时调用的release；nil限流器不限制
+func (l *llmLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	if l.interval > 0 {
+		l.mu.Lock()
+		now := time.Now()
+		if l.next.Before(now) {
+			l.next = now
+		}
+		wait := l.next.Sub(now)
+		l.next = l.next.Add(l.interval)
+		l.mu.Unlock()
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+
+	if l.sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return func() { <-l.sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
-type Config struct {
-	LLMConfigs  []NamedLLMConfig `json:"llm_configs"`
-	CodeServers []CodeServer     `json:"code_servers"`
+// matches 限流器是否按config创建，nil限流器对应没有限制的设置
+func (l *llmLimiter) matches(config types.RateLimit) bool {
+	if l == nil {
+		return newLLMLimiter(config) == nil
+	}
+	return l.config == config
 }
 
-// NamedLLMConfig 定义带名称的LLM配置结构
-type NamedLLMConfig struct {
-	Name    string `json:"name"`
-	APIKey  string `json:"api_key"`
-	BaseURL string `json:"base_url"`
-	Model   string `json:"model"`
+// llmLimiters 按LLM配置名称共享的限流器，所有工作协程调用同一配置时共用
+var (
+	llmLimitersMu sync.Mutex
+	llmLimiters   = make(map[string]*llmLimiter)
+)
+
+// limiterFor 返回LLM配置对应的限流器，限流设置修改后重新创建
+func limiterFor(config *types.NamedLLMConfig) *llmLimiter {
+	var rateLimit types.RateLimit
+	if config.RateLimit != nil {
+		rateLimit = *config.RateLimit
+	}
+
+	llmLimitersMu.Lock()
+	defer llmLimitersMu.Unlock()
+	if l, ok := llmLimiters[config.Name]; ok && l.matches(rateLimit) {
+		return l
+	}
+	l := newLLMLimiter(rateLimit)
+	llmLimiters[config.Name] = l
+	return l
 }
 
 // LLMConfigs 定义存储多个LLM配置的结构
 type LLMConfigs struct {
-	Configs []NamedLLMConfig `json:"configs"`
+	Configs []types.NamedLLMConfig `json:"configs"`
 }
 
-// Task 定义任务结构
-type Task struct {
-	ID             string `json:"id"`
-	SystemPrompt   string `json:"system_prompt"`
-	UserPrompt     string `json:"user_prompt"`
-	CodeServerName string `json:"code_server_name"`
-	LLMConfigName  string `json:"llm_config_name"`
-}
+// codeServerTimeout 访问code server的单次请求超时时间
+var codeServerTimeout = 60 * time.Second
+
+// codeServerRetries 访问code server出现连接错误时的重试次数
+var codeServerRetries = 2
 
 // CodeAnalyzer 代码分析器
 type CodeAnalyzer struct {
 	ServerIP   string
 	ServerPort int
 	ServerURL  string
+	HTTPClient *http.Client
+	Retries    int
+	// TaskID 触发请求的任务ID，作为X-Task-ID发给code server用于关联日志
+	TaskID string
 }
 
-// NewCodeAnalyzer 创建新的代码分析器
+// unixURLPrefix code server地址使用Unix domain socket时的前缀，如unix:///run/code_server.sock
+const unixURLPrefix = "unix://"
+
+// NewCodeAnalyzer 创建新的代码分析器，server为host:port或unix://socket路径
 func NewCodeAnalyzer(server string) *CodeAnalyzer {
+	if socketPath, ok := strings.CutPrefix(server, unixURLPrefix); ok {
+		if socketPath == "" {
+			return nil
+		}
+		// 请求URL中的主机名不起作用，所有连接都拨到socket上
+		dialer := &net.Dialer{}
+		return &CodeAnalyzer{
+			ServerURL: "http://unix",
+			HTTPClient: &http.Client{
+				Timeout: codeServerTimeout,
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						return dialer.DialContext(ctx, "unix", socketPath)
+					},
+				},
+			},
+			Retries: codeServerRetries,
+		}
+	}
+
 	parts := strings.Split(server, ":")
 	if len(parts) != 2 {
 		// 处理错误情况
@@ -120,148 +634,911 @@ func NewCodeAnalyzer(server string) *CodeAnalyzer {
 		ServerIP:   ip,
 		ServerPort: port,
 		ServerURL:  fmt.Sprintf("http://%s:%d", ip, port),
+		HTTPClient: &http.Client{
+			Timeout: codeServerTimeout,
+		},
+		Retries: codeServerRetries,
 	}
 }
 
-// GetSymbolInfo 获取符号信息
-func (ca *CodeAnalyzer) GetSymbolInfo(symbol string) (string, error) {
-	url := fmt.Sprintf("%s/api/get_symbol", ca.ServerURL)
-	data := map[string]string{"symbol": symbol}
-	json_data, _ := json.Marshal(data)
+// requestIDHeader 发往code server的请求追踪ID头，code server会在日志中记录并原样返回
+const requestIDHeader = "X-Request-ID"
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(json_data))
+// taskIDHeader 发往code server的任务ID头
+const taskIDHeader = "X-Task-ID"
+
+// newRequestID 生成随机的请求追踪ID
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// post 向code server发送JSON请求，连接错误时按Retries重试，重试沿用同一个请求追踪ID
+func (ca *CodeAnalyzer) post(ctx context.Context, path string, payload interface{}) (string, error) {
+	url := fmt.Sprintf("%s%s", ca.ServerURL, path)
+	json_data, err := json.Marshal(payload)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to marshal request: %v", err)
+	}
+	requestID := newRequestID()
+	log.Printf("[req=%s task=%s] POST %s", requestID, ca.TaskID, url)
+
+	var lastErr error
+	for attempt := 0; attempt <= ca.Retries; attempt++ {
+		if attempt > 0 {
+			log.Printf("[req=%s] code server %s 请求失败，尝试重试 (%d/%d): %v", requestID, url, attempt, ca.Retries, lastErr)
+			if err := sleepContext(ctx, time.Duration(attempt)*time.Second); err != nil {
+				return "", err
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(json_data))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(requestIDHeader, requestID)
+		if ca.TaskID != "" {
+			req.Header.Set(taskIDHeader, ca.TaskID)
+		}
+
+		resp, err := ca.HTTPClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to read response from code server %s (request %s): %v", url, requestID, err)
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			return string(body), nil
+		}
+		// 符号不存在、符号名不合法或查询命令失败时code server返回带error字段的JSON，
+		// 原样作为工具结果交给模型，由模型决定换一个符号重试
+		if msg, ok := errorEnvelope(body); ok {
+			log.Printf("[req=%s] code server %s returned status %d: %s", requestID, url, resp.StatusCode, msg)
+			return string(body), nil
+		}
+		return "", fmt.Errorf("code server %s returned status %d (request %s): %s", url, resp.StatusCode, requestID, strings.TrimSpace(string(body)))
 	}
-	defer resp.Body.Close()
+	return "", fmt.Errorf("code server %s unreachable after %d attempts (request %s): %w", url, ca.Retries+1, requestID, lastErr)
+}
 
-	body, _ := io.ReadAll(resp.Body)
-	return string(body), nil
+// errorEnvelope 判断响应是否为code server的错误JSON（包含非空的error字段），返回其中的错误信息
+func errorEnvelope(body []byte) (string, bool) {
+	var envelope struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.Error == "" {
+		return "", false
+	}
+	return envelope.Error, true
 }
 
-// FindAllRefs 查找所有引用
-func (ca *CodeAnalyzer) FindAllRefs(symbol string) (string, error) {
-	url := fmt.Sprintf("%s/api/find_refs", ca.ServerURL)
-	data := map[string]string{"symbol": symbol}
-	json_data, _ := json.Marshal(data)
+// GetSymbolInfo 获取符号信息
+func (ca *CodeAnalyzer) GetSymbolInfo(ctx context.Context, symbol string) (string, error) {
+	return ca.post(ctx, "/api/get_symbol", map[string]string{"symbol": symbol})
+}
+
+// GetSymbolsBatch 通过symbols_batch一次获取多个符号的信息，返回符号名到响应JSON的映射
+func (ca *CodeAnalyzer) GetSymbolsBatch(ctx context.Context, symbols []string) (map[string]string, error) {
+	body, err := ca.post(ctx, "/api/symbols_batch", map[string]interface{}{"symbols": symbols})
+	if err != nil {
+		return nil, err
+	}
+
+	var batch struct {
+		Results map[string]json.RawMessage `json:"results"`
+		Error   string                     `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(body), &batch); err != nil {
+		return nil, fmt.Errorf("failed to parse symbols_batch response: %v", err)
+	}
+	if batch.Results == nil {
+		return nil, fmt.Errorf("symbols_batch failed: %s", batch.Error)
+	}
+
+	results := make(map[string]string, len(batch.Results))
+	for symbol, raw := range batch.Results {
+		results[symbol] = string(raw)
+	}
+	return results, nil
+}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(json_data))
+// FindRefsBatch 通过find_refs_batch一次查找多个符号的引用，返回符号名到响应JSON的映射
+func (ca *CodeAnalyzer) FindRefsBatch(ctx context.Context, symbols []string) (map[string]string, error) {
+	body, err := ca.post(ctx, "/api/find_refs_batch", map[string]interface{}{"symbols": symbols})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(resp.Body)
+	var batch struct {
+		Results map[string]json.RawMessage `json:"results"`
+		Error   string                     `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(body), &batch); err != nil {
+		return nil, fmt.Errorf("failed to parse find_refs_batch response: %v", err)
+	}
+	if batch.Results == nil {
+		return nil, fmt.Errorf("find_refs_batch failed: %s", batch.Error)
+	}
+
+	results := make(map[string]string, len(batch.Results))
+	for symbol, raw := range batch.Results {
+		results[symbol] = string(raw)
+	}
+	return results, nil
+}
+
+// FindAllRefs 查找所有引用
+func (ca *CodeAnalyzer) FindAllRefs(ctx context.Context, symbol string) (string, error) {
+	return ca.post(ctx, "/api/find_refs", map[string]string{"symbol": symbol})
+}
+
+// strictProtocol 严格模式：模型回复在纠正次数用完后仍不符合JSON协议时直接判定任务失败
+var strictProtocol = false
+
+// protocolRetries 一次对话中模型回复不是合法JSON时最多纠正的次数，纠正不计入对话轮数
+var protocolRetries = 2
+
+// strictProtocolRetries 严格模式下未指定--protocol-retries时的纠正次数：去掉代码块标记并纠正一次后仍不合法即失败
+const strictProtocolRetries = 1
 
-	return string(body), nil
+// defaultProtocolRetries 返回未显式指定--protocol-retries时的纠正次数
+func defaultProtocolRetries(strict bool) int {
+	if strict {
+		return strictProtocolRetries
+	}
+	return protocolRetries
 }
 
 // LLMAnalyzer LLM分析器
 type LLMAnalyzer struct {
-	APIKey  string
-	BaseURL string
-	Model   string
+	// ConfigName 当前使用的LLM配置名，发生fallback后为实际给出结果的配置
+	ConfigName     string
+	APIKey         string
+	BaseURL        string
+	Model          string
+	StrictProtocol bool
+	// ProtocolRetries 回复不是合法JSON时最多纠正的次数
+	ProtocolRetries int
+	// ContextTokens 发送给模型的对话估算token上限，0表示不限制
+	ContextTokens int
+	// Limiter 该LLM配置的限流器，nil表示不限制
+	Limiter *llmLimiter
+	// ExtraParams 覆盖默认请求参数的额外参数
+	ExtraParams map[string]interface{}
+	// Provider LLM服务类型，见types.LLMProviderOpenAI、types.LLMProviderLocal
+	Provider string
+	// Fallbacks 当前配置认证失败或服务不可用时依次改用的LLM配置
+	Fallbacks []types.NamedLLMConfig
+	// FailedConfigs 因失败被跳过的LLM配置名
+	FailedConfigs []string
 }
 
 // NewLLMAnalyzer 创建新的LLM分析器
-func NewLLMAnalyzer(config *NamedLLMConfig) *LLMAnalyzer {
-	return &LLMAnalyzer{
-		APIKey:  config.APIKey,
-		BaseURL: config.BaseURL,
-		Model:   config.Model,
+func NewLLMAnalyzer(config *types.NamedLLMConfig) *LLMAnalyzer {
+	la := &LLMAnalyzer{
+		StrictProtocol:  strictProtocol,
+		ProtocolRetries: protocolRetries,
 	}
+	la.useConfig(config)
+	return la
 }
 
-// Message 消息结构
-type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+// useConfig 切换到指定的LLM配置
+func (la *LLMAnalyzer) useConfig(config *types.NamedLLMConfig) {
+	la.ConfigName = config.Name
+	// 加载配置时已确认引用的环境变量都存在
+	la.APIKey, _ = expandEnv(config.APIKey)
+	la.BaseURL, _ = expandEnv(config.BaseURL)
+	la.Model = config.Model
+	la.ContextTokens = contextTokens
+	if config.ContextTokens > 0 {
+		la.ContextTokens = config.ContextTokens
+	}
+	la.Limiter = limiterFor(config)
+	la.ExtraParams = config.ExtraParams
+	la.Provider = config.Provider
 }
 
-// QueryOpenAI 调用OpenAI API进行查询
-func (la *LLMAnalyzer) QueryOpenAI(messages []Message) (string, error) {
-	// 添加重试机制
-	maxRetries := 3
-	retryDelay := 2 * time.Second
+// llmStatusError 模型API返回的非2xx状态
+type llmStatusError struct {
+	StatusCode int
+	Message    string
+}
 
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		url := fmt.Sprintf("%s/chat/completions", la.BaseURL)
-		data := map[string]interface{}{
-			"model":             la.Model,
-			"messages":          messages,
-			"temperature":       0.1,
-			"max_tokens":        2000,
-			"top_p":             0.95,
-			"frequency_penalty": 0,
-			"presence_penalty":  0,
-			"response_format":   map[string]string{"type": "json_object"},
-		}
-		json_data, _ := json.Marshal(data)
-
-		req, _ := http.NewRequest("POST", url, bytes.NewBuffer(json_data))
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+la.APIKey)
+func (e *llmStatusError) Error() string {
+	return fmt.Sprintf("API返回错误状态 %d: %s", e.StatusCode, e.Message)
+}
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			if attempt < maxRetries-1 {
-				log.Printf("API调用失败，尝试重试 (%d/%d): %v", attempt+1, maxRetries, err)
-				time.Sleep(retryDelay * time.Duration(2^attempt)) // 指数退避
-				continue
-			} else {
-				return "", err
-			}
+// shouldFallback 判断调用模型的错误是否应改用fallback配置：认证失败、模型不存在、
+// 重试后仍限流或服务端错误、无法连接。请求本身有误或任务被取消时不切换
+func shouldFallback(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var statusErr *llmStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			return true
 		}
-		defer resp.Body.Close()
-
-		body, _ := io.ReadAll(resp.Body)
-		var result map[string]interface{}
-		json.Unmarshal(body, &result)
+		return retryableStatus(statusErr.StatusCode)
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
 
-		if choices, ok := result["choices"].([]interface{}); ok && len(choices) > 0 {
-			if choice, ok := choices[0].(map[string]interface{}); ok {
-				if message, ok := choice["message"].(map[string]interface{}); ok {
-					if content, ok := message["content"].(string); ok {
-						return content, nil
-					}
-				}
-			}
+// query 调用当前LLM配置，认证失败或服务不可用时依次改用fallback配置重新发送同一对话
+func (la *LLMAnalyzer) query(ctx context.Context, messages []Message) (string, error) {
+	for {
+		content, err := la.QueryOpenAI(ctx, messages)
+		if err == nil || len(la.Fallbacks) == 0 || ctx.Err() != nil || !shouldFallback(err) {
+			return content, err
 		}
-		return "", fmt.Errorf("无法解析API响应，响应体: %s", body)
+		next := la.Fallbacks[0]
+		la.Fallbacks = la.Fallbacks[1:]
+		log.Printf("LLM config %s failed (%v), falling back to %s", la.ConfigName, err, next.Name)
+		la.FailedConfigs = append(la.FailedConfigs, la.ConfigName)
+		la.useConfig(&next)
 	}
-	return "", fmt.Errorf("API调用失败")
 }
 
-// AnalyzeTask 分析任务
-func (la *LLMAnalyzer) AnalyzeTask(codeAnalyzer *CodeAnalyzer, problemPrompt map[string]string) (map[string]interface{}, error) {
-	messages := []Message{
-		{Role: "system", Content: problemPrompt["system"] + "\n请使用工具调用获取代码信息并分析问题。"},
-		{Role: "user", Content: problemPrompt["init_user"] + `\n\n【代码分析功能说明】\n你可以使用get_symbol功能获取符号定义信息，可以使用find_refs获取函数引用信息以便于向上追踪函数调用栈。\n\n【强制输出结果要求】\n必须在回答中tag字段，值为[tsj_have][tsj_nothave][tsj_next]:\n- 如判断有代码问题: [tsj_have] 并提供 {\"problem_type\": \"问题类型\", \"context\": \"代码上下文\"}\n- 如判断无代码问题: [tsj_nothave]\n- 如果不能判断，需要获取信息进一步分析，请包含[tsj_next]，并包含get_symbol或者find_refs请求获取更多代码信息,详细格式如下：\n1. 如果需要知道某个函数，宏或者变量的定义，使用get_symbol获取符号信息: {\"command\": \"get_symbol\", \"sym_name\": \"符号名称\"}\n2. 如果需要进一步分析数据流，使用find_refs获取调用信息: {\"command\": \"find_refs\", \"sym_name\": \"符号名称\"}\n\n【输出要求】\n【JSON格式返回要求】\n请以JSON格式返回你的回答，例如：\n{\"tag\": \"tsj_have\", \"problem_info\": {\"problem_type\": \"问题类型\", \"context\": \"代码上下文\"}, \"response\": \"你的分析和解释\"}\n或\n{\"tag\": \"tsj_nothave\", \"response\": \"你的分析和解释\"}\n或\n{\"tag\": \"tsj_next\", \"requests\": [{\"command\": \"get_symbol\", \"sym_name\": \"符号名称\"}], \"response\": \"你的分析和解释\"}\n或\n{\"tag\": \"tsj_next\", \"requests\": [{\"command\": \"find_refs\", \"sym_name\": \"符号名称\"}], \"response\": \"你的分析和解释\"}\n或\n{\"tag\": \"tsj_next\", \"requests\": [{\"command\": \"get_symbol\", \"sym_name\": \"符号名称\"},{\"command\": \"find_refs\", \"sym_name\": \"符号名称\"},{\"command\": \"find_refs\", \"sym_name\": \"符号名称\"}], \"response\": \"你的分析和解释\"}`},
-	}
+// errProtocolViolation 模型未按约定的JSON协议回复
+var errProtocolViolation = fmt.Errorf("model did not follow protocol")
 
-	conversationComplete := false
-	maxTurns := 5
-	turn := 0
+// protocolNudge 模型回复无法解析时用于纠正的提示
+const protocolNudge = "你上一次的回答不是合法的JSON，或缺少tag字段。请严格按照要求的JSON格式重新回答。"
 
-	result := map[string]interface{}{
-		"has_problem_info": false,
-		"problem_info":     nil,
-		"conversation":     []Message{},
+// stripCodeFence 去掉模型回复外层的markdown代码块标记
+func stripCodeFence(content string) string {
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, "```") {
+		return content
+	}
+	content = strings.TrimPrefix(content, "```")
+	// 去掉语言标识，例如```json
+	if idx := strings.Index(content, "\n"); idx >= 0 {
+		content = content[idx+1:]
 	}
+	content = strings.TrimSuffix(strings.TrimSpace(content), "```")
+	return strings.TrimSpace(content)
+}
 
-	for !conversationComplete && turn < maxTurns {
-		// 调用OpenAI API获取响应
-		llmResponse, err := la.QueryOpenAI(messages)
-		if err != nil {
-			return nil, err
-		}
+// parseLLMMessage 解析模型回复，要求为带tag字段的JSON对象
+func parseLLMMessage(content string) (map[string]interface{}, error) {
+	var message map[string]interface{}
+	if err := json.Unmarshal([]byte(stripCodeFence(content)), &message); err != nil {
+		return nil, err
+	}
+	if _, ok := message["tag"].(string); !ok {
+		return nil, fmt.Errorf("missing tag field")
+	}
+	return message, nil
+}
 
-		// 处理普通响应
-		messages = append(messages, Message{Role: "assistant", Content: llmResponse})
+// Message 消息结构
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// LLMConfig和Model 给出该条回复的LLM配置和模型，只记录在assistant消息上，不发送给模型
+	LLMConfig string `json:"llm_config,omitempty"`
+	Model     string `json:"model,omitempty"`
+}
+
+// chatMessage 发送给chat/completions接口的消息
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// ModelUsage 任务中某个LLM配置和模型给出的回复数
+type ModelUsage struct {
+	LLMConfig string `json:"llm_config"`
+	Model     string `json:"model"`
+	Turns     int    `json:"turns"`
+}
+
+// summarizeModels 按首次使用的顺序统计对话中各模型给出的回复数
+func summarizeModels(messages []Message) []ModelUsage {
+	var usage []ModelUsage
+	index := make(map[ModelUsage]int)
+	for _, m := range messages {
+		if m.Role != "assistant" || m.Model == "" {
+			continue
+		}
+		key := ModelUsage{LLMConfig: m.LLMConfig, Model: m.Model}
+		i, ok := index[key]
+		if !ok {
+			i = len(usage)
+			index[key] = i
+			usage = append(usage, key)
+		}
+		usage[i].Turns++
+	}
+	return usage
+}
+
+// maxErrorBodyLen 错误信息中保留的响应体最大长度
+const maxErrorBodyLen = 512
+
+// truncateBody 截断过长的响应体，避免错误信息过大
+func truncateBody(body []byte) string {
+	if len(body) > maxErrorBodyLen {
+		return string(body[:maxErrorBodyLen]) + "...(truncated)"
+	}
+	return string(body)
+}
+
+// providerErrorMessage 从服务商的错误响应中提取错误信息，无法解析时返回截断后的响应体
+func providerErrorMessage(body []byte) string {
+	var payload struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil && len(payload.Error) > 0 {
+		var errObj struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(payload.Error, &errObj); err == nil && errObj.Message != "" {
+			return errObj.Message
+		}
+		var errStr string
+		if err := json.Unmarshal(payload.Error, &errStr); err == nil && errStr != "" {
+			return errStr
+		}
+	}
+	return truncateBody(body)
+}
+
+// retryableStatus 判断HTTP状态码是否可以重试（限流和服务端错误）
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// retryAfterDelay 解析Retry-After响应头（秒数或HTTP日期），无法解析时使用默认退避时间
+func retryAfterDelay(header string, fallback time.Duration) time.Duration {
+	if header == "" {
+		return fallback
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(header)); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return fallback
+}
+
+// llmDebugLogger 记录LLM原始HTTP请求和响应的调试日志，为nil时不记录
+var llmDebugLogger *log.Logger
+
+// maxDebugBodyLen 调试日志中单个请求或响应体的最大长度
+const maxDebugBodyLen = 64 * 1024
+
+// redactSecret 将文本中出现的密钥替换为占位符
+func redactSecret(text, secret string) string {
+	if secret == "" {
+		return text
+	}
+	return strings.ReplaceAll(text, secret, "[REDACTED]")
+}
+
+// logLLMDebug 记录一条LLM调试日志，内容中的API key会被脱敏并截断
+func (la *LLMAnalyzer) logLLMDebug(direction string, detail string, body []byte) {
+	if llmDebugLogger == nil {
+		return
+	}
+	// 先脱敏再截断，避免截断点落在API key中间时留下未脱敏的前缀
+	text := redactSecret(string(body), la.APIKey)
+	if len(text) > maxDebugBodyLen {
+		text = fmt.Sprintf("%s...(truncated, %d bytes total)", text[:maxDebugBodyLen], len(body))
+	}
+	llmDebugLogger.Printf("%s model=%s %s\n%s", direction, la.Model, redactSecret(detail, la.APIKey), text)
+}
+
+// sleepContext 等待指定时间，上下文取消或超时时提前返回
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// QueryOpenAI 调用OpenAI API进行查询
+func (la *LLMAnalyzer) QueryOpenAI(ctx context.Context, messages []Message) (string, error) {
+	// 添加重试机制
+	maxRetries := 3
+	retryDelay := 2 * time.Second
+	var lastErr error
+	client := &http.Client{}
+
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		backoff := retryDelay * time.Duration(1<<attempt) // 指数退避
+		url := fmt.Sprintf("%s/chat/completions", la.BaseURL)
+		json_data, _ := json.Marshal(la.requestBody(messages))
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(json_data))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		// 本地模型服务通常不需要认证，没有配置api_key时不发送Authorization
+		auth := "none"
+		if la.APIKey != "" {
+			req.Header.Set("Authorization", "Bearer "+la.APIKey)
+			auth = "Bearer [REDACTED]"
+		}
+		la.logLLMDebug(">>> request", fmt.Sprintf("POST %s Authorization: %s attempt=%d", url, auth, attempt+1), json_data)
+
+		// 按LLM配置限流，每次尝试（包括重试）都要等待放行
+		release, err := la.Limiter.acquire(ctx)
+		if err != nil {
+			return "", err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			release()
+			lastErr = err
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			if attempt < maxRetries-1 {
+				log.Printf("API调用失败，尝试重试 (%d/%d): %v", attempt+1, maxRetries, err)
+				if err := sleepContext(ctx, backoff); err != nil {
+					return "", err
+				}
+				continue
+			} else {
+				return "", err
+			}
+		}
+
+		// 每轮读取后立即关闭响应体，避免在循环中defer导致重试期间连接和文件描述符堆积
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		release()
+		la.logLLMDebug("<<< response", fmt.Sprintf("status=%d", resp.StatusCode), body)
+		if err != nil {
+			lastErr = fmt.Errorf("读取API响应失败: %v", err)
+			if attempt < maxRetries-1 {
+				log.Printf("%v，尝试重试 (%d/%d)", lastErr, attempt+1, maxRetries)
+				if err := sleepContext(ctx, backoff); err != nil {
+					return "", err
+				}
+				continue
+			}
+			return "", lastErr
+		}
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			lastErr = &llmStatusError{StatusCode: resp.StatusCode, Message: providerErrorMessage(body)}
+			// 限流和服务端错误可以重试，认证等其他4xx错误直接失败
+			if retryableStatus(resp.StatusCode) && attempt < maxRetries-1 {
+				delay := retryAfterDelay(resp.Header.Get("Retry-After"), backoff)
+				log.Printf("%v，%v后重试 (%d/%d)", lastErr, delay, attempt+1, maxRetries)
+				if err := sleepContext(ctx, delay); err != nil {
+					return "", err
+				}
+				continue
+			}
+			return "", lastErr
+		}
+
+		var result map[string]interface{}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return "", fmt.Errorf("无法解析API响应: %v，响应体: %s", err, truncateBody(body))
+		}
+
+		if choices, ok := result["choices"].([]interface{}); ok && len(choices) > 0 {
+			if choice, ok := choices[0].(map[string]interface{}); ok {
+				if message, ok := choice["message"].(map[string]interface{}); ok {
+					if content, ok := message["content"].(string); ok {
+						return content, nil
+					}
+				}
+			}
+		}
+		if _, hasError := result["error"]; hasError {
+			return "", fmt.Errorf("API返回错误: %s", providerErrorMessage(body))
+		}
+		return "", fmt.Errorf("无法解析API响应，响应体: %s", truncateBody(body))
+	}
+	if lastErr != nil {
+		return "", fmt.Errorf("API调用失败: %w", lastErr)
+	}
+	return "", fmt.Errorf("API调用失败")
+}
+
+// reservedParams 由执行器决定、不能被extra_params覆盖的请求参数
+var reservedParams = map[string]bool{"model": true, "messages": true}
+
+// localUnsupportedParams 本地模型服务（Ollama、llama.cpp）忽略或拒绝的默认参数，provider为local时不发送
+var localUnsupportedParams = []string{"response_format", "frequency_penalty", "presence_penalty"}
+
+// requestBody 构造chat/completions请求体：默认参数 < LLM配置的extra_params，model和messages总是由执行器设置
+func (la *LLMAnalyzer) requestBody(messages []Message) map[string]interface{} {
+	data := map[string]interface{}{
+		"temperature":       0.1,
+		"max_tokens":        2000,
+		"top_p":             0.95,
+		"frequency_penalty": 0,
+		"presence_penalty":  0,
+		"response_format":   map[string]string{"type": "json_object"},
+	}
+	// extra_params仍然可以显式加回这些参数
+	if la.Provider == types.LLMProviderLocal {
+		for _, key := range localUnsupportedParams {
+			delete(data, key)
+		}
+	}
+	for key, value := range la.ExtraParams {
+		if reservedParams[key] {
+			continue
+		}
+		// 值为null表示不发送该参数，例如不支持response_format的模型
+		if value == nil {
+			delete(data, key)
+			continue
+		}
+		data[key] = value
+	}
+	data["model"] = la.Model
+	chat := make([]chatMessage, len(messages))
+	for i, m := range messages {
+		chat[i] = chatMessage{Role: m.Role, Content: m.Content}
+	}
+	data["messages"] = chat
+	return data
+}
+
+// toolCallConcurrency 单轮对话中并发执行工具请求的最大数量
+var toolCallConcurrency = 4
 
-		var message map[string]interface{}
-		json.Unmarshal([]byte(llmResponse), &message)
+// toolCall 模型在tsj_next中请求的一次工具调用
+type toolCall struct {
+	Command string
+	SymName string
+}
+
+// parseToolCalls 从模型的requests字段中解析出支持的工具调用，忽略格式不正确的请求
+func parseToolCalls(requests []any) []toolCall {
+	var calls []toolCall
+	for _, req := range requests {
+		request, ok := req.(map[string]any)
+		if !ok {
+			continue
+		}
+		command, _ := request["command"].(string)
+		symName, ok := request["sym_name"].(string)
+		if !ok || (command != "get_symbol" && command != "find_refs") {
+			continue
+		}
+		calls = append(calls, toolCall{Command: command, SymName: symName})
+	}
+	return calls
+}
+
+// requestedSymbols 返回工具调用中get_symbol的符号名（去重，保持顺序）
+func requestedSymbols(calls []toolCall) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, call := range calls {
+		if call.Command == "get_symbol" && !seen[call.SymName] {
+			seen[call.SymName] = true
+			names = append(names, call.SymName)
+		}
+	}
+	return names
+}
+
+// toolCacheNote 模型重复请求已提供过的工具结果时，附加在缓存内容前的提示
+const toolCacheNote = "（注意：该结果在本次对话中已经提供过，以下为相同内容）\n"
+
+// toolCacheHitsTotal 所有对话中命中工具结果缓存的累计次数
+var toolCacheHitsTotal atomic.Int64
+
+// runToolCalls 并发执行一轮中的全部工具调用（最多toolCallConcurrency个同时进行），
+// 返回的消息与calls顺序一致，保证对话内容可复现；任一调用失败时返回第一个错误。
+// cache保存本次对话中已获取的工具结果，重复的请求直接复用缓存内容，返回值hits为命中次数
+func runToolCalls(ctx context.Context, codeAnalyzer *CodeAnalyzer, calls []toolCall, cache map[toolCall]string) (messages []Message, hits int, err error) {
+	// 本轮中需要实际请求的调用（去掉已缓存和本轮重复的）
+	var pending []toolCall
+	seen := make(map[toolCall]bool)
+	for _, call := range calls {
+		if _, ok := cache[call]; ok || seen[call] {
+			continue
+		}
+		seen[call] = true
+		pending = append(pending, call)
+	}
+
+	// 同一轮请求多个符号时通过symbols_batch一次获取，失败时逐个请求
+	symbolResults := map[string]string{}
+	if names := requestedSymbols(pending); len(names) > 1 {
+		batch, err := codeAnalyzer.GetSymbolsBatch(ctx, names)
+		if err != nil {
+			log.Printf("symbols_batch failed, falling back to get_symbol: %v", err)
+		} else {
+			symbolResults = batch
+		}
+	}
+
+	contents := make([]string, len(pending))
+	errs := make([]error, len(pending))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, toolCallConcurrency)
+
+	for i, call := range pending {
+		if call.Command == "get_symbol" {
+			if info, ok := symbolResults[call.SymName]; ok {
+				contents[i] = info
+				continue
+			}
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, call toolCall) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			switch call.Command {
+			case "get_symbol":
+				contents[i], errs[i] = codeAnalyzer.GetSymbolInfo(ctx, call.SymName)
+			case "find_refs":
+				contents[i], errs[i] = codeAnalyzer.FindAllRefs(ctx, call.SymName)
+			}
+		}(i, call)
+	}
+	wg.Wait()
+
+	fetched := make(map[toolCall]string, len(pending))
+	for i, call := range pending {
+		if errs[i] != nil {
+			return nil, 0, errs[i]
+		}
+		fetched[call] = contents[i]
+	}
+
+	messages = make([]Message, 0, len(calls))
+	for _, call := range calls {
+		content, ok := fetched[call]
+		if ok {
+			// 同一轮内的重复请求只在第一次出现时视为新结果
+			delete(fetched, call)
+			cache[call] = content
+		} else {
+			content = toolCacheNote + cache[call]
+			hits++
+		}
+		messages = append(messages, Message{Role: "user", Content: content})
+	}
+	if hits > 0 {
+		toolCacheHitsTotal.Add(int64(hits))
+		log.Printf("[task=%s] reused %d cached tool result(s)", codeAnalyzer.TaskID, hits)
+	}
+	return messages, hits, nil
+}
+
+// contextTokens 默认的对话token上限（估算值），0表示不限制
+var contextTokens = 64000
+
+// minKeptToolTokens 截断工具结果时至少保留的token数
+const minKeptToolTokens = 256
+
+// messageOverheadTokens 每条消息的角色、分隔符等额外开销
+const messageOverheadTokens = 4
+
+// estimateTokens 粗略估算文本的token数：ASCII字符约4个一个token，其余字符（如中文）按每字一个token计
+func estimateTokens(text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < 0x80 {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// estimateConversationTokens 估算整个对话的token数
+func estimateConversationTokens(messages []Message) int {
+	total := 0
+	for _, m := range messages {
+		total += estimateTokens(m.Content) + messageOverheadTokens
+	}
+	return total
+}
+
+// truncateToTokens 截取文本开头估算不超过maxTokens的部分，保证不截断多字节字符
+func truncateToTokens(text string, maxTokens int) string {
+	ascii, other := 0, 0
+	for i, r := range text {
+		if r < 0x80 {
+			ascii++
+		} else {
+			other++
+		}
+		if (ascii+3)/4+other > maxTokens {
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// trimConversation 对话估算token超过budget时截断工具结果：每次选择最大的一条（相同时选较早的），
+// 截掉超出部分但至少保留minKeptToolTokens。系统提示、初始问题和模型回复不会被截断，
+// truncated记录已截断过的消息下标，同一条消息只截断一次。返回本次被截断的消息数以及截断后的估算token数
+func trimConversation(messages []Message, budget int, truncated map[int]bool) (trimmed int, total int) {
+	total = estimateConversationTokens(messages)
+	if budget <= 0 {
+		return 0, total
+	}
+
+	for total > budget {
+		largest, largestTokens := -1, 0
+		for i := 2; i < len(messages); i++ {
+			if messages[i].Role != "user" || truncated[i] {
+				continue
+			}
+			if tokens := estimateTokens(messages[i].Content); tokens > minKeptToolTokens && tokens > largestTokens {
+				largest, largestTokens = i, tokens
+			}
+		}
+		if largest < 0 {
+			// 已没有可截断的内容
+			break
+		}
+
+		keep := largestTokens - (total - budget)
+		if keep < minKeptToolTokens {
+			keep = minKeptToolTokens
+		}
+		content := messages[largest].Content
+		head := truncateToTokens(content, keep)
+		messages[largest].Content = head + fmt.Sprintf("\n...[内容过长已截断，省略%d个字符]", len(content)-len(head))
+		truncated[largest] = true
+		trimmed++
+		total = estimateConversationTokens(messages)
+	}
+	return trimmed, total
+}
+
+// protocolFile 工具调用协议说明所在的模板文件（相对于prompts目录），可通过--protocol-file指定其他路径
+const protocolFile = "_protocol.txt"
+
+// protocolKeywords 协议说明中必须出现的tag和命令名，解析模型回复时依赖这些名称
+var protocolKeywords = []string{"tsj_have", "tsj_nothave", "tsj_next", "get_symbol", "find_refs"}
+
+// defaultProtocolPrompt 未找到协议模板文件时使用的内置协议说明
+const defaultProtocolPrompt = `【代码分析功能说明】
+你可以使用get_symbol功能获取符号定义信息，可以使用find_refs获取函数引用信息以便于向上追踪函数调用栈。
+
+【强制输出结果要求】
+必须在回答中tag字段，值为[tsj_have][tsj_nothave][tsj_next]:
+- 如判断有代码问题: [tsj_have] 并提供 {"problem_type": "问题类型", "context": "代码上下文"}
+- 如判断无代码问题: [tsj_nothave]
+- 如果不能判断，需要获取信息进一步分析，请包含[tsj_next]，并包含get_symbol或者find_refs请求获取更多代码信息,详细格式如下：
+1. 如果需要知道某个函数，宏或者变量的定义，使用get_symbol获取符号信息: {"command": "get_symbol", "sym_name": "符号名称"}
+2. 如果需要进一步分析数据流，使用find_refs获取调用信息: {"command": "find_refs", "sym_name": "符号名称"}
+
+【输出要求】
+【JSON格式返回要求】
+请以JSON格式返回你的回答，例如：
+{"tag": "tsj_have", "problem_info": {"problem_type": "问题类型", "context": "代码上下文"}, "response": "你的分析和解释"}
+或
+{"tag": "tsj_nothave", "response": "你的分析和解释"}
+或
+{"tag": "tsj_next", "requests": [{"command": "get_symbol", "sym_name": "符号名称"}], "response": "你的分析和解释"}
+或
+{"tag": "tsj_next", "requests": [{"command": "find_refs", "sym_name": "符号名称"}], "response": "你的分析和解释"}
+或
+{"tag": "tsj_next", "requests": [{"command": "get_symbol", "sym_name": "符号名称"},{"command": "find_refs", "sym_name": "符号名称"},{"command": "find_refs", "sym_name": "符号名称"}], "response": "你的分析和解释"}`
+
+// protocolPrompt 附加在初始问题之后的协议说明，启动时由loadProtocolPrompt加载
+var protocolPrompt = defaultProtocolPrompt
+
+// loadProtocolPrompt 从模板文件加载协议说明。path为空时使用prompts目录下的_protocol.txt，
+// 该文件不存在时使用内置协议说明；模板中缺少protocolKeywords中的名称时返回错误
+func loadProtocolPrompt(path string) error {
+	explicit := path != ""
+	if !explicit {
+		path = filepath.Join(getPromptDir(), protocolFile)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			log.Printf("Protocol template %s not found, using built-in protocol", path)
+			protocolPrompt = defaultProtocolPrompt
+			return nil
+		}
+		return fmt.Errorf("failed to read protocol template: %v", err)
+	}
+
+	text := strings.TrimSpace(string(data))
+	for _, keyword := range protocolKeywords {
+		if !strings.Contains(text, keyword) {
+			return fmt.Errorf("protocol template %s does not mention %s", path, keyword)
+		}
+	}
+	protocolPrompt = text
+	log.Printf("Loaded protocol template from %s", path)
+	return nil
+}
+
+// AnalyzeTask 分析任务，出错时返回的结果中包含出错前的对话
+func (la *LLMAnalyzer) AnalyzeTask(ctx context.Context, codeAnalyzer *CodeAnalyzer, problemPrompt map[string]string) (*TaskResult, error) {
+	messages := []Message{
+		{Role: "system", Content: problemPrompt["system"] + "\n请使用工具调用获取代码信息并分析问题。"},
+		{Role: "user", Content: problemPrompt["init_user"] + "\n\n" + protocolPrompt},
+	}
+
+	conversationComplete := false
+	maxTurns := 5
+	turn := 0
+	corrections := 0
+
+	result := &TaskResult{Status: ResultStatusCompleted}
+	// fail 出错时连同已有的对话一起返回，便于保存超时或被中断任务的部分结果
+	fail := func(err error) (*TaskResult, error) {
+		result.Conversation = messages
+		return result, err
+	}
+	toolCache := make(map[toolCall]string)
+	truncated := make(map[int]bool)
+
+	for !conversationComplete && turn < maxTurns {
+		// 发送前保证对话不超过模型上下文
+		if trimmed, total := trimConversation(messages, la.ContextTokens, truncated); trimmed > 0 {
+			log.Printf("[task=%s] conversation exceeded %d tokens, truncated %d tool result(s), now ~%d tokens", codeAnalyzer.TaskID, la.ContextTokens, trimmed, total)
+			result.Truncated = true
+			result.TruncatedMessages += trimmed
+		}
+
+		// 调用OpenAI API获取响应，失败时按配置改用fallback模型
+		llmResponse, err := la.query(ctx, messages)
+		if err != nil {
+			return fail(err)
+		}
+
+		// 处理普通响应，记录实际给出回复的配置和模型（fallback后可能与任务指定的不同）
+		messages = append(messages, Message{Role: "assistant", Content: llmResponse, LLMConfig: la.ConfigName, Model: la.Model})
+
+		message, parseErr := parseLLMMessage(llmResponse)
+		if parseErr != nil {
+			// 要求模型按格式重新回答，不计入对话轮数；纠正次数有上限，避免死循环
+			if corrections < la.ProtocolRetries {
+				corrections++
+				result.ProtocolRetries = corrections
+				log.Printf("[task=%s] invalid model response (%v), asking to resend (%d/%d)", codeAnalyzer.TaskID, parseErr, corrections, la.ProtocolRetries)
+				messages = append(messages, Message{Role: "user", Content: protocolNudge})
+				continue
+			}
+			if la.StrictProtocol {
+				return fail(fmt.Errorf("%w: %v", errProtocolViolation, parseErr))
+			}
+			// 纠正次数用完后本轮作废
+		}
 		fmt.Printf("LLM Response: %+v\n", message)
 
 		// 检查是否包含问题信息,通过tag判断，如果是tsj_have或者tsj_nothave就结束对话并将结果保存
@@ -269,36 +1546,19 @@ func (la *LLMAnalyzer) AnalyzeTask(codeAnalyzer *CodeAnalyzer, problemPrompt map
 			switch tag {
 			case "tsj_have", "tsj_nothave":
 				conversationComplete = true
-				result["has_problem_info"] = (tag == "tsj_have")
-				result["problem_info"] = message["problem_info"]
-				result["response"] = message["response"]
+				result.Tag = tag
+				result.HasProblemInfo = (tag == "tsj_have")
+				result.ProblemInfo = normalizeProblemInfo(message["problem_info"])
+				result.Response = message["response"]
 			case "tsj_next":
-				// 处理tsj_next标签，添加请求到消息列表
+				// 处理tsj_next标签，并发执行本轮全部工具请求，按请求顺序添加到消息列表
 				if requests, ok := message["requests"].([]any); ok {
-					for _, req := range requests {
-						if request, ok := req.(map[string]any); ok {
-							if command, ok := request["command"].(string); ok {
-								if symName, ok := request["sym_name"].(string); ok {
-									switch command {
-									case "get_symbol":
-										info, err := codeAnalyzer.GetSymbolInfo(symName)
-										if err != nil {
-											//todo
-											return nil, err
-										}
-										messages = append(messages, Message{Role: "user", Content: info})
-									case "find_refs":
-										refs, err := codeAnalyzer.FindAllRefs(symName)
-										if err != nil {
-											//todo
-											return nil, err
-										}
-										messages = append(messages, Message{Role: "user", Content: refs})
-									}
-								}
-							}
-						}
+					toolMessages, hits, err := runToolCalls(ctx, codeAnalyzer, parseToolCalls(requests), toolCache)
+					if err != nil {
+						return fail(err)
 					}
+					result.ToolCacheHits += hits
+					messages = append(messages, toolMessages...)
 				}
 			}
 		}
@@ -306,31 +1566,88 @@ func (la *LLMAnalyzer) AnalyzeTask(codeAnalyzer *CodeAnalyzer, problemPrompt map
 	}
 
 	if turn == maxTurns && !conversationComplete {
-		result["has_problem_info"] = true
-		result["problem_info"] = "对话轮数耗尽仍没有问答，建议重点审视。"
+		// 与真正的结论区分开，不计入发现问题，只在problem_info中保留提示信息供人工审视
+		result.Status = ResultStatusInconclusive
+		result.HasProblemInfo = false
+		result.ProblemInfo = normalizeProblemInfo("对话轮数耗尽仍没有问答，建议重点审视。")
 	}
 
-	result["conversation"] = messages
+	result.Conversation = messages
 	return result, nil
 }
 
+// taskTimeout 单个任务的最长执行时间
+var taskTimeout = 5 * time.Minute
+
 // TaskQueue 任务队列
-var TaskQueue = make(chan Task, 2000)
+var TaskQueue = make(chan types.Task, 2000)
 
 // generateTaskID 生成任务ID
 func generateTaskID() string {
 	return fmt.Sprintf("task_%d", time.Now().Unix())
 }
 
-// saveTaskResult 保存任务结果
-func saveTaskResult(taskID string, result map[string]interface{}) error {
+// resultLocks 按任务ID分段的结果文件写锁，同一ID的读-追加-写过程串行执行
+var resultLocks [64]sync.Mutex
+
+// resultLock 返回任务ID对应的结果文件写锁
+func resultLock(taskID string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(taskID))
+	return &resultLocks[h.Sum32()%uint32(len(resultLocks))]
+}
+
+// writeFileAtomic 先写入同目录下的临时文件再重命名，避免进程中途退出留下不完整的文件
+func writeFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write temp file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync temp file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close temp file: %v", err)
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to chmod temp file: %v", err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename temp file: %v", err)
+	}
+	return nil
+}
+
+// saveTaskResult 保存任务结果，追加到该任务ID的结果文件中
+func saveTaskResult(taskID string, result *TaskResult) error {
 	// 确保results目录存在
 	resultPath := getResultDir()
 	if err := os.MkdirAll(resultPath, 0755); err != nil {
 		return err
 	}
 
-	var results []map[string]interface{}
+	// 新记录统一使用当前格式版本，problem_info总是对象
+	result.SchemaVersion = resultSchemaVersion
+	result.ProblemInfo = normalizeProblemInfo(result.ProblemInfo)
+
+	lock := resultLock(taskID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// 已有的结果按原样保留，兼容旧格式的记录
+	var results []json.RawMessage
 
 	// 检查是否已有该ID的结果文件
 	filePath := filepath.Join(resultPath, taskID+".json")
@@ -343,67 +1660,221 @@ func saveTaskResult(taskID string, result map[string]interface{}) error {
 		if err := json.Unmarshal(data, &results); err != nil {
 			return err
 		}
+	}
 
-	} else {
-		// 文件不存在，创建新文件
-		results = []map[string]interface{}{}
+	// 对话单独保存到conversations/<taskID>/<序号>.json，结果文件只保留路径
+	if separateConversations && result.Conversation != nil {
+		relPath := conversationFile(taskID, len(results))
+		data, err := json.MarshalIndent(result.Conversation, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(resultPath, relPath)), 0755); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(resultPath, relPath), data, 0644); err != nil {
+			return err
+		}
+		stored := *result
+		stored.Conversation = nil
+		stored.ConversationFile = relPath
+		result = &stored
 	}
 
-	results = append(results, result)
+	entry, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	results = append(results, entry)
 
 	// 保存到文件
 	data, err := json.MarshalIndent(results, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filePath, data, 0644)
+	if err := writeFileAtomic(filePath, data, 0644); err != nil {
+		return err
+	}
+	resultIdx.update(taskID+".json", data)
+	return nil
 }
 
-// executeTask 执行任务的函数
-func executeTask(task Task) {
-	fmt.Printf("Executing task: %+v\n", task)
+// separateConversations 为true时对话记录单独保存，避免结果文件过大
+var separateConversations = false
 
-	// 获取code server配置
-	var codeServerURL string
+// conversationDir 单独保存的对话记录所在目录（相对于结果目录）
+const conversationDir = "conversations"
 
-	// 查找指定的code server配置
-	for _, cs := range dataStore.data.CodeServers {
-		if cs.Name == task.CodeServerName {
-			codeServerURL = cs.URL
-			break
+// conversationFile 返回任务第index次执行的对话记录文件路径（相对于结果目录）
+func conversationFile(taskID string, index int) string {
+	return filepath.Join(conversationDir, taskID, strconv.Itoa(index)+".json")
+}
+
+// TranscriptEntry 便于阅读的对话记录中的一条消息
+type TranscriptEntry struct {
+	// Turn 消息所在的对话轮次，系统提示和初始问题为0
+	Turn int    `json:"turn"`
+	Role string `json:"role"`
+	// Kind 消息类型：system、prompt、assistant、tool_result、nudge或user
+	Kind string `json:"kind"`
+	// Command和Symbol 工具结果对应的请求
+	Command string `json:"command,omitempty"`
+	Symbol  string `json:"symbol,omitempty"`
+	// LLMConfig和Model 给出assistant回复的配置和模型
+	LLMConfig string `json:"llm_config,omitempty"`
+	Model     string `json:"model,omitempty"`
+	Content   string `json:"content"`
+}
+
+// buildTranscript 将发送给模型的消息整理为带类型标注的对话记录。
+// 工具结果按模型在tsj_next中请求的顺序依次追加，据此对应到各自的请求
+func buildTranscript(messages []Message) []TranscriptEntry {
+	transcript := make([]TranscriptEntry, 0, len(messages))
+	turn := 0
+	var pending []toolCall
+
+	for i, m := range messages {
+		entry := TranscriptEntry{Turn: turn, Role: m.Role, LLMConfig: m.LLMConfig, Model: m.Model, Content: m.Content}
+		switch {
+		case i == 0 && m.Role == "system":
+			entry.Kind = "system"
+		case i == 1 && m.Role == "user":
+			entry.Kind = "prompt"
+		case m.Role == "assistant":
+			turn++
+			entry.Turn = turn
+			entry.Kind = "assistant"
+			pending = nil
+			if message, err := parseLLMMessage(m.Content); err == nil && message["tag"] == "tsj_next" {
+				if requests, ok := message["requests"].([]any); ok {
+					pending = parseToolCalls(requests)
+				}
+			}
+		case m.Content == protocolNudge:
+			entry.Kind = "nudge"
+		case len(pending) > 0:
+			entry.Kind = "tool_result"
+			entry.Command = pending[0].Command
+			entry.Symbol = pending[0].SymName
+			pending = pending[1:]
+		default:
+			entry.Kind = m.Role
 		}
+		transcript = append(transcript, entry)
 	}
+	return transcript
+}
 
-	// 如果没有配置可用，记录错误并返回
-	if codeServerURL == "" {
-		fmt.Printf("No code server configuration available for task\n")
+// getTaskConversationHandler 返回任务某次执行的对话记录，index省略时返回最近一次
+func getTaskConversationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// 初始化代码分析器
-	codeAnalyzer := NewCodeAnalyzer(codeServerURL)
-	if codeAnalyzer == nil {
-		fmt.Printf("Error initializing code analyzer\ncheck code server url: %s", codeServerURL)
+	taskID := r.URL.Query().Get("id")
+	if taskID == "" {
+		http.Error(w, "Task ID is required", http.StatusBadRequest)
+		return
+	}
+	// 安全检查：确保任务ID不包含路径遍历字符
+	if strings.Contains(taskID, "..") || strings.Contains(taskID, "/") || strings.Contains(taskID, "\\") {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
 		return
 	}
 
-	// 查找指定的LLM配置
-	var selectedConfig *NamedLLMConfig
-	for _, config := range dataStore.data.LLMConfigs {
-		if config.Name == task.LLMConfigName {
-			selectedConfig = &config
-			break
+	resultPath := getResultDir()
+	lock := resultLock(taskID)
+	lock.Lock()
+	data, err := os.ReadFile(filepath.Join(resultPath, taskID+".json"))
+	lock.Unlock()
+	if os.IsNotExist(err) {
+		http.Error(w, "Task result not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read task result", http.StatusInternalServerError)
+		return
+	}
+
+	var results []json.RawMessage
+	if err := json.Unmarshal(data, &results); err != nil {
+		http.Error(w, "Invalid task result file", http.StatusInternalServerError)
+		return
+	}
+
+	index := len(results) - 1
+	if v := r.URL.Query().Get("index"); v != "" {
+		index, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid index", http.StatusBadRequest)
+			return
 		}
 	}
+	if index < 0 || index >= len(results) {
+		http.Error(w, fmt.Sprintf("Index out of range, task has %d result(s)", len(results)), http.StatusNotFound)
+		return
+	}
 
-	// 如果没有配置可用，记录错误并返回
-	if selectedConfig == nil {
-		fmt.Printf("No LLM configuration available for task\n")
+	var entry struct {
+		Conversation     []Message `json:"conversation"`
+		ConversationFile string    `json:"conversation_file"`
+	}
+	if err := json.Unmarshal(results[index], &entry); err != nil {
+		http.Error(w, "Invalid task result entry", http.StatusInternalServerError)
 		return
 	}
+	if entry.ConversationFile != "" {
+		data, err := os.ReadFile(filepath.Join(resultPath, filepath.Clean(entry.ConversationFile)))
+		if err != nil {
+			http.Error(w, "Failed to read conversation file", http.StatusInternalServerError)
+			return
+		}
+		if err := json.Unmarshal(data, &entry.Conversation); err != nil {
+			http.Error(w, "Invalid conversation file", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	response := map[string]interface{}{
+		"id":       taskID,
+		"index":    index,
+		"attempts": len(results),
+		"messages": buildTranscript(entry.Conversation),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// executeTask 执行任务的函数
+func executeTask(task types.Task, workerID int) error {
+	fmt.Printf("Executing task: %+v\n", task)
+
+	// 查找指定的code server配置，配置可能被后台重新加载，在锁内复制地址
+	codeServerURL := dataStore.codeServerURL(task.CodeServerName)
+
+	// 如果没有配置可用，记录错误并返回
+	if codeServerURL == "" {
+		return fmt.Errorf("no code server configuration available for task")
+	}
+
+	// 初始化代码分析器
+	codeAnalyzer := NewCodeAnalyzer(codeServerURL)
+	if codeAnalyzer == nil {
+		return fmt.Errorf("error initializing code analyzer, check code server url: %s", codeServerURL)
+	}
+	codeAnalyzer.TaskID = task.ID
+
+	// 查找指定的LLM配置及其fallback链
+	chain, err := dataStore.llmConfigChain(task.LLMConfigName)
+	if err != nil {
+		return fmt.Errorf("no LLM configuration available for task: %v", err)
+	}
 
 	// 初始化LLM分析器
-	llmAnalyzer := NewLLMAnalyzer(selectedConfig)
+	llmAnalyzer := NewLLMAnalyzer(&chain[0])
+	llmAnalyzer.Fallbacks = chain[1:]
 
 	// 准备问题上下文
 	problemPrompt := map[string]string{
@@ -411,27 +1882,301 @@ func executeTask(task Task) {
 		"init_user": task.UserPrompt,
 	}
 
-	// 分析任务
-	result, err := llmAnalyzer.AnalyzeTask(codeAnalyzer, problemPrompt)
+	// 分析任务，整体耗时受taskTimeout限制
+	startedAt := time.Now()
+	ctx, cancel := context.WithTimeout(workerCtx, taskTimeout)
+	defer cancel()
+
+	result, err := llmAnalyzer.AnalyzeTask(ctx, codeAnalyzer, problemPrompt)
+	var analyzeErr error
 	if err != nil {
+		// 出错、超时或因执行器关闭被中断的任务保存一条带部分对话的结果，便于后续排查
+		var status, message string
+		switch {
+		case workerCtx.Err() != nil:
+			status, message = ResultStatusInterrupted, fmt.Sprintf("task interrupted by executor shutdown: %v", err)
+		case errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded:
+			status, message = ResultStatusTimedOut, fmt.Sprintf("task exceeded timeout %v: %v", taskTimeout, err)
+		default:
+			analyzeErr = fmt.Errorf("error analyzing task: %v", err)
+			status, message = ResultStatusError, analyzeErr.Error()
+		}
 		fmt.Printf("Error analyzing task: %v\n", err)
-		return
+		// 保留AnalyzeTask已记录的工具缓存命中、纠正次数和截断等信息
+		result.Status = status
+		result.Error = message
 	}
 
+	result.ID = task.ID
+	result.Input = &TaskInput{
+		SystemPrompt:   task.SystemPrompt,
+		UserPrompt:     task.UserPrompt,
+		CodeServerName: task.CodeServerName,
+		LLMConfigName:  task.LLMConfigName,
+		Labels:         task.Labels,
+	}
+	result.Labels = task.Labels
+	// 记录实际给出结果的LLM配置
+	result.LLMConfig = llmAnalyzer.ConfigName
+	result.Model = llmAnalyzer.Model
+	result.FailedLLMConfigs = llmAnalyzer.FailedConfigs
+	result.ModelsUsed = summarizeModels(result.Conversation)
+	result.CodeServer = task.CodeServerName
+	result.WorkerID = workerID
+	result.SubmittedAt = task.SubmittedAt
+	result.StartedAt = startedAt
+	result.CompletedAt = time.Now()
+	result.DurationMs = result.CompletedAt.Sub(startedAt).Milliseconds()
+
 	// 保存任务结果
 	if err := saveTaskResult(task.ID, result); err != nil {
-		fmt.Printf("Error saving task result: %v\n", err)
-		return
+		return fmt.Errorf("error saving task result: %v", err)
 	}
 
 	// 输出结果
 	fmt.Printf("Task result: %+v\n", result)
+	return analyzeErr
+}
+
+// workerCount 任务工作协程数量
+var workerCount = 1
+
+// WorkerState 工作协程的当前状态，TaskID为空表示空闲
+type WorkerState struct {
+	ID     int       `json:"id"`
+	TaskID string    `json:"task_id,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+var (
+	workerStates      []WorkerState
+	workerStatesMutex sync.Mutex
+)
+
+// startWorkers 启动n个任务工作协程
+func startWorkers(n int) {
+	workerStatesMutex.Lock()
+	workerStates = make([]WorkerState, n)
+	for i := range workerStates {
+		workerStates[i] = WorkerState{ID: i, Since: time.Now()}
+	}
+	workerStatesMutex.Unlock()
+
+	for i := 0; i < n; i++ {
+		workerWG.Add(1)
+		go taskWorker(i)
+	}
+}
+
+// setWorkerTask 记录工作协程正在执行的任务，taskID为空表示空闲
+func setWorkerTask(workerID int, taskID string) {
+	workerStatesMutex.Lock()
+	defer workerStatesMutex.Unlock()
+	workerStates[workerID].TaskID = taskID
+	workerStates[workerID].Since = time.Now()
+}
+
+// 任务事件类型
+const (
+	TaskEventEnqueued  = "enqueued"
+	TaskEventStarted   = "started"
+	TaskEventCompleted = "completed"
+	TaskEventFailed    = "failed"
+)
+
+// TaskEvent 通过/ws推送给页面的任务事件
+type TaskEvent struct {
+	Type       string    `json:"type"`
+	TaskID     string    `json:"task_id"`
+	LLMConfig  string    `json:"llm_config"`
+	CodeServer string    `json:"code_server"`
+	WorkerID   *int      `json:"worker_id,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// eventClientBuffer 每个WebSocket连接待发送事件的缓冲数，缓冲满的慢连接会被断开
+const eventClientBuffer = 64
+
+// eventHub 管理WebSocket连接并广播任务事件
+type eventHub struct {
+	register   chan chan []byte
+	unregister chan chan []byte
+	broadcast  chan []byte
+	clients    map[chan []byte]bool
+}
+
+// newEventHub 创建事件广播器，需要调用run启动
+func newEventHub() *eventHub {
+	return &eventHub{
+		register:   make(chan chan []byte),
+		unregister: make(chan chan []byte),
+		broadcast:  make(chan []byte, 256),
+		clients:    make(map[chan []byte]bool),
+	}
+}
+
+// events 全局任务事件广播器
+var events = newEventHub()
+
+// run 事件广播协程，所有连接的增删和事件分发都在这里完成
+func (h *eventHub) run() {
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = true
+		case client := <-h.unregister:
+			if h.clients[client] {
+				delete(h.clients, client)
+				close(client)
+			}
+		case msg := <-h.broadcast:
+			for client := range h.clients {
+				select {
+				case client <- msg:
+				default:
+					// 连接处理不过来，断开它而不是阻塞其他连接
+					delete(h.clients, client)
+					close(client)
+				}
+			}
+		}
+	}
+}
+
+// publish 广播任务事件，广播队列满时丢弃事件，不阻塞任务处理
+func (h *eventHub) publish(eventType string, task types.Task, workerID int, err error) {
+	event := TaskEvent{
+		Type:       eventType,
+		TaskID:     task.ID,
+		LLMConfig:  task.LLMConfigName,
+		CodeServer: task.CodeServerName,
+		Time:       time.Now(),
+	}
+	if workerID >= 0 {
+		event.WorkerID = &workerID
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	msg, jsonErr := json.Marshal(event)
+	if jsonErr != nil {
+		return
+	}
+	select {
+	case h.broadcast <- msg:
+	default:
+	}
+}
+
+// wsUpgrader 使用默认的同源检查
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// wsPingInterval 向WebSocket连接发送ping的间隔
+const wsPingInterval = 30 * time.Second
+
+// wsHandler 建立WebSocket连接，推送任务入队、开始执行和结束的事件
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade失败时已经写入了错误响应
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	client := make(chan []byte, eventClientBuffer)
+	events.register <- client
+
+	// 读取协程只用于处理控制帧和感知连接关闭
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+		})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-client:
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				events.unregister <- client
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				events.unregister <- client
+				return
+			}
+		case <-closed:
+			events.unregister <- client
+			return
+		}
+	}
 }
 
-// taskWorker 任务工作协程
-func taskWorker() {
-	for task := range TaskQueue {
-		executeTask(task)
+// workerCtx 所有任务的上级context，排空超时后取消以中断仍在执行的任务
+var workerCtx, cancelWorkers = context.WithCancel(context.Background())
+
+// workerStop 关闭后工作协程不再从队列中领取任务
+var workerStop = make(chan struct{})
+
+// workerWG 等待工作协程退出
+var workerWG sync.WaitGroup
+
+// taskWorker 任务工作协程，workerStop关闭后执行完当前任务即退出
+func taskWorker(workerID int) {
+	defer workerWG.Done()
+	for {
+		var task types.Task
+		select {
+		case <-workerStop:
+			return
+		case task = <-TaskQueue:
+		}
+		// 与关闭信号同时到达的任务不再执行，按未执行的排队任务处理
+		select {
+		case <-workerStop:
+			dropTask(task)
+			return
+		default:
+		}
+
+		tracker.started(task.ID)
+		setWorkerTask(workerID, task.ID)
+		events.publish(TaskEventStarted, task, workerID, nil)
+		err := executeTask(task, workerID)
+		if err != nil {
+			fmt.Printf("Task %s failed: %v\n", task.ID, err)
+		}
+		setWorkerTask(workerID, "")
+		tracker.done(task.ID, err)
+		idempotency.finish(task.IdempotencyKey)
+		if err != nil {
+			events.publish(TaskEventFailed, task, workerID, err)
+		} else {
+			events.publish(TaskEventCompleted, task, workerID, nil)
+		}
 		// 任务执行完成后，从任务列表中移除
 		taskListMutex.Lock()
 		for i, t := range TaskList {
@@ -444,6 +2189,147 @@ func taskWorker() {
 	}
 }
 
+// dropTask 执行器关闭时丢弃未开始执行的任务
+func dropTask(task types.Task) {
+	log.Printf("Task %s was not started before shutdown and is dropped", task.ID)
+	taskListMutex.Lock()
+	for i, t := range TaskList {
+		if t.ID == task.ID {
+			TaskList = append(TaskList[:i], TaskList[i+1:]...)
+			break
+		}
+	}
+	taskListMutex.Unlock()
+	tracker.unqueued(task.ID)
+	idempotency.release(task.IdempotencyKey)
+}
+
+// drainTimeout 执行器关闭时等待正在执行的任务完成的最长时间
+var drainTimeout = time.Minute
+
+// shuttingDown 执行器正在关闭，不再接收新任务
+var shuttingDown atomic.Bool
+
+// errShuttingDown 执行器正在关闭
+var errShuttingDown = errors.New("task executor is shutting down")
+
+// shutdown 优雅关闭执行器：拒绝新任务，等待正在执行的任务完成（最长drainTimeout），
+// 超时后中断剩余任务并保存其部分结果，未开始的排队任务被丢弃，最后关闭HTTP服务
+func shutdown(server *http.Server) {
+	shuttingDown.Store(true)
+	close(workerStop)
+
+	done := make(chan struct{})
+	go func() {
+		workerWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Printf("All running tasks finished")
+	case <-time.After(drainTimeout):
+		log.Printf("Running tasks did not finish within %v, interrupting them", drainTimeout)
+		cancelWorkers()
+		// 等待被中断的任务保存结果
+		<-done
+	}
+
+	for {
+		select {
+		case task := <-TaskQueue:
+			dropTask(task)
+			continue
+		default:
+		}
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("HTTP server shutdown: %v", err)
+	}
+}
+
+// enqueueTimeout 任务队列已满时等待空位的最长时间，0表示立即拒绝
+var enqueueTimeout time.Duration
+
+// errQueueFull 任务队列已满
+var errQueueFull = errors.New("task queue is full")
+
+// enqueueTask 将任务加入任务列表并放入队列，队列在enqueueTimeout内没有空位时返回errQueueFull，
+// 执行器正在关闭时返回errShuttingDown
+func enqueueTask(task types.Task) error {
+	if shuttingDown.Load() {
+		return errShuttingDown
+	}
+	task.SubmittedAt = time.Now()
+	taskListMutex.Lock()
+	TaskList = append(TaskList, task)
+	taskListMutex.Unlock()
+	tracker.queued(task.ID)
+
+	err := sendTask(task)
+	if err == nil {
+		events.publish(TaskEventEnqueued, task, -1, nil)
+		return nil
+	}
+
+	// 入队失败，撤销任务列表和状态中的记录
+	taskListMutex.Lock()
+	for i := len(TaskList) - 1; i >= 0; i-- {
+		if TaskList[i].ID == task.ID {
+			TaskList = append(TaskList[:i], TaskList[i+1:]...)
+			break
+		}
+	}
+	taskListMutex.Unlock()
+	tracker.unqueued(task.ID)
+	return err
+}
+
+// sendTask 将任务放入队列，队列已满时最多等待enqueueTimeout。
+// 等待期间执行器开始关闭时返回errShuttingDown：关闭时排空队列会空出位置，之后放入的任务既不会执行也不会被丢弃记录
+func sendTask(task types.Task) error {
+	// select在多个分支就绪时随机选择，先单独检查是否已经开始关闭
+	select {
+	case <-workerStop:
+		return errShuttingDown
+	default:
+	}
+
+	select {
+	case TaskQueue <- task:
+		return nil
+	default:
+	}
+	if enqueueTimeout <= 0 {
+		return errQueueFull
+	}
+
+	timer := time.NewTimer(enqueueTimeout)
+	defer timer.Stop()
+	select {
+	case TaskQueue <- task:
+		return nil
+	case <-workerStop:
+		return errShuttingDown
+	case <-timer.C:
+		return errQueueFull
+	}
+}
+
+// writeEnqueueError 返回任务无法入队（队列已满或执行器正在关闭）的503响应
+func writeEnqueueError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "error",
+		"message": err.Error(),
+	})
+}
+
 // submitTaskHandler 接收任务的 HTTP 处理函数
 func submitTaskHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -451,30 +2337,139 @@ func submitTaskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var task Task
-	if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
-		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+	var task types.Task
+	if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	// 如果没有提供ID，生成一个
+	if task.ID == "" {
+		task.ID = generateTaskID()
+	}
+
+	// 相同幂等key的任务已存在时直接返回已有任务ID
+	if task.IdempotencyKey != "" {
+		if existingID, claimed := idempotency.claim(task.IdempotencyKey, task.ID); !claimed {
+			response := map[string]interface{}{
+				"status":    "success",
+				"message":   "Task already submitted",
+				"task_id":   existingID,
+				"duplicate": true,
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+
+	// 添加到任务列表和队列
+	if err := enqueueTask(task); err != nil {
+		idempotency.release(task.IdempotencyKey)
+		writeEnqueueError(w, err)
+		return
+	}
+
+	// 返回响应
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": "Task received",
+		"task_id": task.ID,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// rerunTaskHandler 使用结果文件中保存的输入重新执行任务，新结果追加到同一结果文件。
+// index指定使用第几条结果的输入，省略时使用最近一条带输入的结果
+func rerunTaskHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	taskID := r.URL.Query().Get("id")
+	if taskID == "" {
+		http.Error(w, "Task ID is required", http.StatusBadRequest)
+		return
+	}
+	// 安全检查：确保任务ID不包含路径遍历字符
+	if strings.Contains(taskID, "..") || strings.Contains(taskID, "/") || strings.Contains(taskID, "\\") {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	// 任务还在排队或执行中时不重复执行
+	if status, ok := tracker.get(taskID); ok && (status.State == TaskStateQueued || status.State == TaskStateRunning) {
+		http.Error(w, fmt.Sprintf("Task is %s", status.State), http.StatusConflict)
+		return
+	}
+
+	lock := resultLock(taskID)
+	lock.Lock()
+	data, err := os.ReadFile(filepath.Join(getResultDir(), taskID+".json"))
+	lock.Unlock()
+	if os.IsNotExist(err) {
+		http.Error(w, "Task result not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read task result", http.StatusInternalServerError)
 		return
 	}
 
-	// 如果没有提供ID，生成一个
-	if task.ID == "" {
-		task.ID = generateTaskID()
+	var entries []struct {
+		Input *TaskInput `json:"input"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		http.Error(w, "Invalid task result file", http.StatusInternalServerError)
+		return
 	}
 
-	// 添加到任务列表
-	taskListMutex.Lock()
-	TaskList = append(TaskList, task)
-	taskListMutex.Unlock()
+	index := -1
+	if v := r.URL.Query().Get("index"); v != "" {
+		index, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid index", http.StatusBadRequest)
+			return
+		}
+		if index < 0 || index >= len(entries) {
+			http.Error(w, fmt.Sprintf("Index out of range, task has %d result(s)", len(entries)), http.StatusNotFound)
+			return
+		}
+	} else {
+		for i := len(entries) - 1; i >= 0; i-- {
+			if entries[i].Input != nil {
+				index = i
+				break
+			}
+		}
+	}
+	if index < 0 || entries[index].Input == nil {
+		http.Error(w, "Task result has no stored input, it was saved by an older executor", http.StatusUnprocessableEntity)
+		return
+	}
 
-	// 将任务添加到队列
-	TaskQueue <- task
+	input := entries[index].Input
+	task := types.Task{
+		ID:             taskID,
+		SystemPrompt:   input.SystemPrompt,
+		UserPrompt:     input.UserPrompt,
+		CodeServerName: input.CodeServerName,
+		LLMConfigName:  input.LLMConfigName,
+		Labels:         input.Labels,
+	}
+	if err := enqueueTask(task); err != nil {
+		writeEnqueueError(w, err)
+		return
+	}
 
-	// 返回响应
 	response := map[string]interface{}{
-		"status":  "success",
-		"message": "Task received",
-		"task_id": task.ID,
+		"status":   "success",
+		"message":  "Task re-submitted",
+		"task_id":  taskID,
+		"rerun_of": index,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -488,6 +2483,129 @@ type BatchTaskRequest struct {
 	Functions   []string `json:"function"`
 	LLMConfig   string   `json:"llm_config"`
 	CodeServer  string   `json:"code_server"`
+	// CodeServers 可选，多个访问同一代码仓库的code server，批量任务轮流分配到各个code server以分摊负载
+	CodeServers []string `json:"code_servers,omitempty"`
+	Labels      []string `json:"labels,omitempty"`
+	// Mode 任务代码的来源：callers（默认，函数的调用点）、self（函数自身的定义）或both
+	Mode string `json:"mode,omitempty"`
+}
+
+// 批量任务的代码来源
+const (
+	BatchModeSelf    = "self"
+	BatchModeCallers = "callers"
+	BatchModeBoth    = "both"
+)
+
+// batchCodeServers 合并code_server和code_servers并去重，保持给出的顺序
+func batchCodeServers(request BatchTaskRequest) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range append([]string{request.CodeServer}, request.CodeServers...) {
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// findRefsBatchSize 单次find_refs_batch请求的最大符号数，与code_server的上限一致
+const findRefsBatchSize = 256
+
+// prefetchCallers 通过find_refs_batch批量查找函数的引用，返回函数名到find_refs响应JSON的映射。
+// code server不支持或请求失败时返回已获取的部分，其余函数由callerContents逐个查找
+func prefetchCallers(ctx context.Context, codeAnalyzer *CodeAnalyzer, functions []string) map[string]string {
+	prefetched := make(map[string]string, len(functions))
+	for start := 0; start < len(functions); start += findRefsBatchSize {
+		end := min(start+findRefsBatchSize, len(functions))
+		batch, err := codeAnalyzer.FindRefsBatch(ctx, functions[start:end])
+		if err != nil {
+			log.Printf("find_refs_batch failed, falling back to find_refs: %v", err)
+			break
+		}
+		for name, refs := range batch {
+			prefetched[name] = refs
+		}
+	}
+	return prefetched
+}
+
+// callerContents 返回函数各调用点的代码，没有可用的调用点时返回原因。
+// prefetched中有该函数的find_refs响应时直接使用，不再请求code server
+func callerContents(ctx context.Context, codeAnalyzer *CodeAnalyzer, functionName string, prefetched map[string]string) ([]string, string) {
+	refs, ok := prefetched[functionName]
+	if !ok {
+		var err error
+		refs, err = codeAnalyzer.FindAllRefs(ctx, functionName)
+		if err != nil {
+			return nil, fmt.Sprintf("ref lookup failed: %v", err)
+		}
+	}
+
+	var refsData struct {
+		Callers []string `json:"callers"`
+		Error   string   `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(refs), &refsData); err != nil {
+		return nil, fmt.Sprintf("invalid ref lookup response: %v", err)
+	}
+	if refsData.Error != "" {
+		return nil, fmt.Sprintf("ref lookup failed: %s", refsData.Error)
+	}
+	if len(refsData.Callers) == 0 {
+		return nil, "no callers"
+	}
+
+	var contents []string
+	for _, caller := range refsData.Callers {
+		if strings.TrimSpace(caller) != "" {
+			contents = append(contents, caller)
+		}
+	}
+	if len(contents) == 0 {
+		return nil, "empty caller content"
+	}
+	return contents, ""
+}
+
+// definitionContents 返回函数定义的代码（同名的多个定义各一份），没有可用的定义时返回原因
+func definitionContents(ctx context.Context, codeAnalyzer *CodeAnalyzer, functionName string) ([]string, string) {
+	info, err := codeAnalyzer.GetSymbolInfo(ctx, functionName)
+	if err != nil {
+		return nil, fmt.Sprintf("definition lookup failed: %v", err)
+	}
+
+	var symbolData struct {
+		ResList []struct {
+			Content string `json:"content"`
+		} `json:"res_list"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(info), &symbolData); err != nil {
+		return nil, fmt.Sprintf("invalid definition lookup response: %v", err)
+	}
+	if symbolData.Error != "" {
+		return nil, fmt.Sprintf("definition lookup failed: %s", symbolData.Error)
+	}
+
+	var contents []string
+	for _, sym := range symbolData.ResList {
+		if strings.TrimSpace(sym.Content) != "" {
+			contents = append(contents, sym.Content)
+		}
+	}
+	if len(contents) == 0 {
+		return nil, "no definition"
+	}
+	return contents, ""
+}
+
+// SkippedFunction 批量提交中没有创建任务的function及原因
+type SkippedFunction struct {
+	Function string `json:"function"`
+	Reason   string `json:"reason"`
 }
 
 // PromptTemplate prompt模板结构
@@ -524,6 +2642,84 @@ func renderPrompt(template *PromptTemplate, functionName, functionContent string
 	}
 }
 
+// RenderPromptRequest 预览提示词渲染结果的请求，Name与Template二选一
+type RenderPromptRequest struct {
+	Name            string          `json:"name,omitempty"`
+	Template        *PromptTemplate `json:"template,omitempty"`
+	FunctionName    string          `json:"function_name"`
+	FunctionContent string          `json:"function_content"`
+}
+
+// renderPromptHandler 使用示例函数渲染提示词模板的 HTTP 处理函数，不提交任务
+func renderPromptHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RenderPromptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	template := req.Template
+	if template == nil {
+		if !validPromptName(req.Name) {
+			http.Error(w, "Either a valid prompt name or an inline template is required", http.StatusBadRequest)
+			return
+		}
+		loaded, err := loadPromptTemplate(req.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		template = loaded
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(renderPrompt(template, req.FunctionName, req.FunctionContent))
+}
+
+// requiredPromptPlaceholders init_user中必须包含的占位符，可通过--required-placeholders配置
+var requiredPromptPlaceholders = []string{"{function_content}"}
+
+// recommendedPromptPlaceholders init_user中缺少时只给出警告的占位符
+var recommendedPromptPlaceholders = []string{"{function_name}"}
+
+// validatePromptPlaceholders 检查init_user中的占位符，缺少必需占位符时返回错误，缺少建议占位符时返回警告
+func validatePromptPlaceholders(initUser string) ([]string, error) {
+	for _, placeholder := range requiredPromptPlaceholders {
+		if !strings.Contains(initUser, placeholder) {
+			return nil, fmt.Errorf("init_user is missing required placeholder %s", placeholder)
+		}
+	}
+
+	warnings := []string{}
+	for _, placeholder := range recommendedPromptPlaceholders {
+		if !strings.Contains(initUser, placeholder) {
+			warnings = append(warnings, fmt.Sprintf("init_user does not contain %s", placeholder))
+		}
+	}
+	return warnings, nil
+}
+
+// parsePlaceholderList 解析逗号分隔的占位符列表，未带花括号的名称自动补全
+func parsePlaceholderList(value string) []string {
+	placeholders := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.HasPrefix(item, "{") {
+			item = "{" + item + "}"
+		}
+		placeholders = append(placeholders, item)
+	}
+	return placeholders
+}
+
 // submitBatchTaskHandler 批量提交任务的 HTTP 处理函数
 func submitBatchTaskHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -538,10 +2734,20 @@ func submitBatchTaskHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 验证必要参数
-	if request.ProblemType == "" || len(request.Functions) == 0 || request.LLMConfig == "" || request.CodeServer == "" {
+	codeServers := batchCodeServers(request)
+	if request.ProblemType == "" || len(request.Functions) == 0 || request.LLMConfig == "" || len(codeServers) == 0 {
 		http.Error(w, "Missing required parameters", http.StatusBadRequest)
 		return
 	}
+	mode := request.Mode
+	switch mode {
+	case "":
+		mode = BatchModeCallers
+	case BatchModeSelf, BatchModeCallers, BatchModeBoth:
+	default:
+		http.Error(w, "Invalid mode, must be one of self, callers, both", http.StatusBadRequest)
+		return
+	}
 
 	// 加载prompt模板
 	promptTemplate, err := loadPromptTemplate(request.ProblemType)
@@ -550,86 +2756,131 @@ func submitBatchTaskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 获取code server配置
-	var codeServerURL string
-	for _, cs := range dataStore.data.CodeServers {
-		if cs.Name == request.CodeServer {
-			codeServerURL = cs.URL
-			break
+	// 入队之前确认所有code server都存在，并为每个code server初始化代码分析器
+	analyzers := make([]*CodeAnalyzer, 0, len(codeServers))
+	for _, name := range codeServers {
+		codeServerURL := dataStore.codeServerURL(name)
+		if codeServerURL == "" {
+			http.Error(w, fmt.Sprintf("Code server not found: %s", name), http.StatusBadRequest)
+			return
 		}
-	}
 
-	if codeServerURL == "" {
-		http.Error(w, "Code server not found", http.StatusBadRequest)
-		return
+		codeAnalyzer := NewCodeAnalyzer(codeServerURL)
+		if codeAnalyzer == nil {
+			http.Error(w, fmt.Sprintf("Failed to initialize code analyzer for %s", name), http.StatusInternalServerError)
+			return
+		}
+		codeAnalyzer.TaskID = request.ID
+		analyzers = append(analyzers, codeAnalyzer)
 	}
 
-	// 初始化代码分析器
-	codeAnalyzer := NewCodeAnalyzer(codeServerURL)
-	if codeAnalyzer == nil {
-		http.Error(w, "Failed to initialize code analyzer", http.StatusInternalServerError)
-		return
+	// 需要调用点时按分配到的code server分组，通过find_refs_batch一次查找每组函数的引用
+	prefetched := make([]map[string]string, len(analyzers))
+	if mode == BatchModeCallers || mode == BatchModeBoth {
+		groups := make([][]string, len(analyzers))
+		for i, functionName := range request.Functions {
+			groups[i%len(analyzers)] = append(groups[i%len(analyzers)], functionName)
+		}
+		var wg sync.WaitGroup
+		for i, group := range groups {
+			if len(group) == 0 {
+				continue
+			}
+			wg.Add(1)
+			go func(i int, group []string) {
+				defer wg.Done()
+				prefetched[i] = prefetchCallers(r.Context(), analyzers[i], group)
+			}(i, group)
+		}
+		wg.Wait()
 	}
 
-	// 为每个function创建任务
+	// 为每个function创建任务，没有创建任何任务的function记录在skipped中
 	var taskIDs []string
-	for _, functionName := range request.Functions {
-		// 查找function的调用点
-		refs, err := codeAnalyzer.FindAllRefs(functionName)
-		if err != nil {
-			fmt.Printf("Failed to find refs for %s: %v\n", functionName, err)
-			continue
+	skipped := []SkippedFunction{}
+	rejected := 0
+	var rejectErr error
+	// assigned 每个code server分配到的任务数，next 下一个任务分配到的code server
+	assigned := make(map[string]int, len(codeServers))
+	next := 0
+	for i, functionName := range request.Functions {
+		// 收集代码的查询同样轮流发给各个code server
+		codeAnalyzer := analyzers[i%len(analyzers)]
+
+		// 按mode收集用于渲染prompt的代码：函数自身的定义和/或调用点
+		var contents, reasons []string
+		if mode == BatchModeSelf || mode == BatchModeBoth {
+			defs, reason := definitionContents(r.Context(), codeAnalyzer, functionName)
+			contents = append(contents, defs...)
+			if reason != "" {
+				reasons = append(reasons, reason)
+			}
 		}
-
-		// 解析JSON响应，获取callers列表
-		var refsData map[string]interface{}
-		if err := json.Unmarshal([]byte(refs), &refsData); err != nil {
-			fmt.Printf("Failed to parse refs JSON for %s: %v\n", functionName, err)
-			continue
+		if mode == BatchModeCallers || mode == BatchModeBoth {
+			callers, reason := callerContents(r.Context(), codeAnalyzer, functionName, prefetched[i%len(analyzers)])
+			contents = append(contents, callers...)
+			if reason != "" {
+				reasons = append(reasons, reason)
+			}
 		}
-
-		// 获取callers数组
-		callers, ok := refsData["callers"].([]interface{})
-		if !ok {
-			fmt.Printf("No callers found for %s\n", functionName)
+		if len(contents) == 0 {
+			reason := strings.Join(reasons, "; ")
+			fmt.Printf("Skipping %s: %s\n", functionName, reason)
+			skipped = append(skipped, SkippedFunction{Function: functionName, Reason: reason})
 			continue
 		}
 
-		// 为每个caller创建任务
-		for _, caller := range callers {
-			callerStr, ok := caller.(string)
-			if !ok || strings.TrimSpace(callerStr) == "" {
-				continue
-			}
-
+		// 为每段代码创建任务
+		for _, content := range contents {
 			// 渲染prompt
-			prompt := renderPrompt(promptTemplate, functionName, callerStr)
+			prompt := renderPrompt(promptTemplate, functionName, content)
 
-			// 创建任务
-			task := Task{
+			// 创建任务，轮流分配code server
+			task := types.Task{
 				ID:             request.ID,
 				SystemPrompt:   prompt["system"],
 				UserPrompt:     prompt["init_user"],
-				CodeServerName: request.CodeServer,
+				CodeServerName: codeServers[next%len(codeServers)],
 				LLMConfigName:  request.LLMConfig,
+				Labels:         request.Labels,
 			}
 
-			// 添加到任务列表和队列
-			taskListMutex.Lock()
-			TaskList = append(TaskList, task)
-			taskListMutex.Unlock()
-
-			TaskQueue <- task
+			// 添加到任务列表和队列，队列满后剩余任务直接拒绝，避免每个任务都等待enqueueTimeout
+			if rejected > 0 {
+				rejected++
+				continue
+			}
+			if err := enqueueTask(task); err != nil {
+				rejected++
+				rejectErr = err
+				continue
+			}
 			taskIDs = append(taskIDs, task.ID)
+			assigned[task.CodeServerName]++
+			next++
 		}
 	}
 
+	// 全部被拒绝时返回503，部分被拒绝时在响应中说明
+	if rejected > 0 && len(taskIDs) == 0 {
+		writeEnqueueError(w, rejectErr)
+		return
+	}
+
 	// 返回响应
 	response := map[string]interface{}{
 		"status":   "success",
 		"message":  "Batch tasks submitted",
 		"task_ids": taskIDs,
 		"count":    len(taskIDs),
+		"accepted": len(taskIDs),
+		"rejected": rejected,
+		"skipped":  skipped,
+		// code_servers 每个code server分配到的任务数
+		"code_servers": assigned,
+	}
+	if rejected > 0 {
+		response["message"] = fmt.Sprintf("Batch tasks partially submitted, %d rejected: %v", rejected, rejectErr)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -664,44 +2915,428 @@ func getTaskStatusHandler(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"exists": found,
 	}
+	// 已结束的任务只在保留数量内可查到状态
+	if status, ok := tracker.get(taskID); ok {
+		response["state"] = status.State
+		response["status"] = status
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// 结果列表的排序方式
+const (
+	ResultSortCreatedDesc = "created_desc"
+	ResultSortCreatedAsc  = "created_asc"
+	ResultSortNameAsc     = "name_asc"
+	ResultSortNameDesc    = "name_desc"
+)
+
+// getResultListHandler 获取结果列表的 HTTP 处理函数。
+// 默认按创建时间倒序返回全部结果文件，指定page或limit时分页返回
+func getResultListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	sortBy := query.Get("sort")
+	switch sortBy {
+	case "":
+		sortBy = ResultSortCreatedDesc
+	case ResultSortCreatedDesc, ResultSortCreatedAsc, ResultSortNameAsc, ResultSortNameDesc:
+	default:
+		http.Error(w, "Invalid sort, must be one of created_desc, created_asc, name_asc, name_desc", http.StatusBadRequest)
+		return
+	}
+
+	files := resultIdx.list(sortBy)
+	total := len(files)
+
+	// 未指定分页参数时返回全部结果，兼容不分页的调用方
+	pageStr := query.Get("page")
+	limitStr := query.Get("limit")
+	page := 1
+	limit := total
+	if pageStr != "" || limitStr != "" {
+		limit = 10
+		if pageStr != "" {
+			if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
+				page = p
+			}
+		}
+		if limitStr != "" {
+			if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
+				limit = l
+			}
+		}
+	}
+
+	// 计算当前页的范围
+	offset := (page - 1) * limit
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	totalPages := 0
+	if limit > 0 {
+		totalPages = (total + limit - 1) / limit
+	}
+
+	response := map[string]interface{}{
+		"results":     files[offset:end],
+		"total":       total,
+		"page":        page,
+		"limit":       limit,
+		"total_pages": totalPages,
+		"sort":        sortBy,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ResultSummary 单条任务结果的摘要
+type ResultSummary struct {
+	File           string `json:"file"`
+	Index          int    `json:"index"`
+	ID             string `json:"id,omitempty"`
+	Status         string `json:"status,omitempty"`
+	Tag            string `json:"tag,omitempty"`
+	HasProblemInfo bool   `json:"has_problem_info"`
+	// ProblemType problem_info中的problem_type，没有时为空
+	ProblemType string      `json:"problem_type,omitempty"`
+	ProblemInfo interface{} `json:"problem_info,omitempty"`
+	Labels      []string    `json:"labels,omitempty"`
+	SubmittedAt time.Time   `json:"submitted_at,omitempty"`
+	CompletedAt time.Time   `json:"completed_at,omitempty"`
+}
+
+// summarizeResultFile 解析结果文件内容，返回其中每条结果的摘要
+func summarizeResultFile(fileName string, data []byte) ([]ResultSummary, error) {
+	var entries []struct {
+		ID             string      `json:"id"`
+		Status         string      `json:"status"`
+		Tag            string      `json:"tag"`
+		HasProblemInfo bool        `json:"has_problem_info"`
+		ProblemInfo    interface{} `json:"problem_info"`
+		Labels         []string    `json:"labels"`
+		SubmittedAt    time.Time   `json:"submitted_at"`
+		CompletedAt    time.Time   `json:"completed_at"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	summaries := make([]ResultSummary, 0, len(entries))
+	for i, entry := range entries {
+		summary := ResultSummary{
+			File:           fileName,
+			Index:          i,
+			ID:             entry.ID,
+			Status:         entry.Status,
+			Tag:            entry.Tag,
+			HasProblemInfo: entry.HasProblemInfo,
+			ProblemInfo:    entry.ProblemInfo,
+			Labels:         entry.Labels,
+			SubmittedAt:    entry.SubmittedAt,
+			CompletedAt:    entry.CompletedAt,
+		}
+		// 旧格式记录的problem_info可能不是对象
+		if info, ok := entry.ProblemInfo.(map[string]interface{}); ok {
+			summary.ProblemType, _ = info["problem_type"].(string)
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// indexedResultFile 索引中的一个结果文件
+type indexedResultFile struct {
+	// created 文件中第一条结果的完成时间，旧格式记录没有时间时为索引时的文件修改时间
+	created   time.Time
+	summaries []ResultSummary
+}
+
+// resultIndex 结果文件名到其中各条结果摘要的内存索引。启动时扫描结果目录建立，
+// 保存和删除结果时同步更新，结果列表和汇总接口直接从索引返回而不再读取文件
+type resultIndex struct {
+	mu      sync.RWMutex
+	files   map[string]*indexedResultFile
+	builtAt time.Time
+}
+
+var resultIdx = &resultIndex{files: make(map[string]*indexedResultFile)}
+
+// put 替换一个结果文件的摘要
+func (ri *resultIndex) put(fileName string, file *indexedResultFile) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.files[fileName] = file
+}
+
+// update 根据结果文件的新内容更新索引，内容无法解析时从索引中移除
+func (ri *resultIndex) update(fileName string, data []byte) {
+	summaries, err := summarizeResultFile(fileName, data)
+	if err != nil {
+		log.Printf("Failed to index result file %s: %v", fileName, err)
+		ri.remove(fileName)
+		return
+	}
+
+	file := &indexedResultFile{summaries: summaries}
+	if len(summaries) > 0 {
+		file.created = summaries[0].CompletedAt
+	}
+	if file.created.IsZero() {
+		if info, err := os.Stat(filepath.Join(getResultDir(), fileName)); err == nil {
+			file.created = info.ModTime()
+		}
+	}
+	ri.put(fileName, file)
+}
+
+// remove 从索引中移除结果文件
+func (ri *resultIndex) remove(fileName string) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	delete(ri.files, fileName)
+}
+
+// rebuild 重新扫描结果目录更新索引，返回索引的文件数和结果条数。
+// 逐个文件在结果文件锁内读取和更新，不会覆盖扫描期间新保存的结果
+func (ri *resultIndex) rebuild() (int, int, error) {
+	resultPath := getResultDir()
+	entries, err := os.ReadDir(resultPath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, 0, fmt.Errorf("failed to read results directory: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(fileName, ".json") {
+			continue
+		}
+		seen[fileName] = true
+
+		lock := resultLock(strings.TrimSuffix(fileName, ".json"))
+		lock.Lock()
+		data, err := os.ReadFile(filepath.Join(resultPath, fileName))
+		if err == nil {
+			ri.update(fileName, data)
+		} else {
+			ri.remove(fileName)
+		}
+		lock.Unlock()
+	}
+
+	// 移除已不存在的文件，扫描之后才创建的文件仍然保留
+	ri.mu.RLock()
+	var stale []string
+	for fileName := range ri.files {
+		if !seen[fileName] {
+			stale = append(stale, fileName)
+		}
+	}
+	ri.mu.RUnlock()
+	for _, fileName := range stale {
+		lock := resultLock(strings.TrimSuffix(fileName, ".json"))
+		lock.Lock()
+		if _, err := os.Stat(filepath.Join(resultPath, fileName)); os.IsNotExist(err) {
+			ri.remove(fileName)
+		}
+		lock.Unlock()
+	}
+
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.builtAt = time.Now()
+	total := 0
+	for _, file := range ri.files {
+		total += len(file.summaries)
+	}
+	return len(ri.files), total, nil
+}
+
+// list 返回按sortBy排序的结果文件列表，创建时间相同时按文件名排序
+func (ri *resultIndex) list(sortBy string) []string {
+	ri.mu.RLock()
+	defer ri.mu.RUnlock()
+
+	files := make([]string, 0, len(ri.files))
+	for fileName := range ri.files {
+		files = append(files, fileName)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		a, b := ri.files[files[i]], ri.files[files[j]]
+		switch sortBy {
+		case ResultSortCreatedDesc:
+			if !a.created.Equal(b.created) {
+				return a.created.After(b.created)
+			}
+		case ResultSortCreatedAsc:
+			if !a.created.Equal(b.created) {
+				return a.created.Before(b.created)
+			}
+		case ResultSortNameDesc:
+			return files[i] > files[j]
+		}
+		return files[i] < files[j]
+	})
+	return files
+}
+
+// summaries 按文件名和序号顺序返回所有结果摘要，label非空时只返回带该标签的结果
+func (ri *resultIndex) summaries(label string) []ResultSummary {
+	ri.mu.RLock()
+	defer ri.mu.RUnlock()
+
+	files := make([]string, 0, len(ri.files))
+	for fileName := range ri.files {
+		files = append(files, fileName)
+	}
+	sort.Strings(files)
+
+	summaries := []ResultSummary{}
+	for _, fileName := range files {
+		for _, summary := range ri.files[fileName].summaries {
+			if label != "" && !hasLabel(summary.Labels, label) {
+				continue
+			}
+			summaries = append(summaries, summary)
+		}
+	}
+	return summaries
+}
+
+// rebuildResultIndexHandler 重新扫描结果目录重建结果索引，用于结果文件被外部修改之后
+func rebuildResultIndexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	files, total, err := resultIdx.rebuild()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"files":   files,
+		"results": total,
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// getResultListHandler 获取结果列表的 HTTP 处理函数
-func getResultListHandler(w http.ResponseWriter, r *http.Request) {
+// hasLabel 判断标签列表中是否包含指定标签
+func hasLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// getResultsSummaryHandler 汇总结果文件中每条结果的 HTTP 处理函数，支持按label过滤
+func getResultsSummaryHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// 确保results目录存在
-	if err := os.MkdirAll(resultDir, 0755); err != nil {
-		http.Error(w, "Failed to create results directory", http.StatusInternalServerError)
-		return
-	}
+	summaries := resultIdx.summaries(r.URL.Query().Get("label"))
 
-	// 读取results目录下的所有文件
-	files, err := os.ReadDir(resultDir)
-	if err != nil {
-		http.Error(w, "Failed to read results directory", http.StatusInternalServerError)
-		return
+	response := map[string]interface{}{
+		"results": summaries,
+		"total":   len(summaries),
 	}
 
-	var resultFiles []string
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
-			resultFiles = append(resultFiles, file.Name())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ResultStats 结果的汇总统计
+type ResultStats struct {
+	Files int `json:"files"`
+	Total int `json:"total"`
+	// Have和NotHave 模型给出tsj_have/tsj_nothave结论的结果数
+	Have    int `json:"tsj_have"`
+	NotHave int `json:"tsj_nothave"`
+	// Inconclusive 对话轮数耗尽仍没有结论的结果数
+	Inconclusive int `json:"inconclusive"`
+	// Failed 出错、超时或被中断的结果数
+	Failed   int            `json:"failed"`
+	ByStatus map[string]int `json:"by_status"`
+	// ByProblemType tsj_have结果按problem_type分组的数量，没有problem_type的计入unknown
+	ByProblemType map[string]int `json:"by_problem_type"`
+}
+
+// computeResultStats 汇总结果摘要。没有tag和status的旧格式记录按has_problem_info计入tsj_have或tsj_nothave
+func computeResultStats(summaries []ResultSummary) ResultStats {
+	stats := ResultStats{
+		Total:         len(summaries),
+		ByStatus:      make(map[string]int),
+		ByProblemType: make(map[string]int),
+	}
+	files := make(map[string]bool)
+	for _, summary := range summaries {
+		files[summary.File] = true
+		status := summary.Status
+		if status == "" {
+			status = "unknown"
+		}
+		stats.ByStatus[status]++
+
+		have := false
+		switch {
+		case summary.Tag == "tsj_have":
+			have = true
+		case summary.Tag == "tsj_nothave":
+			stats.NotHave++
+		case summary.Status == ResultStatusInconclusive:
+			stats.Inconclusive++
+		case summary.Status == ResultStatusError || summary.Status == ResultStatusTimedOut || summary.Status == ResultStatusInterrupted:
+			stats.Failed++
+		case summary.HasProblemInfo:
+			have = true
+		default:
+			stats.NotHave++
+		}
+		if have {
+			stats.Have++
+			problemType := summary.ProblemType
+			if problemType == "" {
+				problemType = "unknown"
+			}
+			stats.ByProblemType[problemType]++
 		}
 	}
+	stats.Files = len(files)
+	return stats
+}
 
-	response := map[string]interface{}{
-		"results": resultFiles,
+// getStatsHandler 从结果索引返回结果的汇总统计，可用label只统计带该标签的结果
+func getStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
 	}
 
+	stats := computeResultStats(resultIdx.summaries(r.URL.Query().Get("label")))
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(stats)
 }
 
 // exportResultHandler 导出结果的 HTTP 处理函数
@@ -723,7 +3358,7 @@ func exportResultHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filePath := filepath.Join(resultDir, fileName)
+	filePath := filepath.Join(getResultDir(), fileName)
 
 	// 检查文件是否存在
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
@@ -744,6 +3379,104 @@ func exportResultHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+// ResultDetail 单条任务结果中供界面展示的字段
+type ResultDetail struct {
+	File  string `json:"file"`
+	Index int    `json:"index"`
+	// Total 结果文件中的结果条数
+	Total          int          `json:"total"`
+	ID             string       `json:"id,omitempty"`
+	Status         string       `json:"status,omitempty"`
+	Tag            string       `json:"tag,omitempty"`
+	HasProblemInfo bool         `json:"has_problem_info"`
+	ProblemInfo    interface{}  `json:"problem_info,omitempty"`
+	Response       interface{}  `json:"response,omitempty"`
+	Error          string       `json:"error,omitempty"`
+	Labels         []string     `json:"labels,omitempty"`
+	LLMConfig      string       `json:"llm_config,omitempty"`
+	Model          string       `json:"model,omitempty"`
+	ModelsUsed     []ModelUsage `json:"models_used,omitempty"`
+	DurationMs     int64        `json:"duration_ms"`
+	CompletedAt    time.Time    `json:"completed_at,omitempty"`
+}
+
+// getResultDetailHandler 返回结果文件中第index条结果的解析后字段，index省略时返回最近一条
+func getResultDetailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fileName := r.URL.Query().Get("file")
+	if fileName == "" {
+		http.Error(w, "File name is required", http.StatusBadRequest)
+		return
+	}
+
+	// 安全检查：确保文件名不包含路径遍历字符
+	if strings.Contains(fileName, "..") || strings.Contains(fileName, "/") || strings.Contains(fileName, "\\") {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(getResultDir(), fileName))
+	if os.IsNotExist(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		http.Error(w, "Invalid result file", http.StatusInternalServerError)
+		return
+	}
+	// index省略时返回最近一条结果
+	index := len(entries) - 1
+	if v := r.URL.Query().Get("index"); v != "" {
+		index, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid index", http.StatusBadRequest)
+			return
+		}
+	}
+	if index < 0 || index >= len(entries) {
+		http.Error(w, fmt.Sprintf("Index out of range, file has %d result(s)", len(entries)), http.StatusNotFound)
+		return
+	}
+
+	var result TaskResult
+	if err := json.Unmarshal(entries[index], &result); err != nil {
+		http.Error(w, "Invalid result entry", http.StatusInternalServerError)
+		return
+	}
+
+	detail := ResultDetail{
+		File:           fileName,
+		Index:          index,
+		Total:          len(entries),
+		ID:             result.ID,
+		Status:         result.Status,
+		Tag:            result.Tag,
+		HasProblemInfo: result.HasProblemInfo,
+		ProblemInfo:    result.ProblemInfo,
+		Response:       result.Response,
+		Error:          result.Error,
+		Labels:         result.Labels,
+		LLMConfig:      result.LLMConfig,
+		Model:          result.Model,
+		ModelsUsed:     result.ModelsUsed,
+		DurationMs:     result.DurationMs,
+		CompletedAt:    result.CompletedAt,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
 // deleteResultHandler 删除结果的 HTTP 处理函数
 func deleteResultHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
@@ -763,7 +3496,14 @@ func deleteResultHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filePath := filepath.Join(resultDir, fileName)
+	resultPath := getResultDir()
+	filePath := filepath.Join(resultPath, fileName)
+	taskID := strings.TrimSuffix(fileName, ".json")
+
+	// 与保存结果互斥，避免删除后索引中残留同时写入的结果
+	lock := resultLock(taskID)
+	lock.Lock()
+	defer lock.Unlock()
 
 	// 检查文件是否存在
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
@@ -776,6 +3516,11 @@ func deleteResultHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to delete file", http.StatusInternalServerError)
 		return
 	}
+	resultIdx.remove(fileName)
+	// 同时删除单独保存的对话记录
+	if taskID != "" {
+		os.RemoveAll(filepath.Join(resultPath, conversationDir, taskID))
+	}
 
 	response := map[string]string{
 		"status":  "success",
@@ -838,186 +3583,610 @@ func (ds *DataStore) saveFullConfig() error {
 	if err != nil {
 		return err
 	}
+	ds.lastContent = configData
 	return os.WriteFile(ds.filepath, configData, 0644)
 }
 
+// upsertLLMConfig 返回更新或新增了同名LLM配置后的配置副本，不修改c
+func upsertLLMConfig(c types.Config, config types.NamedLLMConfig) types.Config {
+	//如果有相同name就更新，没有就新增
+	c.LLMConfigs = append([]types.NamedLLMConfig(nil), c.LLMConfigs...)
+	for i, cfg := range c.LLMConfigs {
+		if cfg.Name == config.Name {
+			c.LLMConfigs[i] = config
+			return c
+		}
+	}
+	c.LLMConfigs = append(c.LLMConfigs, config)
+	return c
+}
+
+// upsertCodeServer 返回更新或新增了同名code server后的配置副本，不修改c
+func upsertCodeServer(c types.Config, config types.CodeServer) types.Config {
+	c.CodeServers = append([]types.CodeServer(nil), c.CodeServers...)
+	for i, cs := range c.CodeServers {
+		if cs.Name == config.Name {
+			c.CodeServers[i] = config
+			return c
+		}
+	}
+	c.CodeServers = append(c.CodeServers, config)
+	return c
+}
+
+// applyConfig 校验更新后的配置，通过后保存到磁盘并生效。校验失败时返回400和全部问题，
+// 避免保存的配置在下次启动时无法加载；调用方需持有dataStore.mu
+func applyConfig(w http.ResponseWriter, candidate types.Config) {
+	if err := validateConfig(&candidate); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	old := dataStore.data
+	dataStore.data = candidate
+	if err := dataStore.saveFullConfig(); err != nil {
+		dataStore.data = old
+		http.Error(w, `{"error":"配置保存失败"}`, http.StatusInternalServerError)
+		return
+	}
+}
+
 func handleUpdateLLM(w http.ResponseWriter, r *http.Request) {
 	dataStore.mu.Lock()
 	defer dataStore.mu.Unlock()
-	var config NamedLLMConfig
+	var config types.NamedLLMConfig
 	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
 		http.Error(w, `{"error":"无效请求格式"}`, http.StatusBadRequest)
 		return
 	}
 
-	//如果有相同name就更新，没有就新增
-	var found bool
-	found = false
-	for i, cfg := range dataStore.data.LLMConfigs {
-		if cfg.Name == config.Name {
-			dataStore.data.LLMConfigs[i] = config
-			found = true
-			break
+	// 引用的环境变量必须存在，否则保存后每个任务都会失败
+	for _, value := range []string{config.APIKey, config.BaseURL} {
+		if _, err := expandEnv(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 	}
-	if !found {
-		dataStore.data.LLMConfigs = append(dataStore.data.LLMConfigs, config)
-	}
-	if err := dataStore.saveFullConfig(); err != nil {
-		http.Error(w, `{"error":"配置保存失败"}`, http.StatusInternalServerError)
-		return
-	}
+
+	applyConfig(w, upsertLLMConfig(dataStore.data, config))
 }
 
 func handleUpdateCodeServer(w http.ResponseWriter, r *http.Request) {
 	dataStore.mu.Lock()
 	defer dataStore.mu.Unlock()
-	var config CodeServer
+	var config types.CodeServer
 	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
 		http.Error(w, `{"error":"无效请求格式"}`, http.StatusBadRequest)
 		return
 	}
 
-	//如果有相同name就更新，没有就新增
+	applyConfig(w, upsertCodeServer(dataStore.data, config))
+}
+
+func handleDeleteConfig(w http.ResponseWriter, r *http.Request) {
+	dataStore.mu.Lock()
+	defer dataStore.mu.Unlock()
+	var deleteConfig struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&deleteConfig); err != nil {
+		http.Error(w, `{"error":"无效请求格式"}`, http.StatusBadRequest)
+		return
+	}
+
 	var found bool
 	found = false
-	for i, cfg := range dataStore.data.CodeServers {
-		if cfg.Name == config.Name {
-			dataStore.data.CodeServers[i] = config
-			found = true
-			break
+	// 根据type选择遍历哪个config并检查name相同的就删除
+	if deleteConfig.Type == "llm" {
+		for i, cfg := range dataStore.data.LLMConfigs {
+			if cfg.Name == deleteConfig.Name {
+				found = true
+				// 如果是默认llm，需要更新默认llm
+				dataStore.data.LLMConfigs = append(dataStore.data.LLMConfigs[:i], dataStore.data.LLMConfigs[i+1:]...)
+				break
+			}
+		}
+	} else if deleteConfig.Type == "code_server" {
+		for i, cfg := range dataStore.data.CodeServers {
+			if cfg.Name == deleteConfig.Name {
+				found = true
+				dataStore.data.CodeServers = append(dataStore.data.CodeServers[:i], dataStore.data.CodeServers[i+1:]...)
+				break
+			}
 		}
+	} else {
+		http.Error(w, `{"error":"无效的配置类型"}`, http.StatusBadRequest)
+		return
 	}
 	if !found {
-		dataStore.data.CodeServers = append(dataStore.data.CodeServers, config)
+		http.Error(w, `{"error":"没有找到对应的配置"}`, http.StatusBadRequest)
+		return
 	}
+
 	if err := dataStore.saveFullConfig(); err != nil {
 		http.Error(w, `{"error":"配置保存失败"}`, http.StatusInternalServerError)
 		return
 	}
 }
 
-func handleDeleteConfig(w http.ResponseWriter, r *http.Request) {
-	dataStore.mu.Lock()
-	defer dataStore.mu.Unlock()
-	var deleteConfig struct {
-		Type string `json:"type"`
-		Name string `json:"name"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&deleteConfig); err != nil {
-		http.Error(w, `{"error":"无效请求格式"}`, http.StatusBadRequest)
-		return
+func (ds *DataStore) LoadData() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	dataBytes, err := os.ReadFile(ds.filepath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			//文件不存在就创建一个初始空的文件，有config结构体的结构
+			initialConfig := types.Config{}
+			// 初始化默认的llm配置
+			initialConfig.LLMConfigs = append(initialConfig.LLMConfigs, types.NamedLLMConfig{
+				Name:    "changeme",
+				APIKey:  "",
+				BaseURL: "",
+				Model:   "",
+			})
+			// 初始化默认的code server配置
+			initialConfig.CodeServers = append(initialConfig.CodeServers, types.CodeServer{
+				Name: "changeme",
+				URL:  "",
+			})
+			initialConfigData, err := json.MarshalIndent(initialConfig, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to marshal initial config: %w", err)
+			}
+			if err := os.WriteFile(ds.filepath, initialConfigData, 0644); err != nil {
+				return fmt.Errorf("failed to write initial config file: %w", err)
+			}
+			ds.data = initialConfig
+			ds.lastContent = initialConfigData
+			return nil
+		}
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	config, err := parseConfig(dataBytes)
+	if err != nil {
+		return fmt.Errorf("invalid config %s:\n%w", ds.filepath, err)
+	}
+	ds.data = config
+	ds.lastContent = dataBytes
+	return nil
+}
+
+// usableLLMConfigs 返回base_url、api_key和model都已填写的LLM配置名，provider为local时不需要api_key
+func usableLLMConfigs(c *types.Config) []string {
+	var names []string
+	for _, cfg := range c.LLMConfigs {
+		hasKey := cfg.APIKey != "" || cfg.Provider == types.LLMProviderLocal
+		if cfg.BaseURL != "" && hasKey && cfg.Model != "" {
+			names = append(names, cfg.Name)
+		}
+	}
+	return names
+}
+
+// errNoUsableLLM 配置中没有可用的LLM配置，所有任务都会在运行时失败
+var errNoUsableLLM = errors.New("no usable LLM config: every llm_configs entry is missing base_url, api_key (except provider local) or model")
+
+// checkUsableLLM 配置中至少有一个可用的LLM配置时返回nil
+func checkUsableLLM(c *types.Config) error {
+	if len(usableLLMConfigs(c)) == 0 {
+		return errNoUsableLLM
+	}
+	return nil
+}
+
+// parseConfig 解析并校验配置文件内容
+func parseConfig(dataBytes []byte) (types.Config, error) {
+	var config types.Config
+	if err := json.Unmarshal(dataBytes, &config); err != nil {
+		return types.Config{}, fmt.Errorf("failed to unmarshal data: %w", err)
+	}
+	if err := validateConfig(&config); err != nil {
+		return types.Config{}, err
+	}
+	return config, nil
+}
+
+// configReloadDelay 配置文件变更后等待的时间，用于合并编辑器一次保存产生的多个事件
+const configReloadDelay = 200 * time.Millisecond
+
+// errConfigInvalid 配置文件内容无法解析或校验失败，原配置保持不变
+var errConfigInvalid = errors.New("invalid config")
+
+// reload 从磁盘重新加载并校验配置，返回配置是否有变化；校验失败时保留原配置，返回的错误包装errConfigInvalid
+func (ds *DataStore) reload() (bool, error) {
+	dataBytes, err := os.ReadFile(ds.filepath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read config %s: %v", ds.filepath, err)
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if bytes.Equal(dataBytes, ds.lastContent) {
+		return false, nil
+	}
+
+	config, err := parseConfig(dataBytes)
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", errConfigInvalid, err)
+	}
+	ds.data = config
+	ds.lastContent = dataBytes
+	log.Printf("Config reloaded from %s", ds.filepath)
+	if err := checkUsableLLM(&config); err != nil {
+		log.Printf("Warning: %v, tasks will fail until %s is fixed", err, ds.filepath)
+	}
+	return true, nil
+}
+
+// reloadFromDisk 配置文件变化时重新加载，内容与上次加载或写入一致时跳过，校验失败时保留原配置
+func (ds *DataStore) reloadFromDisk() {
+	if _, err := ds.reload(); err != nil {
+		if errors.Is(err, errConfigInvalid) {
+			log.Printf("Config %s changed but is invalid, keeping previous config:\n%v", ds.filepath, err)
+			return
+		}
+		log.Printf("Failed to reload config: %v", err)
+	}
+}
+
+// reloadConfigHandler 手动重新加载配置文件，返回重新加载后的配置摘要；校验失败时返回422和全部问题，原配置保持不变
+func reloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	changed, err := dataStore.reload()
+	if err != nil {
+		status := http.StatusInternalServerError
+		var problems []string
+		if errors.Is(err, errConfigInvalid) {
+			status = http.StatusUnprocessableEntity
+			problems = strings.Split(strings.TrimPrefix(err.Error(), errConfigInvalid.Error()+": "), "\n")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "failed",
+			"error":  err.Error(),
+			"errors": problems,
+		})
+		return
+	}
+
+	dataStore.mu.Lock()
+	var llmNames, codeServerNames []string
+	for _, cfg := range dataStore.data.LLMConfigs {
+		llmNames = append(llmNames, cfg.Name)
+	}
+	for _, cs := range dataStore.data.CodeServers {
+		codeServerNames = append(codeServerNames, cs.Name)
+	}
+	usable := usableLLMConfigs(&dataStore.data)
+	dataStore.mu.Unlock()
+
+	response := map[string]interface{}{
+		"status":       "success",
+		"changed":      changed,
+		"llm_configs":  llmNames,
+		"code_servers": codeServerNames,
+		// usable_llm_configs base_url、api_key、model都已填写的LLM配置
+		"usable_llm_configs": usable,
+	}
+	if len(usable) == 0 {
+		response["warning"] = errNoUsableLLM.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// watchConfig 监听配置文件变更并自动重新加载
+func (ds *DataStore) watchConfig() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// 监听所在目录而不是文件本身，兼容编辑器以重命名方式替换文件
+	configFile := filepath.Clean(ds.filepath)
+	if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != configFile || !event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(configReloadDelay, ds.reloadFromDisk)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Config watcher error: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// envRefPattern 配置值中引用环境变量的${NAME}
+var envRefPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv 将value中的${NAME}替换为环境变量的值，环境变量未设置或为空时返回错误（同时返回尽量替换后的结果）。
+// 配置文件和/get_config中始终保留原始的${NAME}，只在调用LLM时使用替换后的值
+func expandEnv(value string) (string, error) {
+	var missing []string
+	expanded := envRefPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envRefPattern.FindStringSubmatch(ref)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok || env == "" {
+			missing = append(missing, name)
+		}
+		return env
+	})
+	if len(missing) > 0 {
+		return expanded, fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
 	}
+	return expanded, nil
+}
 
-	var found bool
-	found = false
-	// 根据type选择遍历哪个config并检查name相同的就删除
-	if deleteConfig.Type == "llm" {
-		for i, cfg := range dataStore.data.LLMConfigs {
-			if cfg.Name == deleteConfig.Name {
-				found = true
-				// 如果是默认llm，需要更新默认llm
-				dataStore.data.LLMConfigs = append(dataStore.data.LLMConfigs[:i], dataStore.data.LLMConfigs[i+1:]...)
-				break
-			}
+// validateConfig 检查配置内容，一次性返回所有问题。
+// 所有值字段都为空的条目视为尚未填写的占位配置（例如自动生成的changeme），不做必填检查。
+func validateConfig(c *types.Config) error {
+	var errs []error
+
+	llmNames := make(map[string]bool)
+	for i, cfg := range c.LLMConfigs {
+		if cfg.Name == "" {
+			errs = append(errs, fmt.Errorf("llm_configs[%d]: name is empty", i))
+		} else if llmNames[cfg.Name] {
+			errs = append(errs, fmt.Errorf("llm_configs[%d]: duplicate name %q", i, cfg.Name))
 		}
-	} else if deleteConfig.Type == "code_server" {
-		for i, cfg := range dataStore.data.CodeServers {
-			if cfg.Name == deleteConfig.Name {
-				found = true
-				dataStore.data.CodeServers = append(dataStore.data.CodeServers[:i], dataStore.data.CodeServers[i+1:]...)
-				break
+		llmNames[cfg.Name] = true
+
+		if cfg.APIKey == "" && cfg.BaseURL == "" && cfg.Model == "" {
+			continue
+		}
+		if _, err := expandEnv(cfg.APIKey); err != nil {
+			errs = append(errs, fmt.Errorf("llm_configs[%d] %q: api_key: %v", i, cfg.Name, err))
+		}
+		baseURL, err := expandEnv(cfg.BaseURL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("llm_configs[%d] %q: base_url: %v", i, cfg.Name, err))
+		} else if baseURL == "" {
+			errs = append(errs, fmt.Errorf("llm_configs[%d] %q: base_url is empty", i, cfg.Name))
+		} else if u, err := url.Parse(baseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("llm_configs[%d] %q: invalid base_url %q", i, cfg.Name, cfg.BaseURL))
+		}
+		if cfg.Model == "" {
+			errs = append(errs, fmt.Errorf("llm_configs[%d] %q: model is empty", i, cfg.Name))
+		}
+		if cfg.Provider != "" && cfg.Provider != types.LLMProviderOpenAI && cfg.Provider != types.LLMProviderLocal {
+			errs = append(errs, fmt.Errorf("llm_configs[%d] %q: unknown provider %q, expected %s or %s", i, cfg.Name, cfg.Provider, types.LLMProviderOpenAI, types.LLMProviderLocal))
+		}
+		if cfg.RateLimit != nil && (cfg.RateLimit.RequestsPerMinute < 0 || cfg.RateLimit.MaxConcurrent < 0) {
+			errs = append(errs, fmt.Errorf("llm_configs[%d] %q: rate_limit values must not be negative", i, cfg.Name))
+		}
+		for key := range cfg.ExtraParams {
+			if reservedParams[key] {
+				errs = append(errs, fmt.Errorf("llm_configs[%d] %q: extra_params cannot override %q", i, cfg.Name, key))
 			}
 		}
-	} else {
-		http.Error(w, `{"error":"无效的配置类型"}`, http.StatusBadRequest)
-		return
-	}
-	if !found {
-		http.Error(w, `{"error":"没有找到对应的配置"}`, http.StatusBadRequest)
-		return
 	}
 
-	if err := dataStore.saveFullConfig(); err != nil {
-		http.Error(w, `{"error":"配置保存失败"}`, http.StatusInternalServerError)
-		return
+	// fallback必须指向已有的配置且不能成环
+	for i, cfg := range c.LLMConfigs {
+		if cfg.Fallback == "" {
+			continue
+		}
+		if !llmNames[cfg.Fallback] {
+			errs = append(errs, fmt.Errorf("llm_configs[%d] %q: fallback %q not found", i, cfg.Name, cfg.Fallback))
+		} else if _, err := llmConfigChain(c, cfg.Name); err != nil {
+			errs = append(errs, fmt.Errorf("llm_configs[%d] %q: %v", i, cfg.Name, err))
+		}
 	}
-}
 
-func (ds *DataStore) LoadData() error {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
+	codeServerNames := make(map[string]bool)
+	for i, cs := range c.CodeServers {
+		if cs.Name == "" {
+			errs = append(errs, fmt.Errorf("code_servers[%d]: name is empty", i))
+		} else if codeServerNames[cs.Name] {
+			errs = append(errs, fmt.Errorf("code_servers[%d]: duplicate name %q", i, cs.Name))
+		}
+		codeServerNames[cs.Name] = true
 
-	dataBytes, err := os.ReadFile(ds.filepath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			//文件不存在就创建一个初始空的文件，有config结构体的结构
-			initialConfig := Config{}
-			// 初始化默认的llm配置
-			initialConfig.LLMConfigs = append(initialConfig.LLMConfigs, NamedLLMConfig{
-				Name:    "changeme",
-				APIKey:  "",
-				BaseURL: "",
-				Model:   "",
-			})
-			// 初始化默认的code server配置
-			initialConfig.CodeServers = append(initialConfig.CodeServers, CodeServer{
-				Name: "changeme",
-				URL:  "",
-			})
-			initialConfigData, err := json.MarshalIndent(initialConfig, "", "  ")
-			if err != nil {
-				return fmt.Errorf("failed to marshal initial config: %w", err)
-			}
-			if err := os.WriteFile(ds.filepath, initialConfigData, 0644); err != nil {
-				return fmt.Errorf("failed to write initial config file: %w", err)
+		if cs.URL == "" {
+			continue
+		}
+		// code server地址格式为host:port或unix://socket路径
+		if socketPath, ok := strings.CutPrefix(cs.URL, unixURLPrefix); ok {
+			if socketPath == "" {
+				errs = append(errs, fmt.Errorf("code_servers[%d] %q: empty unix socket path in url %q", i, cs.Name, cs.URL))
 			}
-			ds.data = initialConfig
-			return nil
+		} else if _, port, err := net.SplitHostPort(cs.URL); err != nil {
+			errs = append(errs, fmt.Errorf("code_servers[%d] %q: invalid url %q, expected host:port", i, cs.Name, cs.URL))
+		} else if _, err := strconv.Atoi(port); err != nil {
+			errs = append(errs, fmt.Errorf("code_servers[%d] %q: invalid port in url %q", i, cs.Name, cs.URL))
 		}
-		return fmt.Errorf("failed to read file: %w", err)
 	}
 
-	if err := json.Unmarshal(dataBytes, &ds.data); err != nil {
-		return fmt.Errorf("failed to unmarshal data: %w", err)
+	return errors.Join(errs...)
+}
+
+// version 构建时通过-ldflags "-X main.version=..."注入的版本号
+var version = "dev"
+
+// versionString 返回版本号、Go版本和构建时记录的VCS修订
+func versionString() string {
+	text := fmt.Sprintf("task_executor %s %s", version, runtime.Version())
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		var revision, modified string
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.modified":
+				if setting.Value == "true" {
+					modified = "-dirty"
+				}
+			}
+		}
+		if revision != "" {
+			text += " revision " + revision + modified
+		}
 	}
-	return nil
+	return text
 }
 
 func main() {
 	// 定义命令行参数
 	configPath := flag.String("config", "", "Path to the LLM config file (default: llm_config.json in the same directory as the executable)")
 	port := flag.String("port", ":8080", "Port to listen on (default: :8080)")
+	flag.BoolVar(&strictProtocol, "strict-protocol", false, "Fail a task when the model response is still not valid protocol JSON after --protocol-retries corrections")
+	flag.DurationVar(&taskTimeout, "task-timeout", 5*time.Minute, "Maximum total duration of a single task")
+	flag.DurationVar(&codeServerTimeout, "code-server-timeout", 60*time.Second, "Timeout of a single code server request")
+	flag.IntVar(&codeServerRetries, "code-server-retries", 2, "Retries on code server connection errors")
+	watchConfig := flag.Bool("watch-config", true, "Reload the config file automatically when it changes on disk")
+	flag.DurationVar(&idempotencyTTL, "idempotency-ttl", time.Hour, "How long an idempotency_key keeps returning its task after the task finishes")
+	flag.DurationVar(&drainTimeout, "drain-timeout", time.Minute, "On SIGINT/SIGTERM, how long to wait for running tasks before interrupting them")
+	flag.DurationVar(&enqueueTimeout, "enqueue-timeout", 0, "How long a submission waits for space in a full task queue before being rejected with 503")
+	requiredPlaceholders := flag.String("required-placeholders", "function_content", "Comma separated placeholders every prompt template's init_user must contain")
+	flag.BoolVar(&separateConversations, "separate-conversations", false, "Store each conversation in results/conversations/<id>/<index>.json instead of inline in the result file")
+	protocolPath := flag.String("protocol-file", "", "Tool protocol template appended to the task prompt (default prompts/_protocol.txt, built-in text if absent)")
+	flag.IntVar(&protocolRetries, "protocol-retries", 2, "Times to ask the model to resend a response that is not valid protocol JSON, per conversation (default 1 with --strict-protocol)")
+	flag.IntVar(&contextTokens, "context-tokens", 64000, "Estimated token budget for a conversation; older large tool results are truncated to fit (0 disables)")
+	flag.IntVar(&toolCallConcurrency, "tool-concurrency", 4, "Maximum concurrent code server calls within one conversation turn")
+	flag.IntVar(&workerCount, "workers", 1, "Number of tasks executed concurrently")
+	flag.IntVar(&maxRetainedTasks, "max-retained-tasks", 10000, "Number of finished task statuses kept in memory (results on disk are not affected)")
+	llmDebugLog := flag.String("llm-debug-log", "", "Append raw LLM HTTP requests/responses (API key redacted) to this file")
+	resultsDirFlag := flag.String("results-dir", "", "Directory of task result files (env TASK_EXECUTOR_RESULTS_DIR, default: results in the same directory as the executable)")
+	promptsDirFlag := flag.String("prompts-dir", "", "Directory of prompt templates (env TASK_EXECUTOR_PROMPTS_DIR, default: prompts in the same directory as the executable)")
+	requireValidConfig := flag.Bool("require-valid-config", false, "Refuse to start when no LLM config has base_url, api_key (except provider local) and model set")
+	showVersion := flag.Bool("version", false, "Print version information and exit")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	// 数据目录，必须在加载提示词和建立结果索引之前确定
+	if err := setDataDir(&resultDirOverride, *resultsDirFlag, "TASK_EXECUTOR_RESULTS_DIR"); err != nil {
+		log.Fatal("Invalid results directory: ", err)
+	}
+	if err := setDataDir(&promptDirOverride, *promptsDirFlag, "TASK_EXECUTOR_PROMPTS_DIR"); err != nil {
+		log.Fatal("Invalid prompts directory: ", err)
+	}
+	log.Printf("Results directory: %s, prompts directory: %s", getResultDir(), getPromptDir())
+
+	requiredPromptPlaceholders = parsePlaceholderList(*requiredPlaceholders)
+	protocolRetriesSet := false
+	flag.Visit(func(f *flag.Flag) {
+		protocolRetriesSet = protocolRetriesSet || f.Name == "protocol-retries"
+	})
+	if !protocolRetriesSet {
+		protocolRetries = defaultProtocolRetries(strictProtocol)
+	}
+	if toolCallConcurrency < 1 {
+		toolCallConcurrency = 1
+	}
+
+	// 打开LLM调试日志
+	if *llmDebugLog != "" {
+		debugFile, err := os.OpenFile(*llmDebugLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatal("Failed to open LLM debug log: ", err)
+		}
+		defer debugFile.Close()
+		llmDebugLogger = log.New(debugFile, "[llm] ", log.LstdFlags)
+	}
+
+	// 加载工具调用协议说明
+	if err := loadProtocolPrompt(*protocolPath); err != nil {
+		log.Fatal("Failed to load protocol template: ", err)
+	}
+
 	// 加载配置
 	dataStore.filepath = getConfigPath(*configPath)
 	if err := dataStore.LoadData(); err != nil {
 		log.Fatal("Failed to load configs: ", err)
 	}
+	// 自动生成的changeme配置也能启动，此时每个任务都会失败，启动时就提示出来
+	if err := checkUsableLLM(&dataStore.data); err != nil {
+		if *requireValidConfig {
+			log.Fatalf("Invalid config %s: %v", dataStore.filepath, err)
+		}
+		log.Printf("Warning: %v, tasks will fail until %s is fixed (use --require-valid-config to refuse to start)", err, dataStore.filepath)
+	}
+
+	// 监听配置文件变更
+	if *watchConfig {
+		if err := dataStore.watchConfig(); err != nil {
+			log.Printf("Failed to watch config file: %v", err)
+		}
+	}
+
+	// 建立结果索引
+	if files, total, err := resultIdx.rebuild(); err != nil {
+		log.Printf("Failed to build result index: %v", err)
+	} else {
+		log.Printf("Indexed %d result(s) in %d result file(s)", total, files)
+	}
 
 	// 启动任务工作协程
-	go taskWorker()
+	if workerCount < 1 {
+		log.Fatal("--workers must be at least 1")
+	}
+	startWorkers(workerCount)
+	go events.run()
 
 	// 注册 HTTP 处理函数
 	http.HandleFunc("/api/submit_task", submitTaskHandler)
 	http.HandleFunc("/api/submit_batch_task", submitBatchTaskHandler)
+	http.HandleFunc("/api/rerun_task", rerunTaskHandler)
 	http.HandleFunc("/api/task_status", getTaskStatusHandler)
-	http.HandleFunc("/api/task_num", getTaskNumHandler)   // 新增的任务数量接口
+	http.HandleFunc("/api/task_num", getTaskNumHandler) // 新增的任务数量接口
+	http.HandleFunc("/api/queue_status", getQueueStatusHandler)
 	http.HandleFunc("/api/task_list", getTaskListHandler) // 新增的任务列表接口
 	http.HandleFunc("/api/result_list", getResultListHandler)
+	http.HandleFunc("/api/results_summary", getResultsSummaryHandler)
+	http.HandleFunc("/api/stats", getStatsHandler)
+	http.HandleFunc("/api/rebuild_result_index", rebuildResultIndexHandler)
+	http.HandleFunc("/api/task_conversation", getTaskConversationHandler)
 	http.HandleFunc("/api/export_result", exportResultHandler)
+	http.HandleFunc("/api/result_detail", getResultDetailHandler)
 	http.HandleFunc("/api/delete_result", deleteResultHandler)
 	http.HandleFunc("/api/prompt_templates", getPromptTemplatesHandler) // 新增的prompt模板列表接口
 	http.HandleFunc("/api/prompt_list", getPromptListHandler)           // 新增的提示词列表接口
 	http.HandleFunc("/api/update_prompt", updatePromptHandler)          // 新增的更新提示词接口
 	http.HandleFunc("/api/create_prompt", createPromptHandler)          // 新增的创建提示词接口
 	http.HandleFunc("/api/delete_prompt", deletePromptHandler)          // 新增的删除提示词接口
+	http.HandleFunc("/api/prompt_history", getPromptHistoryHandler)
+	http.HandleFunc("/api/prompt_rollback", rollbackPromptHandler)
+	http.HandleFunc("/api/render_prompt", renderPromptHandler)
 	http.HandleFunc("/config", configPageHandler)
+	http.HandleFunc("/ws", wsHandler)
 	http.HandleFunc("/get_config", handleGetConfig)
 	http.HandleFunc("/api/update_llm", handleUpdateLLM)
 	http.HandleFunc("/api/update_code_server", handleUpdateCodeServer)
 	http.HandleFunc("/api/delete_config", handleDeleteConfig)
+	http.HandleFunc("/api/reload_config", reloadConfigHandler)
 
 	// 添加静态文件路由
 	staticPath := filepath.Join(getExecutableDir(), "static")
@@ -1027,7 +4196,51 @@ func main() {
 	// 启动 HTTP 服务器
 	fmt.Printf("Task executor server starting on port %s...\n", *port)
 	fmt.Printf("Configuration page available at http://localhost%s/config\n", *port)
-	log.Fatal(http.ListenAndServe(*port, nil))
+	server := &http.Server{Addr: *port}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	// 收到退出信号后优雅关闭
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serverErr:
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Printf("Received %v, shutting down", sig)
+		shutdown(server)
+	}
+}
+
+// getQueueStatusHandler 获取队列深度和工作协程状态的 HTTP 处理函数
+func getQueueStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	queued, running := tracker.counts()
+
+	workerStatesMutex.Lock()
+	states := make([]WorkerState, len(workerStates))
+	copy(states, workerStates)
+	workerStatesMutex.Unlock()
+
+	response := map[string]interface{}{
+		"queued":        queued,
+		"running":       running,
+		"channel_len":   len(TaskQueue),
+		"channel_cap":   cap(TaskQueue),
+		"workers":       len(states),
+		"worker_states": states,
+		// 工具结果缓存命中的累计次数
+		"tool_cache_hits": toolCacheHitsTotal.Load(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
 // getTaskNumHandler 获取任务数量的 HTTP 处理函数
@@ -1165,6 +4378,15 @@ func updatePromptHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing required parameters", http.StatusBadRequest)
 		return
 	}
+	if !validPromptName(promptInfo.Name) {
+		http.Error(w, "Invalid prompt name", http.StatusBadRequest)
+		return
+	}
+	warnings, err := validatePromptPlaceholders(promptInfo.InitUser)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// 确保prompts文件夹存在
 	promptPath := getPromptDir()
@@ -1182,6 +4404,12 @@ func updatePromptHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 覆盖前先把旧版本保存到历史目录
+	if _, err := archivePrompt(promptInfo.Name); err != nil {
+		http.Error(w, "Failed to archive prompt: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// 创建提示词模板
 	promptTemplate := PromptTemplate{
 		System:   promptInfo.System,
@@ -1200,9 +4428,10 @@ func updatePromptHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := map[string]string{
-		"status":  "success",
-		"message": "Prompt updated successfully",
+	response := map[string]interface{}{
+		"status":   "success",
+		"message":  "Prompt updated successfully",
+		"warnings": warnings,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1227,6 +4456,15 @@ func createPromptHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing required parameters", http.StatusBadRequest)
 		return
 	}
+	if !validPromptName(promptInfo.Name) {
+		http.Error(w, "Invalid prompt name", http.StatusBadRequest)
+		return
+	}
+	warnings, err := validatePromptPlaceholders(promptInfo.InitUser)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// 确保prompts文件夹存在
 	promptPath := getPromptDir()
@@ -1262,9 +4500,170 @@ func createPromptHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	response := map[string]interface{}{
+		"status":   "success",
+		"message":  "Prompt created successfully",
+		"warnings": warnings,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// promptHistoryDir 提示词历史版本目录（位于prompts目录下）
+const promptHistoryDir = "history"
+
+// promptVersionLayout 历史版本文件名使用的时间格式，按字典序即按时间排序
+const promptVersionLayout = "20060102T150405.000000000Z"
+
+// validPromptName 提示词名称不能包含路径分隔符或..
+func validPromptName(name string) bool {
+	return name != "" && !strings.Contains(name, "..") && !strings.ContainsAny(name, "/\\")
+}
+
+// archivePrompt 将提示词当前内容复制到prompts/history/<name>/<timestamp>.json，文件不存在时不做处理
+func archivePrompt(name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(getPromptDir(), name+".json"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read prompt %s: %v", name, err)
+	}
+
+	historyPath := filepath.Join(getPromptDir(), promptHistoryDir, name)
+	if err := os.MkdirAll(historyPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to create history directory: %v", err)
+	}
+
+	version := time.Now().UTC().Format(promptVersionLayout)
+	if err := os.WriteFile(filepath.Join(historyPath, version+".json"), data, 0644); err != nil {
+		return "", fmt.Errorf("failed to save prompt history: %v", err)
+	}
+	return version, nil
+}
+
+// PromptVersion 提示词的一个历史版本
+type PromptVersion struct {
+	Version  string `json:"version"`
+	System   string `json:"system"`
+	InitUser string `json:"init_user"`
+}
+
+// listPromptVersions 返回提示词的历史版本，最新的在前
+func listPromptVersions(name string) ([]PromptVersion, error) {
+	historyPath := filepath.Join(getPromptDir(), promptHistoryDir, name)
+	files, err := os.ReadDir(historyPath)
+	if os.IsNotExist(err) {
+		return []PromptVersion{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history directory: %v", err)
+	}
+
+	versions := []PromptVersion{}
+	for i := len(files) - 1; i >= 0; i-- {
+		file := files[i]
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(historyPath, file.Name()))
+		if err != nil {
+			continue
+		}
+		var prompt PromptTemplate
+		if err := json.Unmarshal(data, &prompt); err != nil {
+			continue
+		}
+		versions = append(versions, PromptVersion{
+			Version:  strings.TrimSuffix(file.Name(), ".json"),
+			System:   prompt.System,
+			InitUser: prompt.InitUser,
+		})
+	}
+	return versions, nil
+}
+
+// getPromptHistoryHandler 获取提示词历史版本的 HTTP 处理函数
+func getPromptHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if !validPromptName(name) {
+		http.Error(w, "Invalid prompt name", http.StatusBadRequest)
+		return
+	}
+
+	versions, err := listPromptVersions(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"name":     name,
+		"versions": versions,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// rollbackPromptHandler 将提示词恢复到指定历史版本的 HTTP 处理函数，当前内容同样会保存到历史中
+func rollbackPromptHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	if !validPromptName(req.Name) || !validPromptName(req.Version) {
+		http.Error(w, "Invalid prompt name or version", http.StatusBadRequest)
+		return
+	}
+
+	versionPath := filepath.Join(getPromptDir(), promptHistoryDir, req.Name, req.Version+".json")
+	data, err := os.ReadFile(versionPath)
+	if os.IsNotExist(err) {
+		http.Error(w, "Prompt version not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read prompt version", http.StatusInternalServerError)
+		return
+	}
+
+	var prompt PromptTemplate
+	if err := json.Unmarshal(data, &prompt); err != nil {
+		http.Error(w, "Invalid prompt version content", http.StatusInternalServerError)
+		return
+	}
+
+	archived, err := archivePrompt(req.Name)
+	if err != nil {
+		http.Error(w, "Failed to archive prompt: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := os.WriteFile(filepath.Join(getPromptDir(), req.Name+".json"), data, 0644); err != nil {
+		http.Error(w, "Failed to save prompt file", http.StatusInternalServerError)
+		return
+	}
+
 	response := map[string]string{
-		"status":  "success",
-		"message": "Prompt created successfully",
+		"status":   "success",
+		"message":  "Prompt rolled back to " + req.Version,
+		"archived": archived,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1284,6 +4683,10 @@ func deletePromptHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error":"无效请求格式"}`, http.StatusBadRequest)
 		return
 	}
+	if !validPromptName(deleteRequest.Name) {
+		http.Error(w, `{"error":"无效的提示词名称"}`, http.StatusBadRequest)
+		return
+	}
 
 	// 构建提示词文件路径
 	promptPath := getPromptDir()
@@ -1295,6 +4698,12 @@ func deletePromptHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 删除前保存到历史目录，删除后仍可通过prompt_rollback恢复
+	if _, err := archivePrompt(deleteRequest.Name); err != nil {
+		http.Error(w, `{"error":"保存提示词历史失败"}`, http.StatusInternalServerError)
+		return
+	}
+
 	// 删除提示词文件
 	if err := os.Remove(promptFile); err != nil {
 		http.Error(w, `{"error":"删除提示词文件失败"}`, http.StatusInternalServerError)
@@ -1337,12 +4746,56 @@ func getTaskListHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// 过滤条件，在分页之前应用
+	query := r.URL.Query()
+	state := query.Get("state")
+	llmConfig := query.Get("llm_config")
+	codeServer := query.Get("code_server")
+	// 任务结束后即从任务列表移除，已结束的任务通过结果接口查询
+	switch state {
+	case "", TaskStateQueued, TaskStateRunning:
+	default:
+		http.Error(w, "Invalid state, must be queued or running (finished tasks are listed by /api/result_list)", http.StatusBadRequest)
+		return
+	}
+
 	// 计算偏移量
 	offset := (page - 1) * limit
 
 	// 获取任务列表
 	taskListMutex.Lock()
-	totalTasks := len(TaskList)
+	tasks := make([]types.Task, 0, len(TaskList))
+	// 批量任务共用ID，同一ID的任务按入队顺序开始执行，列表中该ID的前Running个任务即运行中的任务
+	seen := make(map[string]int)
+	running := make(map[string]int)
+	for _, task := range TaskList {
+		index := seen[task.ID]
+		seen[task.ID]++
+		if llmConfig != "" && task.LLMConfigName != llmConfig {
+			continue
+		}
+		if codeServer != "" && task.CodeServerName != codeServer {
+			continue
+		}
+		if state != "" {
+			n, ok := running[task.ID]
+			if !ok {
+				status, _ := tracker.get(task.ID)
+				n = status.Running
+				running[task.ID] = n
+			}
+			taskState := TaskStateQueued
+			if index < n {
+				taskState = TaskStateRunning
+			}
+			if taskState != state {
+				continue
+			}
+		}
+		tasks = append(tasks, task)
+	}
+	taskListMutex.Unlock()
+	totalTasks := len(tasks)
 
 	// 确保偏移量不超过任务总数
 	if offset >= totalTasks {
@@ -1356,12 +4809,10 @@ func getTaskListHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 获取当前页的任务
-	var pageTasks []Task
+	var pageTasks []types.Task
 	if offset < totalTasks {
-		pageTasks = make([]Task, end-offset)
-		copy(pageTasks, TaskList[offset:end])
+		pageTasks = tasks[offset:end]
 	}
-	taskListMutex.Unlock()
 
 	response := map[string]interface{}{
 		"tasks":       pageTasks,
@@ -0,0 +1,866 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lometsj/code_server/pkg/types"
+)
+
+// serve 用httptest.NewRecorder调用handler，返回记录的响应
+func serve(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// withPromptDir 测试期间使用临时的prompts目录
+func withPromptDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	old := promptDirOverride
+	promptDirOverride = dir
+	t.Cleanup(func() { promptDirOverride = old })
+	return dir
+}
+
+func readPrompt(t *testing.T, dir, name string) PromptTemplate {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, name+".json"))
+	if err != nil {
+		t.Fatalf("read prompt %s: %v", name, err)
+	}
+	var prompt PromptTemplate
+	if err := json.Unmarshal(data, &prompt); err != nil {
+		t.Fatalf("parse prompt %s: %v", name, err)
+	}
+	return prompt
+}
+
+func promptHistory(t *testing.T, name string) []PromptVersion {
+	t.Helper()
+	rec := serve(getPromptHistoryHandler, http.MethodGet, "/api/prompt_history?name="+name, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("prompt_history status = %d: %s", rec.Code, rec.Body)
+	}
+	var response struct {
+		Versions []PromptVersion `json:"versions"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response.Versions
+}
+
+func promptBody(name, system string) string {
+	data, _ := json.Marshal(PromptInfo{Name: name, System: system, InitUser: "check {function_name}: {function_content}"})
+	return string(data)
+}
+
+func TestPromptUpdateArchivesPreviousVersion(t *testing.T) {
+	dir := withPromptDir(t)
+
+	if rec := serve(createPromptHandler, http.MethodPost, "/api/create_prompt", promptBody("leak", "v1")); rec.Code != http.StatusOK {
+		t.Fatalf("create status = %d: %s", rec.Code, rec.Body)
+	}
+	if versions := promptHistory(t, "leak"); len(versions) != 0 {
+		t.Fatalf("new prompt has history %+v", versions)
+	}
+
+	for _, system := range []string{"v2", "v3"} {
+		if rec := serve(updatePromptHandler, http.MethodPost, "/api/update_prompt", promptBody("leak", system)); rec.Code != http.StatusOK {
+			t.Fatalf("update to %s status = %d: %s", system, rec.Code, rec.Body)
+		}
+	}
+	if got := readPrompt(t, dir, "leak").System; got != "v3" {
+		t.Errorf("current system = %q, want v3", got)
+	}
+
+	// 历史中是被覆盖的旧版本，最新的在前
+	versions := promptHistory(t, "leak")
+	if len(versions) != 2 || versions[0].System != "v2" || versions[1].System != "v1" {
+		t.Fatalf("history = %+v, want v2 then v1", versions)
+	}
+	if versions[0].Version <= versions[1].Version {
+		t.Errorf("versions not newest first: %s, %s", versions[0].Version, versions[1].Version)
+	}
+}
+
+func TestPromptRollback(t *testing.T) {
+	dir := withPromptDir(t)
+
+	serve(createPromptHandler, http.MethodPost, "/api/create_prompt", promptBody("leak", "v1"))
+	serve(updatePromptHandler, http.MethodPost, "/api/update_prompt", promptBody("leak", "v2"))
+	versions := promptHistory(t, "leak")
+	if len(versions) != 1 || versions[0].System != "v1" {
+		t.Fatalf("history = %+v", versions)
+	}
+
+	body := `{"name":"leak","version":"` + versions[0].Version + `"}`
+	rec := serve(rollbackPromptHandler, http.MethodPost, "/api/prompt_rollback", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rollback status = %d: %s", rec.Code, rec.Body)
+	}
+	if got := readPrompt(t, dir, "leak").System; got != "v1" {
+		t.Errorf("after rollback system = %q, want v1", got)
+	}
+	// 回滚前的内容同样保存到历史中
+	versions = promptHistory(t, "leak")
+	if len(versions) != 2 || versions[0].System != "v2" {
+		t.Errorf("history after rollback = %+v, want v2 first", versions)
+	}
+
+	rec = serve(rollbackPromptHandler, http.MethodPost, "/api/prompt_rollback", `{"name":"leak","version":"20000101T000000.000000000Z"}`)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown version status = %d, want 404", rec.Code)
+	}
+	rec = serve(rollbackPromptHandler, http.MethodPost, "/api/prompt_rollback", `{"name":"leak","version":"../../leak"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("traversal version status = %d, want 400", rec.Code)
+	}
+}
+
+func TestPromptDeleteArchivesAndValidatesName(t *testing.T) {
+	dir := withPromptDir(t)
+
+	// prompts目录之外的文件不能被删除
+	outside := filepath.Join(filepath.Dir(dir), filepath.Base(dir)+"_outside.json")
+	if err := os.WriteFile(outside, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outside)
+	for _, name := range []string{"../" + strings.TrimSuffix(filepath.Base(outside), ".json"), "a/b", `a\b`, ""} {
+		body, _ := json.Marshal(map[string]string{"name": name})
+		rec := serve(deletePromptHandler, http.MethodPost, "/api/delete_prompt", string(body))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("delete %q status = %d, want 400", name, rec.Code)
+		}
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatalf("file outside prompts dir was removed: %v", err)
+	}
+
+	serve(createPromptHandler, http.MethodPost, "/api/create_prompt", promptBody("leak", "v1"))
+	rec := serve(deletePromptHandler, http.MethodPost, "/api/delete_prompt", `{"name":"leak"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete status = %d: %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "leak.json")); !os.IsNotExist(err) {
+		t.Fatalf("prompt file still exists: %v", err)
+	}
+
+	// 删除的提示词可以从历史中恢复
+	versions := promptHistory(t, "leak")
+	if len(versions) != 1 || versions[0].System != "v1" {
+		t.Fatalf("history after delete = %+v", versions)
+	}
+	rec = serve(rollbackPromptHandler, http.MethodPost, "/api/prompt_rollback", `{"name":"leak","version":"`+versions[0].Version+`"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restore status = %d: %s", rec.Code, rec.Body)
+	}
+	if got := readPrompt(t, dir, "leak").System; got != "v1" {
+		t.Errorf("restored system = %q, want v1", got)
+	}
+}
+
+// newTestDataStore 使用临时配置文件创建DataStore并加载初始内容
+func newTestDataStore(t *testing.T, content string) *DataStore {
+	t.Helper()
+	ds := &DataStore{filepath: filepath.Join(t.TempDir(), "config.json")}
+	if err := os.WriteFile(ds.filepath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.LoadData(); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	return ds
+}
+
+const testConfigV1 = `{"llm_configs":[{"name":"primary","api_key":"k1","base_url":"http://127.0.0.1:1/v1","model":"m1","fallback":"backup"},
+{"name":"backup","api_key":"k2","base_url":"http://127.0.0.1:2/v1","model":"m2"}],
+"code_servers":[{"name":"cs","url":"127.0.0.1:8081"}]}`
+
+const testConfigV2 = `{"llm_configs":[{"name":"primary","api_key":"k1","base_url":"http://127.0.0.1:1/v1","model":"m3"}],
+"code_servers":[{"name":"cs","url":"127.0.0.1:9091"}]}`
+
+func TestDataStoreReloadKeepsPreviousConfigWhenInvalid(t *testing.T) {
+	ds := newTestDataStore(t, testConfigV1)
+
+	// 不是合法JSON
+	if err := os.WriteFile(ds.filepath, []byte(`{"llm_configs": [`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := ds.reload()
+	if !errors.Is(err, errConfigInvalid) || changed {
+		t.Fatalf("reload invalid JSON = %v, %v, want errConfigInvalid", changed, err)
+	}
+	// JSON合法但fallback指向不存在的配置
+	if err := os.WriteFile(ds.filepath, []byte(`{"llm_configs":[{"name":"a","api_key":"k","base_url":"http://x/v1","model":"m","fallback":"missing"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.reload(); !errors.Is(err, errConfigInvalid) {
+		t.Fatalf("reload with missing fallback = %v, want errConfigInvalid", err)
+	}
+	if got := ds.codeServerURL("cs"); got != "127.0.0.1:8081" {
+		t.Errorf("code server after invalid reload = %q, want previous 127.0.0.1:8081", got)
+	}
+	chain, err := ds.llmConfigChain("primary")
+	if err != nil || len(chain) != 2 || chain[0].Model != "m1" || chain[1].Name != "backup" {
+		t.Fatalf("chain after invalid reload = %+v, %v", chain, err)
+	}
+
+	if err := os.WriteFile(ds.filepath, []byte(testConfigV2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed, err = ds.reload()
+	if err != nil || !changed {
+		t.Fatalf("reload valid config = %v, %v", changed, err)
+	}
+	if got := ds.codeServerURL("cs"); got != "127.0.0.1:9091" {
+		t.Errorf("code server after reload = %q, want 127.0.0.1:9091", got)
+	}
+	chain, err = ds.llmConfigChain("primary")
+	if err != nil || len(chain) != 1 || chain[0].Model != "m3" {
+		t.Errorf("chain after reload = %+v, %v", chain, err)
+	}
+	if _, err := ds.llmConfigChain("backup"); err == nil {
+		t.Errorf("removed config backup still found")
+	}
+
+	// 内容没有变化时不重新加载
+	if changed, err := ds.reload(); err != nil || changed {
+		t.Errorf("reload unchanged file = %v, %v, want false, nil", changed, err)
+	}
+}
+
+func TestDataStoreReadsDuringReload(t *testing.T) {
+	ds := newTestDataStore(t, testConfigV1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			content := testConfigV1
+			if i%2 == 1 {
+				content = testConfigV2
+			}
+			os.WriteFile(ds.filepath, []byte(content), 0644)
+			ds.reload()
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if url := ds.codeServerURL("cs"); url != "127.0.0.1:8081" && url != "127.0.0.1:9091" {
+			t.Fatalf("unexpected code server url %q", url)
+		}
+		if _, err := ds.llmConfigChain("primary"); err != nil {
+			t.Fatalf("llmConfigChain: %v", err)
+		}
+	}
+}
+
+func TestTaskListStateFilter(t *testing.T) {
+	oldList, oldTracker := TaskList, tracker
+	t.Cleanup(func() { TaskList, tracker = oldList, oldTracker })
+	tracker = newTaskTracker()
+
+	// batch共用ID的三个任务中第一个开始执行，single仍在排队
+	TaskList = []types.Task{
+		{ID: "batch", UserPrompt: "f1", LLMConfigName: "a", CodeServerName: "cs"},
+		{ID: "batch", UserPrompt: "f2", LLMConfigName: "a", CodeServerName: "cs"},
+		{ID: "single", UserPrompt: "g", LLMConfigName: "b", CodeServerName: "cs"},
+		{ID: "batch", UserPrompt: "f3", LLMConfigName: "a", CodeServerName: "cs"},
+	}
+	for _, task := range TaskList {
+		tracker.queued(task.ID)
+	}
+	tracker.started("batch")
+
+	list := func(query string) ([]string, int) {
+		t.Helper()
+		rec := serve(getTaskListHandler, http.MethodGet, "/api/task_list?"+query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("task_list?%s status = %d: %s", query, rec.Code, rec.Body)
+		}
+		var response struct {
+			Tasks []types.Task `json:"tasks"`
+			Total int          `json:"total"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		var prompts []string
+		for _, task := range response.Tasks {
+			prompts = append(prompts, task.UserPrompt)
+		}
+		return prompts, response.Total
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "f1,f2,g,f3"},
+		{"state=running", "f1"},
+		{"state=queued", "f2,g,f3"},
+		{"state=queued&llm_config=a", "f2,f3"},
+		{"state=running&llm_config=b", ""},
+		{"code_server=cs&limit=2&page=2", "g,f3"},
+	}
+	for _, tt := range tests {
+		prompts, total := list(tt.query)
+		if got := strings.Join(prompts, ","); got != tt.want {
+			t.Errorf("task_list?%s = %q, want %q", tt.query, got, tt.want)
+		}
+		if tt.query != "code_server=cs&limit=2&page=2" && total != len(prompts) {
+			t.Errorf("task_list?%s total = %d, want %d", tt.query, total, len(prompts))
+		}
+	}
+
+	for _, state := range []string{"completed", "failed", "bogus"} {
+		if rec := serve(getTaskListHandler, http.MethodGet, "/api/task_list?state="+state, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("state=%s status = %d, want 400", state, rec.Code)
+		}
+	}
+}
+
+func TestLogLLMDebugRedactsBeforeTruncating(t *testing.T) {
+	var buf bytes.Buffer
+	old := llmDebugLogger
+	llmDebugLogger = log.New(&buf, "", 0)
+	t.Cleanup(func() { llmDebugLogger = old })
+
+	const key = "sk-0123456789abcdef"
+	la := &LLMAnalyzer{APIKey: key, Model: "m"}
+
+	// API key跨过截断点，截断前只剩前几个字符
+	body := strings.Repeat("x", maxDebugBodyLen-4) + key + strings.Repeat("y", 100)
+	la.logLLMDebug("request", "Authorization: Bearer "+key, []byte(body))
+	out := buf.String()
+	if strings.Contains(out, key[:4]) {
+		t.Errorf("debug log leaks a prefix of the API key")
+	}
+	if !strings.Contains(out, fmt.Sprintf("(truncated, %d bytes total)", len(body))) {
+		t.Errorf("body was not truncated")
+	}
+
+	buf.Reset()
+	la.logLLMDebug("response", "200 OK", []byte(`{"key":"`+key+`"}`))
+	if out := buf.String(); strings.Contains(out, key) || !strings.Contains(out, `{"key":"[REDACTED]"}`) {
+		t.Errorf("short body not redacted: %s", out)
+	}
+}
+
+// withResultDir 测试期间使用临时的结果目录和空的结果索引
+func withResultDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	oldDir, oldIdx := resultDirOverride, resultIdx
+	resultDirOverride = dir
+	resultIdx = &resultIndex{files: make(map[string]*indexedResultFile)}
+	t.Cleanup(func() { resultDirOverride, resultIdx = oldDir, oldIdx })
+	return dir
+}
+
+// writeResultFile 在结果目录中写入一个结果文件
+func writeResultFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResultsSummaryLabelFilter(t *testing.T) {
+	dir := withResultDir(t)
+	writeResultFile(t, dir, "task_a.json", `[
+		{"id":"task_a","status":"completed","tag":"tsj_have","has_problem_info":true,"labels":["team-a","scan-1"]},
+		{"id":"task_a","status":"completed","tag":"tsj_nothave","labels":["team-b"]}
+	]`)
+	writeResultFile(t, dir, "task_b.json", `[{"id":"task_b","status":"failed","labels":["scan-1"]}]`)
+	writeResultFile(t, dir, "task_c.json", `[{"id":"task_c","status":"completed","tag":"tsj_nothave"}]`)
+	if _, _, err := resultIdx.rebuild(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		label string
+		want  []string
+	}{
+		{"", []string{"task_a.json#0", "task_a.json#1", "task_b.json#0", "task_c.json#0"}},
+		{"scan-1", []string{"task_a.json#0", "task_b.json#0"}},
+		{"team-b", []string{"task_a.json#1"}},
+		{"missing", nil},
+	}
+	for _, tt := range tests {
+		t.Run("label="+tt.label, func(t *testing.T) {
+			rec := serve(getResultsSummaryHandler, http.MethodGet, "/api/results_summary?label="+tt.label, "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+			}
+			var response struct {
+				Results []ResultSummary `json:"results"`
+				Total   int             `json:"total"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, summary := range response.Results {
+				if tt.label != "" && !hasLabel(summary.Labels, tt.label) {
+					t.Errorf("result %s#%d has labels %v", summary.File, summary.Index, summary.Labels)
+				}
+				got = append(got, fmt.Sprintf("%s#%d", summary.File, summary.Index))
+			}
+			sort.Strings(got)
+			if response.Total != len(tt.want) || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("results = %v (total %d), want %v", got, response.Total, tt.want)
+			}
+		})
+	}
+
+	if rec := serve(getResultsSummaryHandler, http.MethodPost, "/api/results_summary", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want 405", rec.Code)
+	}
+}
+
+func TestStripCodeFence(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain json", ` {"tag":"tsj_next"} `, `{"tag":"tsj_next"}`},
+		{"fence with language", "```json\n{\"tag\":\"tsj_have\"}\n```", `{"tag":"tsj_have"}`},
+		{"fence without language", "```\n{\"tag\":\"tsj_have\"}\n```\n", `{"tag":"tsj_have"}`},
+		{"unterminated fence", "```json\n{\"tag\":\"tsj_have\"}", `{"tag":"tsj_have"}`},
+		{"text around fence is kept", "answer:\n```json\n{}\n```", "answer:\n```json\n{}\n```"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripCodeFence(tt.in); got != tt.want {
+				t.Errorf("stripCodeFence(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLLMMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantTag string
+		wantErr bool
+	}{
+		{"valid", `{"tag":"tsj_nothave","response":"ok"}`, "tsj_nothave", false},
+		{"fenced", "```json\n{\"tag\":\"tsj_next\",\"requests\":[]}\n```", "tsj_next", false},
+		{"prose", "The function looks safe.", "", true},
+		{"missing tag", `{"response":"ok"}`, "", true},
+		{"tag not a string", `{"tag":1}`, "", true},
+		{"array", `[{"tag":"tsj_have"}]`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, err := parseLLMMessage(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && message["tag"] != tt.wantTag {
+				t.Errorf("tag = %v, want %s", message["tag"], tt.wantTag)
+			}
+		})
+	}
+}
+
+// fakeLLM 模拟chat/completions接口，reply按请求序号（从0开始）返回状态码和回复内容
+func fakeLLM(t *testing.T, reply func(n int) (int, string)) (*httptest.Server, *int32) {
+	t.Helper()
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		status, content := reply(int(atomic.AddInt32(&calls, 1)) - 1)
+		if status != http.StatusOK {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, content, status)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{"message": map[string]string{"role": "assistant", "content": content}}},
+		})
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &calls
+}
+
+func TestAnalyzeTaskProtocolViolation(t *testing.T) {
+	ts, calls := fakeLLM(t, func(int) (int, string) {
+		return http.StatusOK, "I think this code has a bug."
+	})
+	prompt := map[string]string{"system": "system", "init_user": "analyze"}
+
+	// 严格模式默认去掉代码块标记并纠正一次后仍不合法即失败，保留已有的对话
+	if got := defaultProtocolRetries(true); got != 1 {
+		t.Fatalf("default strict protocol retries = %d, want 1", got)
+	}
+	la := &LLMAnalyzer{BaseURL: ts.URL, Model: "m", StrictProtocol: true, ProtocolRetries: defaultProtocolRetries(true)}
+	result, err := la.AnalyzeTask(context.Background(), &CodeAnalyzer{TaskID: "t"}, prompt)
+	if !errors.Is(err, errProtocolViolation) {
+		t.Fatalf("err = %v, want errProtocolViolation", err)
+	}
+	if got := atomic.LoadInt32(calls); got != 2 {
+		t.Errorf("model called %d times, want 2", got)
+	}
+	if result.ProtocolRetries != 1 {
+		t.Errorf("protocol retries = %d, want 1", result.ProtocolRetries)
+	}
+	nudges := 0
+	for _, m := range result.Conversation {
+		if m.Role == "user" && m.Content == protocolNudge {
+			nudges++
+		}
+	}
+	if nudges != 1 {
+		t.Errorf("conversation has %d nudges, want 1", nudges)
+	}
+
+	// 非严格模式下作废无法解析的回复，对话轮数耗尽后标记为没有结论
+	atomic.StoreInt32(calls, 0)
+	la = &LLMAnalyzer{BaseURL: ts.URL, Model: "m", ProtocolRetries: defaultProtocolRetries(false)}
+	result, err = la.AnalyzeTask(context.Background(), &CodeAnalyzer{TaskID: "t"}, prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != ResultStatusInconclusive {
+		t.Errorf("status = %s, want %s", result.Status, ResultStatusInconclusive)
+	}
+	if result.HasProblemInfo {
+		t.Errorf("inconclusive result counted as a finding")
+	}
+	if got := atomic.LoadInt32(calls); got != 7 {
+		t.Errorf("model called %d times, want 2 corrections and 5 turns", got)
+	}
+}
+
+// bodyTracker 记录经过的响应体数量及其中已关闭的数量
+type bodyTracker struct {
+	base           http.RoundTripper
+	opened, closed int32
+}
+
+func (bt *bodyTracker) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := bt.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&bt.opened, 1)
+	resp.Body = &trackedBody{ReadCloser: resp.Body, tracker: bt}
+	return resp, nil
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	tracker *bodyTracker
+	once    sync.Once
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(func() { atomic.AddInt32(&b.tracker.closed, 1) })
+	return b.ReadCloser.Close()
+}
+
+func TestQueryOpenAIRetriesAndClosesBodies(t *testing.T) {
+	ts, calls := fakeLLM(t, func(n int) (int, string) {
+		if n == 0 {
+			return http.StatusInternalServerError, "upstream error"
+		}
+		return http.StatusOK, `{"tag":"tsj_nothave"}`
+	})
+
+	// QueryOpenAI使用默认的Transport
+	tracker := &bodyTracker{base: http.DefaultTransport}
+	old := http.DefaultTransport
+	http.DefaultTransport = tracker
+	t.Cleanup(func() { http.DefaultTransport = old })
+
+	la := &LLMAnalyzer{BaseURL: ts.URL, Model: "m"}
+	content, err := la.QueryOpenAI(context.Background(), []Message{{Role: "user", Content: "hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != `{"tag":"tsj_nothave"}` {
+		t.Errorf("content = %q", content)
+	}
+	if got := atomic.LoadInt32(calls); got != 2 {
+		t.Errorf("model called %d times, want 2", got)
+	}
+	opened, closed := atomic.LoadInt32(&tracker.opened), atomic.LoadInt32(&tracker.closed)
+	if opened != 2 || closed != opened {
+		t.Errorf("opened %d response bodies, closed %d", opened, closed)
+	}
+}
+
+// chdir 测试期间切换当前工作目录
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	old, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(old) })
+}
+
+func TestResultHandlersIgnoreWorkingDirectory(t *testing.T) {
+	dir := withResultDir(t)
+	const content = `[{"id":"task_x","status":"completed","tag":"tsj_nothave"}]`
+	writeResultFile(t, dir, "task_x.json", content)
+	if err := os.MkdirAll(filepath.Join(dir, conversationDir, "task_x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	resultIdx.update("task_x.json", []byte(content))
+
+	// 当前目录下的results中是另一个同名文件，处理函数不应使用它
+	cwd := t.TempDir()
+	chdir(t, cwd)
+	if err := os.MkdirAll(filepath.Join(cwd, resultDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeResultFile(t, filepath.Join(cwd, resultDir), "task_x.json", `[{"id":"decoy"}]`)
+
+	rec := serve(exportResultHandler, http.MethodGet, "/api/export_result?file=task_x.json", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != content {
+		t.Fatalf("export = %d %s, want the file from the results directory", rec.Code, rec.Body)
+	}
+
+	rec = serve(deleteResultHandler, http.MethodDelete, "/api/delete_result?file=task_x.json", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete = %d %s", rec.Code, rec.Body)
+	}
+	for _, path := range []string{filepath.Join(dir, "task_x.json"), filepath.Join(dir, conversationDir, "task_x")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after delete", path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cwd, resultDir, "task_x.json")); err != nil {
+		t.Errorf("file in the working directory was touched: %v", err)
+	}
+	if summaries := resultIdx.summaries(""); len(summaries) != 0 {
+		t.Errorf("index still has %d results", len(summaries))
+	}
+
+	if rec := serve(exportResultHandler, http.MethodGet, "/api/export_result?file=task_x.json", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("export after delete = %d, want 404", rec.Code)
+	}
+	if rec := serve(exportResultHandler, http.MethodGet, "/api/export_result?file=../task_x.json", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("export with path traversal = %d, want 400", rec.Code)
+	}
+}
+
+func TestSetDataDirResolvesRelativeToWorkingDirectory(t *testing.T) {
+	cwd := t.TempDir()
+	chdir(t, cwd)
+	t.Setenv("TEST_RESULTS_DIR", "from-env")
+
+	var dir string
+	if err := setDataDir(&dir, "", "TEST_RESULTS_DIR"); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(cwd, "from-env"); dir != want {
+		t.Errorf("dir from env = %s, want %s", dir, want)
+	}
+	if err := setDataDir(&dir, "from-flag", "TEST_RESULTS_DIR"); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(cwd, "from-flag"); dir != want {
+		t.Errorf("dir from flag = %s, want %s", dir, want)
+	}
+
+	writeResultFile(t, cwd, "file", "")
+	if err := setDataDir(&dir, "file", ""); err == nil {
+		t.Errorf("expected an error for a regular file")
+	}
+}
+
+// withDataStore 测试期间使用从content加载的临时配置
+func withDataStore(t *testing.T, content string) *DataStore {
+	t.Helper()
+	ds := newTestDataStore(t, content)
+	old := dataStore
+	dataStore = ds
+	t.Cleanup(func() { dataStore = old })
+	return ds
+}
+
+func TestUpdateConfigRejectsInvalidEntries(t *testing.T) {
+	ds := withDataStore(t, testConfigV1)
+	saved, err := os.ReadFile(ds.filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		want    string
+	}{
+		{"base_url without scheme", handleUpdateLLM, `{"name":"new","api_key":"k","base_url":"api.example.com","model":"m"}`, "invalid base_url"},
+		{"unknown provider", handleUpdateLLM, `{"name":"primary","api_key":"k","base_url":"http://127.0.0.1:1/v1","model":"m","provider":"azure"}`, "unknown provider"},
+		{"empty llm name", handleUpdateLLM, `{"api_key":"k","base_url":"http://127.0.0.1:1/v1","model":"m"}`, "name is empty"},
+		{"missing fallback", handleUpdateLLM, `{"name":"backup","api_key":"k","base_url":"http://127.0.0.1:2/v1","model":"m","fallback":"gone"}`, "fallback"},
+		{"code server url not host:port", handleUpdateCodeServer, `{"name":"cs","url":"127.0.0.1"}`, "expected host:port"},
+		{"empty code server name", handleUpdateCodeServer, `{"url":"127.0.0.1:8082"}`, "name is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(tt.handler, http.MethodPost, "/api/update", tt.body)
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("status = %d, body %q, want 400 containing %q", rec.Code, rec.Body, tt.want)
+			}
+		})
+	}
+
+	// 校验失败时磁盘和内存中的配置都不变
+	data, err := os.ReadFile(ds.filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, saved) {
+		t.Errorf("config file changed after rejected updates:\n%s", data)
+	}
+	if got := ds.codeServerURL("cs"); got != "127.0.0.1:8081" {
+		t.Errorf("code server url = %s after rejected update", got)
+	}
+	if chain, err := ds.llmConfigChain("primary"); err != nil || len(chain) != 2 || chain[0].Provider != "" {
+		t.Errorf("llm config changed after rejected update: %+v, %v", chain, err)
+	}
+
+	// 合法的更新保存后可以被重新加载
+	if rec := serve(handleUpdateCodeServer, http.MethodPost, "/api/update_code_server", `{"name":"cs","url":"127.0.0.1:9091"}`); rec.Code != http.StatusOK {
+		t.Fatalf("valid update = %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(handleUpdateLLM, http.MethodPost, "/api/update_llm", `{"name":"local","base_url":"http://127.0.0.1:11434/v1","model":"llama3","provider":"local"}`); rec.Code != http.StatusOK {
+		t.Fatalf("valid update = %d %s", rec.Code, rec.Body)
+	}
+	reloaded := &DataStore{filepath: ds.filepath}
+	if err := reloaded.LoadData(); err != nil {
+		t.Fatalf("saved config does not load: %v", err)
+	}
+	if got := reloaded.codeServerURL("cs"); got != "127.0.0.1:9091" {
+		t.Errorf("reloaded code server url = %s", got)
+	}
+	if _, err := reloaded.llmConfigChain("local"); err != nil {
+		t.Errorf("reloaded config lacks the new llm config: %v", err)
+	}
+}
+
+func TestExecuteTaskKeepsPartialResultDetails(t *testing.T) {
+	// 第一次回复不是JSON而被纠正，之后模型API返回不可重试的错误
+	ts, _ := fakeLLM(t, func(n int) (int, string) {
+		if n == 0 {
+			return http.StatusOK, "Let me think about it."
+		}
+		return http.StatusBadRequest, "bad request"
+	})
+	withDataStore(t, fmt.Sprintf(`{"llm_configs":[{"name":"llm","api_key":"k","base_url":%q,"model":"m"}],
+"code_servers":[{"name":"cs","url":"127.0.0.1:1"}]}`, ts.URL))
+	dir := withResultDir(t)
+
+	task := types.Task{ID: "task_partial", SystemPrompt: "s", UserPrompt: "u", CodeServerName: "cs", LLMConfigName: "llm"}
+	if err := executeTask(task, 0); err == nil {
+		t.Fatal("expected the analysis error")
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, task.ID+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []TaskResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results", len(results))
+	}
+	result := results[0]
+	if result.Status != ResultStatusError || !strings.Contains(result.Error, "400") {
+		t.Errorf("status = %s, error = %q", result.Status, result.Error)
+	}
+	if result.ProtocolRetries != 1 {
+		t.Errorf("protocol_retries = %d, want 1", result.ProtocolRetries)
+	}
+	if result.LLMConfig != "llm" || result.Input == nil || result.Input.UserPrompt != "u" {
+		t.Errorf("task details missing from the partial result: %+v", result)
+	}
+}
+
+func TestEnqueueWaitingDuringShutdown(t *testing.T) {
+	oldList, oldTracker, oldQueue, oldStop, oldTimeout := TaskList, tracker, TaskQueue, workerStop, enqueueTimeout
+	t.Cleanup(func() {
+		TaskList, tracker, TaskQueue, workerStop, enqueueTimeout = oldList, oldTracker, oldQueue, oldStop, oldTimeout
+	})
+	TaskList, tracker = nil, newTaskTracker()
+	TaskQueue = make(chan types.Task, 1)
+	workerStop = make(chan struct{})
+	enqueueTimeout = time.Minute
+
+	TaskQueue <- types.Task{ID: "filler"}
+	errc := make(chan error, 1)
+	go func() { errc <- enqueueTask(types.Task{ID: "late"}) }()
+
+	// 等提交进入任务列表并开始等待队列空位
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		taskListMutex.Lock()
+		n := len(TaskList)
+		taskListMutex.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("enqueue did not start waiting")
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// 与shutdown相同：先停止工作协程，再排空队列空出位置
+	close(workerStop)
+	<-TaskQueue
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, errShuttingDown) {
+			t.Fatalf("enqueue = %v, want errShuttingDown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("enqueue still waiting after shutdown")
+	}
+	if len(TaskQueue) != 0 {
+		t.Errorf("task entered the queue after shutdown")
+	}
+	if status, ok := tracker.get("late"); len(TaskList) != 0 || (ok && status.Queued != 0) {
+		t.Errorf("rejected task still listed: %v, %+v", TaskList, status)
+	}
+}
@@ -2,45 +2,25 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
-)
-
-// Config 配置结构
-type Config struct {
-	LLMConfigs  []NamedLLMConfig `json:"llm_configs"`
-	CodeServers []CodeServer     `json:"code_servers"`
-}
-
-// NamedLLMConfig 定义带名称的LLM配置结构
-type NamedLLMConfig struct {
-	Name    string `json:"name"`
-	APIKey  string `json:"api_key"`
-	BaseURL string `json:"base_url"`
-	Model   string `json:"model"`
-}
-
-// CodeServer 定义代码服务器结构
-type CodeServer struct {
-	Name string `json:"name"`
-	URL  string `json:"url"`
-}
 
-// Task 任务结构
-type Task struct {
-	ID             string `json:"id"`
-	SystemPrompt   string `json:"system_prompt"`
-	UserPrompt     string `json:"user_prompt"`
-	CodeServerName string `json:"code_server_name"`
-	LLMConfigName  string `json:"llm_config_name"`
-}
+	"github.com/lometsj/code_server/pkg/types"
+)
 
 // TaskResponse 任务提交响应
 type TaskResponse struct {
@@ -52,16 +32,87 @@ type TaskResponse struct {
 // TaskStatusResponse 任务状态响应
 type TaskStatusResponse struct {
 	Exists bool `json:"exists"`
+	// State 执行器记录的任务状态：queued、running、completed或failed
+	State string `json:"state,omitempty"`
+}
+
+// 任务状态
+const (
+	TaskStateCompleted = "completed"
+	TaskStateFailed    = "failed"
+)
+
+// finished 任务是否已结束（执行器不再有该任务，或状态为completed/failed）
+func (s *TaskStatusResponse) finished() bool {
+	return !s.Exists || s.State == TaskStateCompleted || s.State == TaskStateFailed
+}
+
+// ResultDetail 执行器返回的单条任务结果
+type ResultDetail struct {
+	File           string      `json:"file"`
+	Index          int         `json:"index"`
+	Total          int         `json:"total"`
+	ID             string      `json:"id,omitempty"`
+	Status         string      `json:"status,omitempty"`
+	Tag            string      `json:"tag,omitempty"`
+	HasProblemInfo bool        `json:"has_problem_info"`
+	ProblemInfo    interface{} `json:"problem_info,omitempty"`
+	Response       interface{} `json:"response,omitempty"`
+	Error          string      `json:"error,omitempty"`
+	Labels         []string    `json:"labels,omitempty"`
+	LLMConfig      string      `json:"llm_config,omitempty"`
+	Model          string      `json:"model,omitempty"`
+	DurationMs     int64       `json:"duration_ms"`
+	CompletedAt    time.Time   `json:"completed_at,omitempty"`
 }
 
-// ProblemType 问题类型定义
-type ProblemType struct {
-	Name           string
-	Description    string
-	SystemPrompt   string
-	UserPrompt     string
-	RequiresBatch  bool // 是否需要批量处理
-	RequiresSymbol bool // 是否需要符号参数
+// ResultListResponse 结果列表响应
+type ResultListResponse struct {
+	Results    []string `json:"results"`
+	Total      int      `json:"total"`
+	Page       int      `json:"page"`
+	Limit      int      `json:"limit"`
+	TotalPages int      `json:"total_pages"`
+	Sort       string   `json:"sort"`
+}
+
+// PromptInfo 提示词信息
+type PromptInfo struct {
+	Name     string `json:"name"`
+	System   string `json:"system"`
+	InitUser string `json:"init_user"`
+}
+
+// PromptVersion 提示词的一个历史版本
+type PromptVersion struct {
+	Version  string `json:"version"`
+	System   string `json:"system"`
+	InitUser string `json:"init_user"`
+}
+
+// SubmitOutput submit子命令在--json模式下的输出
+type SubmitOutput struct {
+	TaskID  string        `json:"task_id"`
+	Status  string        `json:"status"`
+	Message string        `json:"message,omitempty"`
+	State   string        `json:"state,omitempty"`
+	Result  *ResultDetail `json:"result,omitempty"`
+	SavedTo string        `json:"saved_to,omitempty"`
+}
+
+// ActionOutput 修改类子命令在--json模式下的输出
+type ActionOutput struct {
+	Status   string   `json:"status"`
+	Type     string   `json:"type,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	Version  string   `json:"version,omitempty"`
+	SavedTo  string   `json:"saved_to,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// PromptListResponse 提示词列表响应
+type PromptListResponse struct {
+	Prompts []PromptInfo `json:"prompts"`
 }
 
 // TaskPublisher 任务发布器
@@ -75,13 +126,109 @@ func NewTaskPublisher(executorURL string) *TaskPublisher {
 	return &TaskPublisher{
 		ExecutorURL: executorURL,
 		HTTPClient: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout:   30 * time.Second,
+			Transport: &retryTransport{retries: httpRetries, base: http.DefaultTransport},
 		},
 	}
 }
 
-// SubmitTask 提交任务到执行器
-func (tp *TaskPublisher) SubmitTask(task Task) (*TaskResponse, error) {
+// httpRetries 请求出现连接错误或5xx响应时的重试次数，可通过--retries配置
+var httpRetries = 3
+
+// jsonOutput 为true时所有子命令以JSON格式输出到stdout，可通过--json配置
+var jsonOutput bool
+
+// retryBaseDelay 第一次重试前的等待时间，之后每次翻倍
+var retryBaseDelay = 500 * time.Millisecond
+
+// retryMaxDelay 两次重试之间的最长等待时间
+const retryMaxDelay = 10 * time.Second
+
+// retryTransport 在连接错误和5xx响应时按指数退避重试请求，4xx响应直接返回
+type retryTransport struct {
+	retries int
+	base    http.RoundTripper
+}
+
+// RoundTrip 实现http.RoundTripper接口
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 && req.Body != nil {
+			// 请求体已在上一次发送时读完，重新获取一份
+			if req.GetBody == nil {
+				return nil, fmt.Errorf("cannot retry %s %s: request body is not replayable", req.Method, req.URL)
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(req.Context())
+			r.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(r)
+		retryable := err != nil || resp.StatusCode >= http.StatusInternalServerError
+		if !retryable || attempt >= t.retries || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		fmt.Fprintf(os.Stderr, "Request %s %s failed (%s), retrying in %v (%d/%d)\n", req.Method, req.URL, reason, delay, attempt+1, t.retries)
+
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		delay *= 2
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+// authTransport 为每个请求附加认证头
+type authTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+// RoundTrip 实现http.RoundTripper接口
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(req)
+}
+
+// SetAuthToken 设置访问执行器时携带的认证token，为空时不附加认证头
+func (tp *TaskPublisher) SetAuthToken(token string) {
+	if token == "" {
+		return
+	}
+	base := tp.HTTPClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	tp.HTTPClient.Transport = &authTransport{token: token, base: base}
+}
+
+// SubmitTask 提交任务到执行器，未指定IdempotencyKey时自动生成，避免重试导致任务重复执行
+func (tp *TaskPublisher) SubmitTask(task types.Task) (*TaskResponse, error) {
+	if task.IdempotencyKey == "" {
+		key := make([]byte, 16)
+		if _, err := rand.Read(key); err == nil {
+			task.IdempotencyKey = hex.EncodeToString(key)
+		}
+	}
 	taskData, err := json.Marshal(task)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal task: %v", err)
@@ -112,7 +259,7 @@ func (tp *TaskPublisher) SubmitTask(task Task) (*TaskResponse, error) {
 }
 
 // GetConfig 从执行器获取配置
-func (tp *TaskPublisher) GetConfig() (*Config, error) {
+func (tp *TaskPublisher) GetConfig() (*types.Config, error) {
 	url := fmt.Sprintf("%s/get_config", tp.ExecutorURL)
 	resp, err := tp.HTTPClient.Get(url)
 	if err != nil {
@@ -129,7 +276,7 @@ func (tp *TaskPublisher) GetConfig() (*Config, error) {
 		return nil, fmt.Errorf("get config failed with status %d: %s", resp.StatusCode, string(body))
 	}
 
-	var config Config
+	var config types.Config
 	if err := json.Unmarshal(body, &config); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %v", err)
 	}
@@ -139,7 +286,7 @@ func (tp *TaskPublisher) GetConfig() (*Config, error) {
 
 // GetTaskStatus 获取任务状态
 func (tp *TaskPublisher) GetTaskStatus(taskID string) (*TaskStatusResponse, error) {
-	url := fmt.Sprintf("%s/get_task_status?id=%s", tp.ExecutorURL, taskID)
+	url := fmt.Sprintf("%s/api/task_status?id=%s", tp.ExecutorURL, neturl.QueryEscape(taskID))
 	resp, err := tp.HTTPClient.Get(url)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get task status: %v", err)
@@ -163,17 +310,16 @@ func (tp *TaskPublisher) GetTaskStatus(taskID string) (*TaskStatusResponse, erro
 	return &statusResp, nil
 }
 
-// WaitForTaskCompletion 等待任务完成
-func (tp *TaskPublisher) WaitForTaskCompletion(taskID string, maxRetries int, retryInterval time.Duration) error {
+// WaitForTaskCompletion 等待任务完成，返回任务结束时的状态（执行器未记录状态时为空）
+func (tp *TaskPublisher) WaitForTaskCompletion(taskID string, maxRetries int, retryInterval time.Duration) (string, error) {
 	for i := 0; i < maxRetries; i++ {
 		status, err := tp.GetTaskStatus(taskID)
 		if err != nil {
-			return fmt.Errorf("failed to get task status: %v", err)
+			return "", fmt.Errorf("failed to get task status: %v", err)
 		}
 
-		if !status.Exists {
-			// 任务不存在，说明已完成
-			return nil
+		if status.finished() {
+			return status.State, nil
 		}
 
 		if i < maxRetries-1 {
@@ -181,7 +327,311 @@ func (tp *TaskPublisher) WaitForTaskCompletion(taskID string, maxRetries int, re
 		}
 	}
 
-	return fmt.Errorf("task did not complete within %d retries", maxRetries)
+	return "", fmt.Errorf("task did not complete within %d retries", maxRetries)
+}
+
+// GetTaskResult 获取任务最近一次执行的结果
+func (tp *TaskPublisher) GetTaskResult(taskID string) (*ResultDetail, error) {
+	url := fmt.Sprintf("%s/api/result_detail?file=%s", tp.ExecutorURL, neturl.QueryEscape(taskID+".json"))
+	resp, err := tp.HTTPClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get task result: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get task result failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var detail ResultDetail
+	if err := json.Unmarshal(body, &detail); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	return &detail, nil
+}
+
+// ListResults 获取执行器上的结果文件列表，page或limit为0时不分页，sortBy为空时按创建时间倒序
+func (tp *TaskPublisher) ListResults(page, limit int, sortBy string) (*ResultListResponse, error) {
+	params := neturl.Values{}
+	if page > 0 {
+		params.Set("page", strconv.Itoa(page))
+	}
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+	if sortBy != "" {
+		params.Set("sort", sortBy)
+	}
+	url := fmt.Sprintf("%s/api/result_list?%s", tp.ExecutorURL, params.Encode())
+	resp, err := tp.HTTPClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list results: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list results failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var listResp ResultListResponse
+	if err := json.Unmarshal(body, &listResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+	if listResp.Results == nil {
+		listResp.Results = []string{}
+	}
+
+	return &listResp, nil
+}
+
+// RebuildResultIndex 让执行器重新扫描结果目录，返回索引的文件数和结果条数
+func (tp *TaskPublisher) RebuildResultIndex() (int, int, error) {
+	body, err := tp.postJSON("/api/rebuild_result_index", struct{}{}, "rebuild result index")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var resp struct {
+		Files   int `json:"files"`
+		Results int `json:"results"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return 0, 0, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+	return resp.Files, resp.Results, nil
+}
+
+// RerunTask 使用结果中保存的输入重新执行任务，index为负数时使用最近一条带输入的结果
+func (tp *TaskPublisher) RerunTask(taskID string, index int) error {
+	params := neturl.Values{"id": {taskID}}
+	if index >= 0 {
+		params.Set("index", strconv.Itoa(index))
+	}
+	_, err := tp.postJSON("/api/rerun_task?"+params.Encode(), struct{}{}, "rerun task")
+	return err
+}
+
+// ExportResult 下载指定的结果文件内容
+func (tp *TaskPublisher) ExportResult(fileName string) ([]byte, error) {
+	url := fmt.Sprintf("%s/api/export_result?file=%s", tp.ExecutorURL, neturl.QueryEscape(fileName))
+	resp, err := tp.HTTPClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export result: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("export result failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	return body, nil
+}
+
+// DeleteResult 删除指定的结果文件
+func (tp *TaskPublisher) DeleteResult(fileName string) error {
+	url := fmt.Sprintf("%s/api/delete_result?file=%s", tp.ExecutorURL, neturl.QueryEscape(fileName))
+	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	resp, err := tp.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to delete result: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("delete result failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// postJSON 向执行器发送JSON POST请求，返回响应体
+func (tp *TaskPublisher) postJSON(path string, payload interface{}, action string) ([]byte, error) {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	url := fmt.Sprintf("%s%s", tp.ExecutorURL, path)
+	resp, err := tp.HTTPClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to %s: %v", action, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s failed with status %d: %s", action, resp.StatusCode, string(body))
+	}
+
+	return body, nil
+}
+
+// ReloadConfigResult /api/reload_config的响应
+type ReloadConfigResult struct {
+	Status           string   `json:"status"`
+	Changed          bool     `json:"changed"`
+	LLMConfigs       []string `json:"llm_configs"`
+	CodeServers      []string `json:"code_servers"`
+	UsableLLMConfigs []string `json:"usable_llm_configs"`
+	Warning          string   `json:"warning,omitempty"`
+}
+
+// ReloadConfig 让执行器重新加载配置文件，配置无效时返回执行器给出的全部问题
+func (tp *TaskPublisher) ReloadConfig() (*ReloadConfigResult, error) {
+	body, err := tp.postJSON("/api/reload_config", struct{}{}, "reload config")
+	if err != nil {
+		return nil, err
+	}
+
+	var result ReloadConfigResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+	return &result, nil
+}
+
+// ListPrompts 获取执行器上的提示词模板列表
+func (tp *TaskPublisher) ListPrompts() ([]PromptInfo, error) {
+	url := fmt.Sprintf("%s/api/prompt_list", tp.ExecutorURL)
+	resp, err := tp.HTTPClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list prompts: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list prompts failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var listResp PromptListResponse
+	if err := json.Unmarshal(body, &listResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	return listResp.Prompts, nil
+}
+
+// CreatePrompt 创建提示词模板，返回执行器给出的占位符警告
+func (tp *TaskPublisher) CreatePrompt(prompt PromptInfo) ([]string, error) {
+	body, err := tp.postJSON("/api/create_prompt", prompt, "create prompt")
+	if err != nil {
+		return nil, err
+	}
+	return promptWarnings(body), nil
+}
+
+// UpdatePrompt 更新提示词模板，返回执行器给出的占位符警告
+func (tp *TaskPublisher) UpdatePrompt(prompt PromptInfo) ([]string, error) {
+	body, err := tp.postJSON("/api/update_prompt", prompt, "update prompt")
+	if err != nil {
+		return nil, err
+	}
+	return promptWarnings(body), nil
+}
+
+// promptWarnings 从创建/更新提示词的响应中取出警告信息
+func promptWarnings(body []byte) []string {
+	var resp struct {
+		Warnings []string `json:"warnings"`
+	}
+	json.Unmarshal(body, &resp)
+	return resp.Warnings
+}
+
+// DeletePrompt 删除提示词模板
+func (tp *TaskPublisher) DeletePrompt(name string) error {
+	_, err := tp.postJSON("/api/delete_prompt", map[string]string{"name": name}, "delete prompt")
+	return err
+}
+
+// PromptHistory 获取提示词模板的历史版本，最新的在前
+func (tp *TaskPublisher) PromptHistory(name string) ([]PromptVersion, error) {
+	url := fmt.Sprintf("%s/api/prompt_history?name=%s", tp.ExecutorURL, neturl.QueryEscape(name))
+	resp, err := tp.HTTPClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get prompt history: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get prompt history failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var historyResp struct {
+		Versions []PromptVersion `json:"versions"`
+	}
+	if err := json.Unmarshal(body, &historyResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	return historyResp.Versions, nil
+}
+
+// RollbackPrompt 将提示词模板恢复到指定历史版本
+func (tp *TaskPublisher) RollbackPrompt(name, version string) error {
+	_, err := tp.postJSON("/api/prompt_rollback", map[string]string{"name": name, "version": version}, "rollback prompt")
+	return err
+}
+
+// UpdateLLMConfig 新增或更新LLM配置
+func (tp *TaskPublisher) UpdateLLMConfig(config types.NamedLLMConfig) error {
+	_, err := tp.postJSON("/api/update_llm", config, "update llm config")
+	return err
+}
+
+// UpdateCodeServer 新增或更新code server配置
+func (tp *TaskPublisher) UpdateCodeServer(config types.CodeServer) error {
+	_, err := tp.postJSON("/api/update_code_server", config, "update code server")
+	return err
+}
+
+// DeleteConfig 删除配置，configType为llm或code_server
+func (tp *TaskPublisher) DeleteConfig(configType, name string) error {
+	payload := map[string]string{
+		"type": configType,
+		"name": name,
+	}
+	_, err := tp.postJSON("/api/delete_config", payload, "delete config")
+	return err
 }
 
 // CodeServerClient code_server客户端
@@ -195,91 +645,101 @@ func NewCodeServerClient(baseURL string) *CodeServerClient {
 	return &CodeServerClient{
 		BaseURL: baseURL,
 		HTTPClient: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout:   30 * time.Second,
+			Transport: &retryTransport{retries: httpRetries, base: http.DefaultTransport},
 		},
 	}
 }
 
-// SymbolInfo 符号信息
-type SymbolInfo struct {
-	Name    string `json:"name"`
-	Kind    string `json:"kind"`
-	Line    int    `json:"line"`
-	End     int    `json:"end"`
-	Content string `json:"content"`
-	File    string `json:"file"`
-	Typeref string `json:"typeref,omitempty"`
-}
-
-// SymbolResponse 符号响应
-type SymbolResponse struct {
-	Status  string       `json:"status"`
-	ResList []SymbolInfo `json:"res_list,omitempty"`
-	Error   string       `json:"error,omitempty"`
-}
-
-// RefResponse 引用响应
-type RefResponse struct {
-	Callers []string `json:"callers"`
-	Error   string   `json:"error,omitempty"`
-}
-
-// GetSymbolInfo 获取符号信息
-func (csc *CodeServerClient) GetSymbolInfo(symbol string) error {
+// GetSymbolInfo 获取符号信息，返回code_server的原始JSON响应，file非空时只在该文件中查找
+func (csc *CodeServerClient) GetSymbolInfo(symbol, file string) ([]byte, error) {
 	reqBody := map[string]string{
 		"symbol": symbol,
 	}
+	if file != "" {
+		reqBody["file"] = file
+	}
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
-		return fmt.Errorf("failed to marshal request: %v", err)
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
 	}
 
 	url := fmt.Sprintf("%s/api/get_symbol", csc.BaseURL)
 	resp, err := csc.HTTPClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
-		return fmt.Errorf("failed to get symbol info: %v", err)
+		return nil, fmt.Errorf("failed to get symbol info: %v", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to read response: %v", err)
+		return nil, fmt.Errorf("failed to read response: %v", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("get symbol info failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("get symbol info failed with status %d: %s", resp.StatusCode, string(body))
 	}
-	fmt.Print(string(body))
-
-	return nil
+	return body, nil
 }
 
-// FindAllRefs 获取所有引用
-func (csc *CodeServerClient) FindAllRefs(symbol string) error {
+// FindAllRefs 获取所有引用，返回code_server的原始JSON响应，mode为空时使用code_server的默认模式
+func (csc *CodeServerClient) FindAllRefs(symbol, mode string) ([]byte, error) {
 	reqBody := map[string]string{
 		"symbol": symbol,
 	}
+	if mode != "" {
+		reqBody["mode"] = mode
+	}
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
-		return fmt.Errorf("failed to marshal request: %v", err)
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
 	}
 
 	url := fmt.Sprintf("%s/api/find_refs", csc.BaseURL)
 	resp, err := csc.HTTPClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
-		return fmt.Errorf("failed to find refs: %v", err)
+		return nil, fmt.Errorf("failed to find refs: %v", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to read response: %v", err)
+		return nil, fmt.Errorf("failed to read response: %v", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("find refs failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
+
+// StreamRefs 以流式模式查找引用，code_server每输出一行（一个调用者）就写到out
+func (csc *CodeServerClient) StreamRefs(symbol, mode string, out io.Writer) error {
+	reqBody := map[string]string{
+		"symbol": symbol,
+	}
+	if mode != "" {
+		reqBody["mode"] = mode
+	}
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	url := fmt.Sprintf("%s/api/find_refs?stream=true", csc.BaseURL)
+	resp, err := csc.HTTPClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to find refs: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("find refs failed with status %d: %s", resp.StatusCode, string(body))
 	}
-	fmt.Print(string(body))
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
 	return nil
 }
 
@@ -323,8 +783,7 @@ func (btp *BatchTaskPublisher) WaitForBatchTasksCompletion(taskID string, maxRet
 			return fmt.Errorf("failed to get task status: %v", err)
 		}
 
-		if !status.Exists {
-			// 任务不存在，说明已完成
+		if status.finished() {
 			return nil
 		}
 
@@ -336,6 +795,51 @@ func (btp *BatchTaskPublisher) WaitForBatchTasksCompletion(taskID string, maxRet
 	return fmt.Errorf("batch tasks did not complete within %d retries", maxRetries)
 }
 
+// readPromptText 读取提示词内容，文件参数优先于直接传入的文本
+func readPromptText(text, file string) (string, error) {
+	if file == "" {
+		return text, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read prompt file %s: %v", file, err)
+	}
+	return string(data), nil
+}
+
+// PublisherSettings 发布器的本地连接设置
+type PublisherSettings struct {
+	ExecutorURL string `json:"executor_url"`
+	AuthToken   string `json:"auth_token"`
+}
+
+// loadPublisherSettings 加载发布器设置文件，未指定路径时使用~/.code_server.json且允许文件不存在
+func loadPublisherSettings(path string) (*PublisherSettings, error) {
+	settings := &PublisherSettings{}
+
+	explicit := path != ""
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return settings, nil
+		}
+		path = filepath.Join(home, ".code_server.json")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return settings, nil
+		}
+		return nil, fmt.Errorf("failed to read settings file %s: %v", path, err)
+	}
+
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("failed to parse settings file %s: %v", path, err)
+	}
+	return settings, nil
+}
+
 // ensureURLProtocol ensures that a URL has the proper protocol prefix
 func ensureURLProtocol(url string) string {
 	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
@@ -344,64 +848,211 @@ func ensureURLProtocol(url string) string {
 	return "http://" + url
 }
 
+// version 构建时通过-ldflags "-X main.version=..."注入的版本号
+var version = "dev"
+
+// VersionInfo version子命令输出的版本信息
+type VersionInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+// buildVersion 收集版本号、Go版本和构建时记录的VCS修订
+func buildVersion() VersionInfo {
+	info := VersionInfo{Version: version, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Revision = setting.Value
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+// String 版本信息的文本形式
+func (v VersionInfo) String() string {
+	text := fmt.Sprintf("task_publisher %s %s", v.Version, v.GoVersion)
+	if v.Revision != "" {
+		text += " revision " + v.Revision
+		if v.Modified {
+			text += "-dirty"
+		}
+	}
+	return text
+}
+
+// llmConfigListing list llm --json输出的LLM配置，同名的空APIKey字段覆盖内嵌配置中的api_key，输出中不包含API key
+type llmConfigListing struct {
+	types.NamedLLMConfig
+	APIKey string `json:"api_key,omitempty"`
+}
+
+// printJSON 以缩进的JSON格式输出到stdout
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding output: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// infof 输出面向用户的提示信息，--json模式下不输出
+func infof(format string, args ...interface{}) {
+	if !jsonOutput {
+		fmt.Printf(format, args...)
+	}
+}
+
+// fatalf 输出错误信息并退出，--json模式下输出{"error": "..."}
+func fatalf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if jsonOutput {
+		printJSON(map[string]string{"error": msg})
+	} else {
+		fmt.Println(msg)
+	}
+	os.Exit(1)
+}
+
 func main() {
+	// 解析全局参数，子命令及其参数在全局参数之后
+	configPath := flag.String("config", "", "Publisher settings file (default: ~/.code_server.json)")
+	executorFlag := flag.String("executor-url", "", "Task executor URL (overrides EXECUTOR_URL and settings file)")
+	authTokenFlag := flag.String("auth-token", "", "Auth token for the executor (overrides EXECUTOR_AUTH_TOKEN and settings file)")
+	flag.IntVar(&httpRetries, "retries", 3, "Retries with exponential backoff on connection errors and 5xx responses")
+	flag.BoolVar(&jsonOutput, "json", false, "Print structured JSON to stdout instead of human-readable text")
+	flag.Parse()
+	args := flag.Args()
+
 	// 检查是否有足够的参数
-	if len(os.Args) < 2 {
+	if len(args) < 1 {
+		if jsonOutput {
+			fatalf("Error: subcommand is required")
+		}
 		fmt.Printf("Usage:\n")
+		fmt.Printf("  task_publisher [--config path] [--executor-url url] [--auth-token token] [--retries n] [--json] <subcommand> ...\n")
+		fmt.Printf("  task_publisher version\n")
 		fmt.Printf("  task_publisher list llm\n")
 		fmt.Printf("  task_publisher list code\n")
-		fmt.Printf("  task_publisher submit --system-prompt xxx --user-prompt xxx --code-server xxx --llm-config xxx --id xxx\n")
+		fmt.Printf("  task_publisher submit --system-prompt xxx --user-prompt xxx --code-server xxx --llm-config xxx --id xxx [--wait [--timeout 10m] [--interval 5s] [--out path]]\n")
 		fmt.Printf("  task_publisher submit --system-prompt-b64 xxx --user-prompt-b64 xxx --code-server xxx --llm-config xxx --id xxx\n")
-		fmt.Printf("  task_publisher get_sym [symbol_name] --code-server name\n")
-		fmt.Printf("  task_publisher find_refs [symbol_name] --code-server name\n")
+		fmt.Printf("  task_publisher submit --system-prompt-file path --user-prompt-file path --code-server xxx --llm-config xxx --id xxx\n")
+		fmt.Printf("  task_publisher get_sym [symbol_name] --code-server name [--file path]\n")
+		fmt.Printf("  task_publisher find_refs [symbol_name] --code-server name [--mode mode] [--stream]\n")
+		fmt.Printf("  task_publisher results list [--page n] [--limit n] [--sort created_desc|created_asc|name_asc|name_desc]\n")
+		fmt.Printf("  task_publisher results get [file] [--out path]\n")
+		fmt.Printf("  task_publisher results delete [file]\n")
+		fmt.Printf("  task_publisher results reindex\n")
+		fmt.Printf("  task_publisher results rerun [task_id] [--index n]\n")
+		fmt.Printf("  task_publisher prompt list\n")
+		fmt.Printf("  task_publisher prompt create --name xxx --system-file path --user-file path\n")
+		fmt.Printf("  task_publisher prompt update --name xxx [--system-file path] [--user-file path]\n")
+		fmt.Printf("  task_publisher prompt delete --name xxx\n")
+		fmt.Printf("  task_publisher prompt history --name xxx\n")
+		fmt.Printf("  task_publisher prompt rollback --name xxx --version xxx\n")
+		fmt.Printf("  task_publisher config set-llm --name xxx --api-key xxx --base-url xxx --model xxx [--provider openai|local]\n")
+		fmt.Printf("  task_publisher config set-code --name xxx --url xxx\n")
+		fmt.Printf("  task_publisher config delete --type [llm|code_server] --name xxx\n")
+		fmt.Printf("  task_publisher config reload\n")
 		os.Exit(1)
 	}
 
 	// 获取子命令
-	subcommand := os.Args[1]
+	subcommand := args[0]
+
+	// version不需要连接执行器
+	if subcommand == "version" {
+		info := buildVersion()
+		if jsonOutput {
+			printJSON(info)
+		} else {
+			fmt.Println(info)
+		}
+		return
+	}
+
+	// 连接设置优先级：命令行参数 > 环境变量 > 配置文件 > 默认值
+	settings, err := loadPublisherSettings(*configPath)
+	if err != nil {
+		fatalf("Error loading settings: %v", err)
+	}
 
-	// 从环境变量获取executor URL
-	executorURL := os.Getenv("EXECUTOR_URL")
+	executorURL := settings.ExecutorURL
+	if env := os.Getenv("EXECUTOR_URL"); env != "" {
+		executorURL = env
+	}
+	if *executorFlag != "" {
+		executorURL = *executorFlag
+	}
 	if executorURL == "" {
 		executorURL = "http://localhost:8080" // 默认值
 	}
 
+	authToken := settings.AuthToken
+	if env := os.Getenv("EXECUTOR_AUTH_TOKEN"); env != "" {
+		authToken = env
+	}
+	if *authTokenFlag != "" {
+		authToken = *authTokenFlag
+	}
+
 	// 创建任务发布器
 	publisher := NewTaskPublisher(executorURL)
+	publisher.SetAuthToken(authToken)
 
 	// 根据子命令处理不同的参数
 	switch subcommand {
 	case "list":
-		if len(os.Args) < 3 {
-			fmt.Printf("Usage: task_publisher list [llm|code]\n")
-			os.Exit(1)
+		if len(args) < 2 {
+			fatalf("Usage: task_publisher list [llm|code]")
 		}
-		listType := os.Args[2]
+		listType := args[1]
 
 		// 从executor获取配置
 		config, err := publisher.GetConfig()
 		if err != nil {
-			fmt.Printf("Error getting config from executor: %v\n", err)
-			os.Exit(1)
+			fatalf("Error getting config from executor: %v", err)
 		}
 
 		switch listType {
 		case "llm":
-			// 列出LLM配置
+			// 列出LLM配置，JSON输出中不包含API key
+			if jsonOutput {
+				llmConfigs := make([]llmConfigListing, 0, len(config.LLMConfigs))
+				for _, llmConfig := range config.LLMConfigs {
+					llmConfigs = append(llmConfigs, llmConfigListing{NamedLLMConfig: llmConfig})
+				}
+				printJSON(llmConfigs)
+				break
+			}
 			fmt.Println("=== LLM Configurations ===")
 			for _, llmConfig := range config.LLMConfigs {
 				fmt.Printf("%s: %s (%s)\n", llmConfig.Name, llmConfig.Model, llmConfig.BaseURL)
 			}
 		case "code":
 			// 列出CodeServer配置
+			if jsonOutput {
+				codeServers := config.CodeServers
+				if codeServers == nil {
+					codeServers = []types.CodeServer{}
+				}
+				printJSON(codeServers)
+				break
+			}
 			fmt.Println("=== Code Server Configurations ===")
 			for _, codeServer := range config.CodeServers {
 				fmt.Printf("%s: %s\n", codeServer.Name, codeServer.URL)
 			}
 		default:
-			fmt.Printf("Error: unknown list type '%s'\n", listType)
-			fmt.Printf("Available list types: llm, code\n")
-			os.Exit(1)
+			fatalf("Error: unknown list type '%s'\nAvailable list types: llm, code", listType)
 		}
 
 	case "submit":
@@ -411,12 +1062,19 @@ func main() {
 		userPrompt := flagSet.String("user-prompt", "", "User prompt for the task")
 		systemPromptB64 := flagSet.String("system-prompt-b64", "", "System prompt in base64")
 		userPromptB64 := flagSet.String("user-prompt-b64", "", "User prompt in base64")
+		systemPromptFile := flagSet.String("system-prompt-file", "", "Read system prompt from file")
+		userPromptFile := flagSet.String("user-prompt-file", "", "Read user prompt from file")
 		codeServerName := flagSet.String("code-server", "default", "Code server name")
 		llmConfigName := flagSet.String("llm-config", "default", "LLM configuration name")
 		id := flagSet.String("id", "", "Task ID")
+		labels := flagSet.String("labels", "", "Comma separated task labels")
+		wait := flagSet.Bool("wait", false, "Block until the task finishes and print its result")
+		timeout := flagSet.Duration("timeout", 10*time.Minute, "With --wait, how long to wait for the task")
+		interval := flagSet.Duration("interval", 5*time.Second, "With --wait, how often to poll the task status")
+		out := flagSet.String("out", "", "With --wait, save the task result JSON to this file")
 
 		// 解析参数，跳过前两个参数（程序名和子命令）
-		flagSet.Parse(os.Args[2:])
+		flagSet.Parse(args[1:])
 
 		// 处理base64编码的参数
 		finalSystemPrompt := *systemPrompt
@@ -425,8 +1083,7 @@ func main() {
 		if *systemPromptB64 != "" {
 			decoded, err := base64.StdEncoding.DecodeString(*systemPromptB64)
 			if err != nil {
-				fmt.Printf("Error decoding system prompt: %v\n", err)
-				os.Exit(1)
+				fatalf("Error decoding system prompt: %v", err)
 			}
 			finalSystemPrompt = string(decoded)
 		}
@@ -434,60 +1091,140 @@ func main() {
 		if *userPromptB64 != "" {
 			decoded, err := base64.StdEncoding.DecodeString(*userPromptB64)
 			if err != nil {
-				fmt.Printf("Error decoding user prompt: %v\n", err)
-				os.Exit(1)
+				fatalf("Error decoding user prompt: %v", err)
 			}
 			finalUserPrompt = string(decoded)
 		}
 
+		// 文件参数优先级最高：file > b64 > 明文
+		if *systemPromptFile != "" {
+			text, err := readPromptText("", *systemPromptFile)
+			if err != nil {
+				fatalf("Error reading system prompt: %v", err)
+			}
+			finalSystemPrompt = text
+		}
+
+		if *userPromptFile != "" {
+			text, err := readPromptText("", *userPromptFile)
+			if err != nil {
+				fatalf("Error reading user prompt: %v", err)
+			}
+			finalUserPrompt = text
+		}
+
 		if finalSystemPrompt == "" || finalUserPrompt == "" {
-			fmt.Printf("Error: system-prompt and user-prompt are required for submit action\n")
-			os.Exit(1)
+			fatalf("Error: system-prompt and user-prompt are required for submit action")
 		}
 
-		fmt.Printf("Submitting task to executor: %s\n", executorURL)
-		fmt.Printf("Code server: %s\n", *codeServerName)
-		fmt.Printf("LLM config: %s\n", *llmConfigName)
+		infof("Submitting task to executor: %s\n", executorURL)
+		infof("Code server: %s\n", *codeServerName)
+		infof("LLM config: %s\n", *llmConfigName)
 
 		// 提交任务
-		task := Task{
+		task := types.Task{
 			ID:             *id,
 			SystemPrompt:   finalSystemPrompt,
 			UserPrompt:     finalUserPrompt,
 			CodeServerName: *codeServerName,
 			LLMConfigName:  *llmConfigName,
 		}
+		for _, label := range strings.Split(*labels, ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				task.Labels = append(task.Labels, label)
+			}
+		}
 
 		// 提交任务
 		resp, err := publisher.SubmitTask(task)
 		if err != nil {
-			fmt.Printf("Error submitting task: %v\n", err)
+			fatalf("Error submitting task: %v", err)
+		}
+
+		infof("\nTask submitted successfully!\n")
+		infof("Task ID: %s\n", resp.TaskID)
+		infof("Status: %s\n", resp.Status)
+
+		output := SubmitOutput{TaskID: resp.TaskID, Status: resp.Status, Message: resp.Message}
+		if !*wait {
+			if jsonOutput {
+				printJSON(output)
+			}
+			break
+		}
+
+		// 等待任务结束并获取结果
+		if *interval <= 0 {
+			*interval = time.Second
+		}
+		maxRetries := int(*timeout / *interval)
+		if maxRetries < 1 {
+			maxRetries = 1
+		}
+		infof("\nWaiting for task %s to finish...\n", resp.TaskID)
+		state, err := publisher.WaitForTaskCompletion(resp.TaskID, maxRetries, *interval)
+		if err != nil {
+			fatalf("Error waiting for task: %v", err)
+		}
+		output.State = state
+		if state == TaskStateFailed {
+			if jsonOutput {
+				printJSON(output)
+			} else {
+				fmt.Printf("Task %s failed\n", resp.TaskID)
+			}
 			os.Exit(1)
 		}
 
-		fmt.Printf("\nTask submitted successfully!\n")
-		fmt.Printf("Task ID: %s\n", resp.TaskID)
-		fmt.Printf("Status: %s\n", resp.Status)
+		result, err := publisher.GetTaskResult(resp.TaskID)
+		if err != nil {
+			fatalf("Error getting task result: %v", err)
+		}
+		output.Result = result
+		infof("Result status: %s\n", result.Status)
+		infof("Tag: %s\n", result.Tag)
+		infof("Has problem: %v\n", result.HasProblemInfo)
+		if result.Error != "" {
+			infof("Error: %s\n", result.Error)
+		}
 
-	case "get_sym":
-		if len(os.Args) < 3 {
-			fmt.Printf("Usage: task_publisher get_sym [symbol_name] --code-server name\n")
+		if *out != "" {
+			data, err := json.MarshalIndent(result, "", "  ")
+			if err != nil {
+				fatalf("Error encoding task result: %v", err)
+			}
+			if err := os.WriteFile(*out, data, 0644); err != nil {
+				fatalf("Error writing task result: %v", err)
+			}
+			output.SavedTo = *out
+			infof("Result saved to %s\n", *out)
+		}
+		if jsonOutput {
+			printJSON(output)
+		}
+		// 超时、被中断或对话轮数耗尽的任务没有完整结论
+		if result.Status != "" && result.Status != TaskStateCompleted {
 			os.Exit(1)
 		}
 
+	case "get_sym":
+		if len(args) < 2 {
+			fatalf("Usage: task_publisher get_sym [symbol_name] --code-server name [--file path]")
+		}
+
 		// 解析get_sym命令的参数
 		flagSet := flag.NewFlagSet("get_sym", flag.ExitOnError)
 		codeServerName := flagSet.String("code-server", "default", "Code server name")
+		fileName := flagSet.String("file", "", "Only look up the symbol in this file")
 
 		// 解析参数，跳过前两个参数（程序名和子命令），第三个参数是symbol_name
-		flagSet.Parse(os.Args[3:])
-		symbolName := os.Args[2]
+		flagSet.Parse(args[2:])
+		symbolName := args[1]
 
 		// 从executor获取配置
 		config, err := publisher.GetConfig()
 		if err != nil {
-			fmt.Printf("Error getting config from executor: %v\n", err)
-			os.Exit(1)
+			fatalf("Error getting config from executor: %v", err)
 		}
 
 		// 查找code server URL
@@ -500,8 +1237,7 @@ func main() {
 		}
 
 		if codeServerURL == "" {
-			fmt.Printf("Error: code server '%s' not found\n", *codeServerName)
-			os.Exit(1)
+			fatalf("Error: code server '%s' not found", *codeServerName)
 		}
 
 		// 确保URL有协议前缀
@@ -511,31 +1247,35 @@ func main() {
 		codeServerClient := NewCodeServerClient(codeServerURL)
 
 		// 获取符号信息
-		err = codeServerClient.GetSymbolInfo(symbolName)
+		body, err := codeServerClient.GetSymbolInfo(symbolName, *fileName)
 		if err != nil {
-			fmt.Println("Error getting symbol info: %v\n", err)
-			os.Exit(1)
+			fatalf("Error getting symbol info: %v", err)
+		}
+		if jsonOutput {
+			printJSON(json.RawMessage(body))
+			break
 		}
+		fmt.Print(string(body))
 
 	case "find_refs":
-		if len(os.Args) < 3 {
-			fmt.Printf("Usage: task_publisher find_refs [symbol_name] --code-server name\n")
-			os.Exit(1)
+		if len(args) < 2 {
+			fatalf("Usage: task_publisher find_refs [symbol_name] --code-server name [--mode symbol_refs|refs|symbols|defs] [--stream]")
 		}
 
 		// 解析find_refs命令的参数
 		flagSet := flag.NewFlagSet("find_refs", flag.ExitOnError)
 		codeServerName := flagSet.String("code-server", "default", "Code server name")
+		mode := flagSet.String("mode", "", "Reference mode: symbol_refs (default), refs, symbols or defs")
+		stream := flagSet.Bool("stream", false, "Print callers as newline-delimited JSON as soon as the code server resolves them")
 
 		// 解析参数，跳过前两个参数（程序名和子命令），第三个参数是symbol_name
-		flagSet.Parse(os.Args[3:])
-		symbolName := os.Args[2]
+		flagSet.Parse(args[2:])
+		symbolName := args[1]
 
 		// 从executor获取配置
 		config, err := publisher.GetConfig()
 		if err != nil {
-			fmt.Printf("Error getting config from executor: %v\n", err)
-			os.Exit(1)
+			fatalf("Error getting config from executor: %v", err)
 		}
 
 		// 查找code server URL
@@ -548,8 +1288,7 @@ func main() {
 		}
 
 		if codeServerURL == "" {
-			fmt.Printf("Error: code server '%s' not found\n", *codeServerName)
-			os.Exit(1)
+			fatalf("Error: code server '%s' not found", *codeServerName)
 		}
 
 		// 确保URL有协议前缀
@@ -558,16 +1297,390 @@ func main() {
 		// 创建code server客户端
 		codeServerClient := NewCodeServerClient(codeServerURL)
 
+		// 流式输出本身就是逐行的JSON，--json时原样输出
+		if *stream {
+			if err := codeServerClient.StreamRefs(symbolName, *mode, os.Stdout); err != nil {
+				fatalf("Error finding refs: %v", err)
+			}
+			break
+		}
+
 		// 获取所有引用
-		err = codeServerClient.FindAllRefs(symbolName)
+		body, err := codeServerClient.FindAllRefs(symbolName, *mode)
 		if err != nil {
-			fmt.Printf("Error finding refs: %v\n", err)
-			os.Exit(1)
+			fatalf("Error finding refs: %v", err)
+		}
+		if jsonOutput {
+			printJSON(json.RawMessage(body))
+			break
+		}
+		fmt.Print(string(body))
+
+	case "results":
+		if len(args) < 2 {
+			fatalf("Usage: task_publisher results [list|get|delete|reindex|rerun]")
+		}
+		action := args[1]
+
+		switch action {
+		case "list":
+			flagSet := flag.NewFlagSet("results list", flag.ExitOnError)
+			page := flagSet.Int("page", 0, "Page number, starting from 1 (default: all results)")
+			limit := flagSet.Int("limit", 0, "Results per page, at most 100 (default 10 when --page is given)")
+			sortBy := flagSet.String("sort", "", "Sort order: created_desc (default), created_asc, name_asc, name_desc")
+			flagSet.Parse(args[2:])
+
+			list, err := publisher.ListResults(*page, *limit, *sortBy)
+			if err != nil {
+				fatalf("Error listing results: %v", err)
+			}
+
+			if jsonOutput {
+				// 不分页时保持输出结果文件名数组
+				if *page == 0 && *limit == 0 {
+					printJSON(list.Results)
+				} else {
+					printJSON(list)
+				}
+				break
+			}
+			fmt.Println("=== Results ===")
+			for _, result := range list.Results {
+				fmt.Println(result)
+			}
+			if *page > 0 || *limit > 0 {
+				fmt.Printf("Page %d/%d, %d result(s) in total\n", list.Page, list.TotalPages, list.Total)
+			}
+
+		case "get":
+			if len(args) < 3 {
+				fatalf("Usage: task_publisher results get [file] [--out path]")
+			}
+
+			// 解析results get命令的参数，第四个参数是文件名
+			flagSet := flag.NewFlagSet("results get", flag.ExitOnError)
+			outPath := flagSet.String("out", "", "Output file path (default: stdout)")
+			flagSet.Parse(args[3:])
+			fileName := args[2]
+
+			data, err := publisher.ExportResult(fileName)
+			if err != nil {
+				fatalf("Error getting result: %v", err)
+			}
+
+			if *outPath == "" {
+				if jsonOutput {
+					printJSON(json.RawMessage(data))
+					break
+				}
+				os.Stdout.Write(data)
+				break
+			}
+
+			if err := os.WriteFile(*outPath, data, 0644); err != nil {
+				fatalf("Error writing result to %s: %v", *outPath, err)
+			}
+			if jsonOutput {
+				printJSON(ActionOutput{Status: "saved", Name: fileName, SavedTo: *outPath})
+				break
+			}
+			fmt.Printf("Result saved to %s\n", *outPath)
+
+		case "delete":
+			if len(args) < 3 {
+				fatalf("Usage: task_publisher results delete [file]")
+			}
+			fileName := args[2]
+
+			if err := publisher.DeleteResult(fileName); err != nil {
+				fatalf("Error deleting result: %v", err)
+			}
+			if jsonOutput {
+				printJSON(ActionOutput{Status: "deleted", Name: fileName})
+				break
+			}
+			fmt.Printf("Result %s deleted\n", fileName)
+
+		case "reindex":
+			files, total, err := publisher.RebuildResultIndex()
+			if err != nil {
+				fatalf("Error rebuilding result index: %v", err)
+			}
+			if jsonOutput {
+				printJSON(map[string]int{"files": files, "results": total})
+				break
+			}
+			fmt.Printf("Indexed %d result(s) in %d result file(s)\n", total, files)
+
+		case "rerun":
+			if len(args) < 3 {
+				fatalf("Usage: task_publisher results rerun [task_id] [--index n]")
+			}
+			flagSet := flag.NewFlagSet("results rerun", flag.ExitOnError)
+			index := flagSet.Int("index", -1, "Result entry whose input is reused (default: the latest one with stored input)")
+			flagSet.Parse(args[3:])
+			// 也接受结果文件名
+			taskID := strings.TrimSuffix(args[2], ".json")
+
+			if err := publisher.RerunTask(taskID, *index); err != nil {
+				fatalf("Error re-running task: %v", err)
+			}
+			if jsonOutput {
+				printJSON(SubmitOutput{TaskID: taskID, Status: "success", Message: "Task re-submitted"})
+				break
+			}
+			fmt.Printf("Task %s re-submitted\n", taskID)
+
+		default:
+			fatalf("Error: unknown results action '%s'\nAvailable results actions: list, get, delete, reindex, rerun", action)
+		}
+
+	case "prompt":
+		if len(args) < 2 {
+			fatalf("Usage: task_publisher prompt [list|create|update|delete|history|rollback]")
+		}
+		action := args[1]
+
+		// 解析prompt命令的参数，跳过前三个参数（程序名、子命令和动作）
+		flagSet := flag.NewFlagSet("prompt "+action, flag.ExitOnError)
+		name := flagSet.String("name", "", "Prompt template name")
+		system := flagSet.String("system", "", "System prompt text")
+		user := flagSet.String("user", "", "Init user prompt text")
+		systemFile := flagSet.String("system-file", "", "Read system prompt from file")
+		userFile := flagSet.String("user-file", "", "Read init user prompt from file")
+		version := flagSet.String("version", "", "History version to roll back to")
+		flagSet.Parse(args[2:])
+
+		switch action {
+		case "list":
+			prompts, err := publisher.ListPrompts()
+			if err != nil {
+				fatalf("Error listing prompts: %v", err)
+			}
+
+			if jsonOutput {
+				if prompts == nil {
+					prompts = []PromptInfo{}
+				}
+				printJSON(prompts)
+				break
+			}
+			fmt.Println("=== Prompt Templates ===")
+			for _, prompt := range prompts {
+				fmt.Println(prompt.Name)
+			}
+
+		case "create", "update":
+			if *name == "" {
+				fatalf("Error: --name is required for prompt %s", action)
+			}
+
+			systemText, err := readPromptText(*system, *systemFile)
+			if err != nil {
+				fatalf("Error: %v", err)
+			}
+			userText, err := readPromptText(*user, *userFile)
+			if err != nil {
+				fatalf("Error: %v", err)
+			}
+
+			prompt := PromptInfo{Name: *name, System: systemText, InitUser: userText}
+
+			if action == "create" {
+				if prompt.System == "" || prompt.InitUser == "" {
+					fatalf("Error: system and user prompts are required for prompt create")
+				}
+				warnings, err := publisher.CreatePrompt(prompt)
+				if err != nil {
+					fatalf("Error creating prompt: %v", err)
+				}
+				if jsonOutput {
+					printJSON(ActionOutput{Status: "created", Name: *name, Warnings: warnings})
+					break
+				}
+				for _, warning := range warnings {
+					fmt.Printf("Warning: %s\n", warning)
+				}
+				fmt.Printf("Prompt %s created\n", *name)
+				break
+			}
+
+			// 更新时未指定的部分沿用现有模板内容
+			if prompt.System == "" || prompt.InitUser == "" {
+				prompts, err := publisher.ListPrompts()
+				if err != nil {
+					fatalf("Error listing prompts: %v", err)
+				}
+				for _, existing := range prompts {
+					if existing.Name != *name {
+						continue
+					}
+					if prompt.System == "" {
+						prompt.System = existing.System
+					}
+					if prompt.InitUser == "" {
+						prompt.InitUser = existing.InitUser
+					}
+					break
+				}
+			}
+			warnings, err := publisher.UpdatePrompt(prompt)
+			if err != nil {
+				fatalf("Error updating prompt: %v", err)
+			}
+			if jsonOutput {
+				printJSON(ActionOutput{Status: "updated", Name: *name, Warnings: warnings})
+				break
+			}
+			for _, warning := range warnings {
+				fmt.Printf("Warning: %s\n", warning)
+			}
+			fmt.Printf("Prompt %s updated\n", *name)
+
+		case "delete":
+			if *name == "" {
+				fatalf("Error: --name is required for prompt delete")
+			}
+			if err := publisher.DeletePrompt(*name); err != nil {
+				fatalf("Error deleting prompt: %v", err)
+			}
+			if jsonOutput {
+				printJSON(ActionOutput{Status: "deleted", Name: *name})
+				break
+			}
+			fmt.Printf("Prompt %s deleted\n", *name)
+
+		case "history":
+			if *name == "" {
+				fatalf("Error: --name is required for prompt history")
+			}
+			versions, err := publisher.PromptHistory(*name)
+			if err != nil {
+				fatalf("Error getting prompt history: %v", err)
+			}
+
+			if jsonOutput {
+				if versions == nil {
+					versions = []PromptVersion{}
+				}
+				printJSON(versions)
+				break
+			}
+			fmt.Printf("=== History of %s ===\n", *name)
+			for _, v := range versions {
+				fmt.Println(v.Version)
+			}
+
+		case "rollback":
+			if *name == "" || *version == "" {
+				fatalf("Error: --name and --version are required for prompt rollback")
+			}
+			if err := publisher.RollbackPrompt(*name, *version); err != nil {
+				fatalf("Error rolling back prompt: %v", err)
+			}
+			if jsonOutput {
+				printJSON(ActionOutput{Status: "rolled_back", Name: *name, Version: *version})
+				break
+			}
+			fmt.Printf("Prompt %s rolled back to %s\n", *name, *version)
+
+		default:
+			fatalf("Error: unknown prompt action '%s'\nAvailable prompt actions: list, create, update, delete, history, rollback", action)
+		}
+
+	case "config":
+		if len(args) < 2 {
+			fatalf("Usage: task_publisher config [set-llm|set-code|delete|reload]")
+		}
+		action := args[1]
+
+		// 解析config命令的参数，跳过前三个参数（程序名、子命令和动作）
+		flagSet := flag.NewFlagSet("config "+action, flag.ExitOnError)
+		name := flagSet.String("name", "", "Config name")
+		apiKey := flagSet.String("api-key", "", "LLM API key")
+		baseURL := flagSet.String("base-url", "", "LLM base URL")
+		model := flagSet.String("model", "", "LLM model name")
+		provider := flagSet.String("provider", "", "LLM provider: openai (default) or local (Ollama/llama.cpp, no API key needed)")
+		url := flagSet.String("url", "", "Code server URL (host:port)")
+		configType := flagSet.String("type", "", "Config type to delete: llm or code_server")
+		flagSet.Parse(args[2:])
+
+		if *name == "" && action != "reload" {
+			fatalf("Error: --name is required for config %s", action)
+		}
+
+		switch action {
+		case "reload":
+			result, err := publisher.ReloadConfig()
+			if err != nil {
+				fatalf("Error reloading config: %v", err)
+			}
+			if jsonOutput {
+				printJSON(result)
+				break
+			}
+			if result.Changed {
+				fmt.Printf("Config reloaded\n")
+			} else {
+				fmt.Printf("Config unchanged\n")
+			}
+			fmt.Printf("LLM configs: %s (usable: %s)\n", strings.Join(result.LLMConfigs, ", "), strings.Join(result.UsableLLMConfigs, ", "))
+			fmt.Printf("Code servers: %s\n", strings.Join(result.CodeServers, ", "))
+			if result.Warning != "" {
+				fmt.Printf("Warning: %s\n", result.Warning)
+			}
+
+		case "set-llm":
+			if *baseURL == "" || *model == "" {
+				fatalf("Error: --base-url and --model are required for config set-llm")
+			}
+			llmConfig := types.NamedLLMConfig{
+				Name:     *name,
+				APIKey:   *apiKey,
+				BaseURL:  *baseURL,
+				Model:    *model,
+				Provider: *provider,
+			}
+			if err := publisher.UpdateLLMConfig(llmConfig); err != nil {
+				fatalf("Error updating LLM config: %v", err)
+			}
+			if jsonOutput {
+				printJSON(ActionOutput{Status: "saved", Type: "llm", Name: *name})
+				break
+			}
+			fmt.Printf("LLM config %s saved\n", *name)
+
+		case "set-code":
+			if *url == "" {
+				fatalf("Error: --url is required for config set-code")
+			}
+			if err := publisher.UpdateCodeServer(types.CodeServer{Name: *name, URL: *url}); err != nil {
+				fatalf("Error updating code server: %v", err)
+			}
+			if jsonOutput {
+				printJSON(ActionOutput{Status: "saved", Type: "code_server", Name: *name})
+				break
+			}
+			fmt.Printf("Code server %s saved\n", *name)
+
+		case "delete":
+			if *configType != "llm" && *configType != "code_server" {
+				fatalf("Error: --type must be llm or code_server")
+			}
+			if err := publisher.DeleteConfig(*configType, *name); err != nil {
+				fatalf("Error deleting config: %v", err)
+			}
+			if jsonOutput {
+				printJSON(ActionOutput{Status: "deleted", Type: *configType, Name: *name})
+				break
+			}
+			fmt.Printf("Config %s (%s) deleted\n", *name, *configType)
+
+		default:
+			fatalf("Error: unknown config action '%s'\nAvailable config actions: set-llm, set-code, delete, reload", action)
 		}
 
 	default:
-		fmt.Printf("Error: unknown subcommand '%s'\n", subcommand)
-		fmt.Printf("Available subcommands: list, submit, get_sym, find_refs\n")
-		os.Exit(1)
+		fatalf("Error: unknown subcommand '%s'\nAvailable subcommands: version, list, submit, get_sym, find_refs, results, prompt, config", subcommand)
 	}
 }
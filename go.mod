@@ -1,3 +1,10 @@
 module github.com/lometsj/code_server
 
 go 1.22.2
+
+require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/gorilla/websocket v1.5.3
+)
+
+require golang.org/x/sys v0.4.0 // indirect
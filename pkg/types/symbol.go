@@ -0,0 +1,132 @@
+// Package types 定义code_server、task_executor和task_publisher之间传递的请求和响应结构。
+// 三个程序引用同一份定义，接口格式不会在各自的副本中悄悄分叉
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// SymbolInfo 一个符号的定义
+type SymbolInfo struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Line    int    `json:"line"`
+	End     int    `json:"end"`
+	Content string `json:"content"`
+	File    string `json:"file"`
+	Typeref string `json:"typeref,omitempty"`
+	// Repo 符号所在的代码仓库名称
+	Repo string `json:"repo,omitempty"`
+	// LineShift 标签过期时实际内容相对索引行号的偏移量
+	LineShift int `json:"line_shift,omitempty"`
+	// ResolvedFrom 经typeref解析到当前定义时依次经过的符号
+	ResolvedFrom []string `json:"resolved_from,omitempty"`
+	// Truncated Content超过--max-snippet-lines被截断，Line和End仍为完整定义的范围
+	Truncated bool `json:"truncated,omitempty"`
+
+	// fields 序列化时只输出的JSON字段，为空时输出全部字段
+	fields []string
+}
+
+// SymbolInfoFields SymbolInfo的全部JSON字段，按输出顺序排列，即get_symbol的fields可选的值
+var SymbolInfoFields = []string{"name", "kind", "line", "end", "content", "file", "typeref", "repo", "line_shift", "resolved_from", "truncated"}
+
+// SelectFields 返回序列化时只输出fields中字段的副本，fields为空时输出全部字段
+func (s SymbolInfo) SelectFields(fields []string) SymbolInfo {
+	s.fields = fields
+	return s
+}
+
+// MarshalJSON 选择了字段时只输出这些字段，值为空且带omitempty的字段仍然省略
+func (s SymbolInfo) MarshalJSON() ([]byte, error) {
+	type plain SymbolInfo
+	data, err := json.Marshal(plain(s))
+	if err != nil || len(s.fields) == 0 {
+		return data, err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	selected := make(map[string]bool, len(s.fields))
+	for _, field := range s.fields {
+		selected[field] = true
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, name := range SymbolInfoFields {
+		value, ok := all[name]
+		if !ok || !selected[name] {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(name)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// SymbolResponse get_symbol和get_symbol_at的响应
+type SymbolResponse struct {
+	Status  string       `json:"status"`
+	ResList []SymbolInfo `json:"res_list,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// RefResponse find_refs的响应
+type RefResponse struct {
+	Callers []string `json:"callers"`
+	// CallerRefs 与Callers一一对应，记录每个调用者中global匹配到的引用
+	CallerRefs [][]RefMatch `json:"caller_refs"`
+	// CallerRanges 与Callers一一对应，记录每个调用者代码在文件中的完整范围
+	CallerRanges []CodeRange `json:"caller_ranges"`
+	// Total 去重后的调用者总数，分页时可能大于len(Callers)
+	Total int `json:"total"`
+	// Warnings 无法读取代码而跳过的引用及查询失败的仓库，不为空时结果可能不完整
+	Warnings []string `json:"warnings,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// RefStreamCaller 流式find_refs输出的一个调用者。Caller为空的行表示不相邻的同一调用者中的更多引用，
+// 应合并到之前输出的第Index个调用者
+type RefStreamCaller struct {
+	Index  int        `json:"index"`
+	Caller string     `json:"caller,omitempty"`
+	Range  *CodeRange `json:"range,omitempty"`
+	Refs   []RefMatch `json:"refs"`
+}
+
+// RefStreamEnd 流式find_refs输出的最后一行
+type RefStreamEnd struct {
+	Done  bool `json:"done"`
+	Total int  `json:"total"`
+	// Warnings 与RefResponse.Warnings相同
+	Warnings []string `json:"warnings,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// RefMatch global输出的一条引用：匹配到的tag、位置及原始源代码行
+type RefMatch struct {
+	Tag    string `json:"tag"`
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Source string `json:"source"`
+	// Repo 引用所在的代码仓库名称
+	Repo string `json:"repo,omitempty"`
+}
+
+// CodeRange 一段代码在文件中的行范围，Truncated表示返回的内容被截断
+type CodeRange struct {
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	End       int    `json:"end"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
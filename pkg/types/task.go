@@ -0,0 +1,61 @@
+package types
+
+import "time"
+
+// Config 执行器的配置：LLM配置和code server
+type Config struct {
+	LLMConfigs  []NamedLLMConfig `json:"llm_configs"`
+	CodeServers []CodeServer     `json:"code_servers"`
+}
+
+// CodeServer 带名称的code server地址，格式为host:port或unix://socket路径
+type CodeServer struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// NamedLLMConfig 定义带名称的LLM配置结构
+type NamedLLMConfig struct {
+	Name    string `json:"name"`
+	APIKey  string `json:"api_key"`
+	BaseURL string `json:"base_url"`
+	Model   string `json:"model"`
+	// ContextTokens 对话的token上限，为0时使用--context-tokens
+	ContextTokens int `json:"context_tokens,omitempty"`
+	// RateLimit 调用该模型的限流设置，超出时排队等待而不是报错
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+	// ExtraParams 合并到请求体中的额外参数，覆盖同名的默认参数，值为null时删除该默认参数
+	ExtraParams map[string]interface{} `json:"extra_params,omitempty"`
+	// Fallback 可选，该配置认证失败或服务不可用时改用的LLM配置名，可继续指定自己的fallback形成链
+	Fallback string `json:"fallback,omitempty"`
+	// Provider 可选，openai（默认）或local；local用于Ollama、llama.cpp等本地OpenAI兼容服务，不需要api_key且不发送它们不支持的默认参数
+	Provider string `json:"provider,omitempty"`
+}
+
+// LLM服务类型
+const (
+	LLMProviderOpenAI = "openai"
+	LLMProviderLocal  = "local"
+)
+
+// RateLimit 单个LLM配置的限流设置，0表示不限制
+type RateLimit struct {
+	// RequestsPerMinute 每分钟最多发出的请求数，请求按固定间隔均匀放行
+	RequestsPerMinute int `json:"requests_per_minute,omitempty"`
+	// MaxConcurrent 同时进行中的最大请求数
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+}
+
+// Task 提交给执行器的任务
+type Task struct {
+	ID             string   `json:"id"`
+	SystemPrompt   string   `json:"system_prompt"`
+	UserPrompt     string   `json:"user_prompt"`
+	CodeServerName string   `json:"code_server_name"`
+	LLMConfigName  string   `json:"llm_config_name"`
+	Labels         []string `json:"labels,omitempty"`
+	// IdempotencyKey 可选，客户端重试提交时带上相同的key，执行器返回已有任务而不重复执行
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// SubmittedAt 任务进入队列的时间，由执行器设置
+	SubmittedAt time.Time `json:"submitted_at,omitempty"`
+}
@@ -0,0 +1,177 @@
+package types
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTrip 序列化后再解析到同类型的新值，模拟请求在两个程序之间传递
+func roundTrip[T any](t *testing.T, in T) T {
+	t.Helper()
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal %T: %v", in, err)
+	}
+	var out T
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("unmarshal %T from %s: %v", in, data, err)
+	}
+	return out
+}
+
+func TestTaskRoundTrip(t *testing.T) {
+	in := Task{
+		ID:             "task_1",
+		SystemPrompt:   "system",
+		UserPrompt:     "user",
+		CodeServerName: "cs",
+		LLMConfigName:  "llm",
+		Labels:         []string{"team-a", "scan-1"},
+		IdempotencyKey: "key",
+		SubmittedAt:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	if out := roundTrip(t, in); !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+
+	// 发布端按字段名构造的请求必须能被执行器解析
+	var task Task
+	raw := `{"id":"t","system_prompt":"s","user_prompt":"u","code_server_name":"cs","llm_config_name":"llm","labels":["x"]}`
+	if err := json.Unmarshal([]byte(raw), &task); err != nil {
+		t.Fatal(err)
+	}
+	if task.CodeServerName != "cs" || task.LLMConfigName != "llm" || len(task.Labels) != 1 {
+		t.Errorf("unexpected task %+v", task)
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	in := Config{
+		LLMConfigs: []NamedLLMConfig{
+			{
+				Name:          "primary",
+				APIKey:        "${OPENAI_KEY}",
+				BaseURL:       "https://api.example.com/v1",
+				Model:         "qwen3",
+				ContextTokens: 32000,
+				RateLimit:     &RateLimit{RequestsPerMinute: 60, MaxConcurrent: 2},
+				ExtraParams:   map[string]interface{}{"temperature": 0.5, "response_format": nil},
+				Fallback:      "local",
+			},
+			{Name: "local", BaseURL: "http://127.0.0.1:11434/v1", Model: "llama3", Provider: LLMProviderLocal},
+		},
+		CodeServers: []CodeServer{{Name: "cs", URL: "127.0.0.1:8080"}},
+	}
+	if out := roundTrip(t, in); !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+}
+
+func TestNamedLLMConfigAlwaysHasAPIKey(t *testing.T) {
+	// 配置文件和get_config中没有填写的api_key也要输出，便于用户看到需要填写的字段
+	data, err := json.Marshal(NamedLLMConfig{Name: "changeme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"api_key":""`) {
+		t.Errorf("api_key missing from %s", data)
+	}
+}
+
+func TestSymbolResponseRoundTrip(t *testing.T) {
+	in := SymbolResponse{
+		Status: "success",
+		ResList: []SymbolInfo{{
+			Name:         "Config",
+			Kind:         "struct",
+			Line:         10,
+			End:          20,
+			Content:      "struct config {\n};",
+			File:         "config.h",
+			Typeref:      "struct:config",
+			Repo:         "main",
+			LineShift:    2,
+			ResolvedFrom: []string{"Config"},
+			Truncated:    true,
+		}},
+	}
+	if out := roundTrip(t, in); !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+
+	failed := roundTrip(t, SymbolResponse{Status: "failed", Error: "symbol not found"})
+	if failed.Status != "failed" || failed.Error != "symbol not found" || failed.ResList != nil {
+		t.Errorf("unexpected failed response %+v", failed)
+	}
+}
+
+func TestRefResponseRoundTrip(t *testing.T) {
+	in := RefResponse{
+		Callers:      []string{"void f() {\n  g();\n}"},
+		CallerRefs:   [][]RefMatch{{{Tag: "g", File: "a.c", Line: 2, Source: "  g();", Repo: "main"}}},
+		CallerRanges: []CodeRange{{File: "a.c", Line: 1, End: 3, Truncated: true}},
+		Total:        5,
+		Warnings:     []string{"b.c:7: failed to read file"},
+	}
+	if out := roundTrip(t, in); !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+
+	// 没有调用者时callers等字段仍然输出为数组，调用方不需要区分null
+	data, err := json.Marshal(RefResponse{Callers: []string{}, CallerRefs: [][]RefMatch{}, CallerRanges: []CodeRange{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"callers":[],"caller_refs":[],"caller_ranges":[],"total":0}`; string(data) != want {
+		t.Errorf("marshal = %s, want %s", data, want)
+	}
+}
+
+func TestSymbolInfoSelectFields(t *testing.T) {
+	info := SymbolInfo{Name: "main", Kind: "function", Line: 3, End: 9, Content: "int main() {}", File: "main.c"}
+
+	tests := []struct {
+		name   string
+		fields []string
+		want   string
+	}{
+		{"all fields", nil, `{"name":"main","kind":"function","line":3,"end":9,"content":"int main() {}","file":"main.c"}`},
+		{"selected fields in canonical order", []string{"file", "name", "line"}, `{"name":"main","line":3,"file":"main.c"}`},
+		{"omitempty field stays omitted", []string{"name", "typeref"}, `{"name":"main"}`},
+		{"zero line kept", []string{"end"}, `{"end":9}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(info.SelectFields(tt.fields))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("marshal = %s, want %s", data, tt.want)
+			}
+		})
+	}
+
+	// SelectFields返回副本，不影响原值的序列化
+	_ = info.SelectFields([]string{"name"})
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"content"`) {
+		t.Errorf("original value lost fields: %s", data)
+	}
+
+	// 响应中的每个元素各自选择字段
+	response := SymbolResponse{Status: "success", ResList: []SymbolInfo{info.SelectFields([]string{"name"})}}
+	data, err = json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"status":"success","res_list":[{"name":"main"}]}`; string(data) != want {
+		t.Errorf("marshal = %s, want %s", data, want)
+	}
+}
@@ -0,0 +1,18 @@
+// 嵌套定义示例：第9行的helper调用同时位于outer和Local::run中，应解析为最内层的run
+int helper();
+
+int outer()
+{
+    struct Local {
+        int run()
+        {
+            return helper();
+        }
+    };
+    return Local().run();
+}
+
+int helper()
+{
+    return 1;
+}